@@ -1,88 +1,24 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/csv"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
 
-	"github.com/adrg/strutil"
-	"github.com/adrg/strutil/metrics"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/stats"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
 )
 
 const MAX_RESULTS = 5
 
-var COMPARE_METRIC = metrics.Levenshtein{
-	CaseSensitive: true,
-	InsertCost:    1,
-	ReplaceCost:   2,
-	DeleteCost:    1,
-}
-
-type JSONLines struct {
-	toClose []io.ReadCloser
-	scanner *bufio.Scanner
-}
-
-func (jl *JSONLines) Load(path string) error {
-	if len(jl.toClose) > 0 {
-		jl.Close()
-	}
-
-	var reader io.ReadCloser
-	reader, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
-	}
-	jl.toClose = append(jl.toClose, reader)
-
-	if strings.HasSuffix(path, ".gz") {
-		reader, err = gzip.NewReader(reader)
-		if err != nil {
-			return err
-		}
-		jl.toClose = append(jl.toClose, reader)
-	}
-	jl.scanner = bufio.NewScanner(reader)
-
-	return nil
-}
-
-func (jl *JSONLines) Close() {
-	for idx := len(jl.toClose) - 1; idx >= 0; idx-- {
-		jl.toClose[idx].Close()
-	}
-	jl.toClose = nil
-	jl.scanner = nil
-}
-
-func (jl *JSONLines) Next(item interface{}) error {
-	if !jl.scanner.Scan() {
-		err := jl.scanner.Err()
-		jl.Close()
-		if err == nil {
-			return io.EOF
-		}
-		return fmt.Errorf("scanner: %w", err)
-	}
-
-	line := jl.scanner.Bytes()
-
-	err := json.Unmarshal(line, item)
-	if err != nil {
-		jl.Close()
-		return fmt.Errorf("json: %w", err)
-	}
-	return nil
-}
-
 type WikidataItem struct {
 	ID             string
 	Name           string
@@ -105,36 +41,13 @@ type PossibleMatch struct {
 	Options []*Result
 }
 
-func normalizeName(s string) string {
-	s = strings.ToLower(s)
-	s = strings.ReplaceAll(s, ".", "")
-	s = strings.ReplaceAll(s, " ltd", " ")
-	s = strings.ReplaceAll(s, " limited", " ")
-	s = strings.ReplaceAll(s, " gmbh", " ")
-	s = strings.ReplaceAll(s, " productions", " PROD")
-	s = strings.ReplaceAll(s, " production", " PROD")
-	s = strings.ReplaceAll(s, " international", " INT")
-	s = strings.ReplaceAll(s, " corporation", " CORP")
-	s = strings.ReplaceAll(s, " entertainment", " ENM")
-	return s
-}
-
-func stringInSlice(key string, values []string) bool {
-	for _, v := range values {
-		if key == v {
-			return true
-		}
-	}
-	return false
-}
-
-func loadTmdbItems(path string) ([]*TMDBItem, error) {
-	var items []*TMDBItem
-
-	var tmdbData JSONLines
-	err := tmdbData.Load(os.Args[1])
+// forEachTmdbItem streams the TMDB export so only the items with candidates
+// are kept in memory
+func forEachTmdbItem(path string, fn func(item *TMDBItem)) error {
+	var tmdbData fileio.JSONLines
+	err := tmdbData.Load(path)
 	if err != nil {
-		return nil, fmt.Errorf("load: %w", err)
+		return fmt.Errorf("load: %w", err)
 	}
 
 	defer tmdbData.Close()
@@ -145,18 +58,18 @@ func loadTmdbItems(path string) ([]*TMDBItem, error) {
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("next: %w", err)
+			return fmt.Errorf("next: %w", err)
 		}
 
-		item.NormalizedName = normalizeName(item.Name)
-		items = append(items, &item)
+		item.NormalizedName = matching.NormalizeName(item.Name)
+		fn(&item)
 	}
 
-	return items, nil
+	return nil
 }
 
 func loadWikidataItems(path string) ([]*WikidataItem, error) {
-	var seenIDs []string
+	var seenIDs = make(map[string]bool)
 
 	var items []*WikidataItem
 
@@ -184,42 +97,43 @@ func loadWikidataItems(path string) ([]*WikidataItem, error) {
 			Name: line[1],
 		}
 
-		if stringInSlice(item.ID, seenIDs) {
+		if seenIDs[item.ID] {
 			continue
 		}
 
-		item.NormalizedName = normalizeName(item.Name)
-		seenIDs = append(seenIDs, item.ID)
+		item.NormalizedName = matching.NormalizeName(item.Name)
+		seenIDs[item.ID] = true
 		items = append(items, &item)
 	}
 
 	return items, nil
 }
 
-func compare(a string, b string) float64 {
-	lena := len(a)
-	lenb := len(b)
-	if lena > (lenb+10) || lena < (lenb-10) {
-		return 0 // Hard fail
-	}
-	score := strutil.Similarity(a, b, &COMPARE_METRIC)
-	return score
-}
-
-func joinTheDots(tmdbItems []*TMDBItem, wikidataItems []*WikidataItem) []*PossibleMatch {
+func joinTheDots(tmdbPath string, wikidataItems []*WikidataItem, store *decisions.Store) ([]*PossibleMatch, error) {
 	// var tmdbNoMatch []*TMDBItem
-	var matches []*PossibleMatch = make([]*PossibleMatch, 0, len(tmdbItems)/2)
+	var matches []*PossibleMatch
+
+	var wikidataByID = make(map[string]*WikidataItem, len(wikidataItems))
+	for _, witem := range wikidataItems {
+		wikidataByID[witem.ID] = witem
+	}
 
-	for idx, titem := range tmdbItems {
+	idx := 0
+	err := forEachTmdbItem(tmdbPath, func(titem *TMDBItem) {
 		if idx%1000 == 0 {
 			fmt.Printf("%d: %d %s\n", idx, titem.ID, titem.Name)
 		}
+		idx += 1
+		tmdbID := strconv.FormatInt(titem.ID, 10)
 		var topResults []*Result = make([]*Result, 0, MAX_RESULTS)
 		for _, witem := range wikidataItems {
-			score := compare(titem.NormalizedName, witem.NormalizedName)
+			score := matching.CompareNames(titem.NormalizedName, witem.NormalizedName)
 			if score < 0.5 { // Not a chance
 				continue
 			}
+			if store.IsRejected(tmdbID, witem.ID) {
+				continue
+			}
 			result := &Result{
 				Item:  witem,
 				Score: score,
@@ -227,9 +141,19 @@ func joinTheDots(tmdbItems []*TMDBItem, wikidataItems []*WikidataItem) []*Possib
 			topResults = addToTopN(topResults, result, MAX_RESULTS)
 		}
 
+		// accepted pairs are always the first option whatever the name score
+		pinned := false
+		if accepted := store.Accepted(tmdbID); accepted != nil && wikidataByID[accepted.QID] != nil {
+			topResults = pinResult(topResults, &Result{
+				Item:  wikidataByID[accepted.QID],
+				Score: matching.CompareNames(titem.NormalizedName, wikidataByID[accepted.QID].NormalizedName),
+			})
+			pinned = true
+		}
+
 		resultsLength := len(topResults)
-		if resultsLength == 0 || topResults[0].Score < 0.65 {
-			continue
+		if !pinned && (resultsLength == 0 || topResults[0].Score < 0.65) {
+			return
 		}
 
 		if topResults[0].Score == 1.0 && resultsLength == 1 {
@@ -247,9 +171,9 @@ func joinTheDots(tmdbItems []*TMDBItem, wikidataItems []*WikidataItem) []*Possib
 			TMDB:    titem,
 			Options: topResults,
 		})
-	}
+	})
 
-	return matches
+	return matches, err
 }
 
 func remove[T comparable](slice []T, s T) []T {
@@ -261,6 +185,20 @@ func remove[T comparable](slice []T, s T) []T {
 	return slice
 }
 
+// Move or insert the result at the start of the slice, keeping the length within MAX_RESULTS
+func pinResult(haystack []*Result, needle *Result) []*Result {
+	for idx, result := range haystack {
+		if result.Item == needle.Item {
+			haystack = append(haystack[:idx], haystack[idx+1:]...)
+			break
+		}
+	}
+	if len(haystack) >= MAX_RESULTS {
+		haystack = haystack[:MAX_RESULTS-1]
+	}
+	return append([]*Result{needle}, haystack...)
+}
+
 // Add to slice, keep the top scores only
 // As a side effect the result will be sorted if this is used from a blank haystack
 func addToTopN(haystack []*Result, needle *Result, limit int) []*Result {
@@ -314,34 +252,95 @@ func saveMatches(path string, matches []*PossibleMatch) error {
 	return w.Error()
 }
 
+// savePairs replaces the candidate pairs in the pipeline store with the matches
+func savePairs(path string, matches []*PossibleMatch) error {
+	db, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var pairs []*store.Pair
+	for row, match := range matches {
+		for rank, result := range match.Options {
+			pairs = append(pairs, &store.Pair{
+				TmdbID:       strconv.FormatInt(match.TMDB.ID, 10),
+				TmdbName:     match.TMDB.Name,
+				QID:          result.Item.ID,
+				WikidataName: result.Item.Name,
+				// rounded as in the csv, so both give the same scores
+				NameScore: roundScore(result.Score),
+				Rank:      rank,
+				Row:       row,
+			})
+		}
+	}
+	err = db.ReplacePairs(pairs)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func roundScore(score float64) float64 {
+	rounded, _ := strconv.ParseFloat(fmt.Sprintf("%0.6f", score), 64)
+	return rounded
+}
+
 // FUTURE - compare ids of movies / tv to correlate
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: go run main.go <tmdb data> <wikidata data> <output>")
+	showStats := flag.Bool("stats", false, "print the run time and peak memory")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <tmdb data> <wikidata data> <output> [decisions csv]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	tmdbItems, err := loadTmdbItems(os.Args[1])
+	var run *stats.Run
+	if *showStats {
+		run = stats.Start("001_titlecompare")
+	}
+
+	decisionsPath := flag.Arg(3)
+
+	decisionStore, err := store.LoadDecisions(decisionsPath)
 	if err != nil {
-		fmt.Println("Error while loading tmdb data:", err)
+		fmt.Println("Error while loading decisions:", err)
 		return
 	}
 
-	wikidataItems, err := loadWikidataItems(os.Args[2])
+	wikidataItems, err := loadWikidataItems(flag.Arg(1))
 	if err != nil {
 		fmt.Println("Error while loading wikidata:", err)
 		return
 	}
 
-	matches := joinTheDots(tmdbItems, wikidataItems)
+	matches, err := joinTheDots(flag.Arg(0), wikidataItems, decisionStore)
+	if err != nil {
+		fmt.Println("Error while loading tmdb data:", err)
+		return
+	}
 
 	sort.Slice(matches, func(i int, j int) bool {
 		return matches[i].Options[0].Score > matches[j].Options[0].Score
 	})
 
-	err = saveMatches(os.Args[3], matches)
+	if store.IsStorePath(flag.Arg(2)) {
+		err = savePairs(flag.Arg(2), matches)
+	} else {
+		err = saveMatches(flag.Arg(2), matches)
+	}
 	if err != nil {
 		fmt.Println("Error while saving matches:", err)
 		return
 	}
+
+	if run != nil {
+		run.Report()
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+)
+
+// Sizes of the full inputs, see large inputs in the README
+const BENCH_TMDB_COMPANIES = 150000
+const BENCH_WIKIDATA_COMPANIES = 20000
+
+// Live heap allowed while reading the inputs, checked after a collection so
+// garbage not yet collected does not count. The export is read one line at a
+// time, so almost nothing of it stays live, and the wikidata companies hold
+// about 150 bytes each
+const TMDB_EXPORT_HEAP_LIMIT = 4 << 20
+const WIKIDATA_ITEMS_HEAP_LIMIT = 8 << 20
+
+// Companies read from the export between checks of the heap
+const BENCH_CHECKPOINT_EVERY = 10000
+
+func benchName(idx int) string {
+	return "Company " + strconv.Itoa(idx) + " Pictures"
+}
+
+func writeBenchExport(b *testing.B, count int) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "production_company_ids.json.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for idx := 1; idx <= count; idx++ {
+		if err := encoder.Encode(map[string]interface{}{"id": idx, "name": benchName(idx)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// writeBenchWikidataCompanies writes every company twice, as the query
+// service does for a company with two logos
+func writeBenchWikidataCompanies(b *testing.B, count int) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "wikidata-companies.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	csvWriter := csv.NewWriter(f)
+	for copies := 0; copies < 2; copies++ {
+		for idx := 1; idx <= count; idx++ {
+			err := csvWriter.Write([]string{"http://www.wikidata.org/entity/Q" + strconv.Itoa(idx), benchName(idx), ""})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func BenchmarkForEachTmdbItem(b *testing.B) {
+	path := writeBenchExport(b, BENCH_TMDB_COMPANIES)
+	heap := &testutil.HeapLimit{Limit: TMDB_EXPORT_HEAP_LIMIT}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		err := forEachTmdbItem(path, func(item *TMDBItem) {
+			count += 1
+			if count%BENCH_CHECKPOINT_EVERY == 0 {
+				heap.Checkpoint(b)
+			}
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if count != BENCH_TMDB_COMPANIES {
+			b.Fatalf("read %d companies, expected %d", count, BENCH_TMDB_COMPANIES)
+		}
+	}
+	b.StopTimer()
+	heap.Check(b)
+}
+
+func BenchmarkLoadWikidataItems(b *testing.B) {
+	path := writeBenchWikidataCompanies(b, BENCH_WIKIDATA_COMPANIES)
+	heap := &testutil.HeapLimit{Limit: WIKIDATA_ITEMS_HEAP_LIMIT}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		items, err := loadWikidataItems(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		heap.Checkpoint(b)
+		// the items are measured while they are still in use
+		runtime.KeepAlive(items)
+		if len(items) != BENCH_WIKIDATA_COMPANIES {
+			b.Fatalf("loaded %d companies, expected %d", len(items), BENCH_WIKIDATA_COMPANIES)
+		}
+	}
+	b.StopTimer()
+	heap.Check(b)
+}
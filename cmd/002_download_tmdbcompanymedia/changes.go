@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+// TMDB only lists changes for up to 14 days per request
+const CHANGES_WINDOW_DAYS = 14
+
+// Saved next to the media mapping, holds the date the last changes run started
+const CHANGES_STATE_SUFFIX = ".changes_since"
+
+type TMDBChangesResponse struct {
+	Results []struct {
+		ID int64 `json:"id"`
+	} `json:"results"`
+	Page       int64 `json:"page"`
+	TotalPages int64 `json:"total_pages"`
+}
+
+func tmdbGetChangedIDs(client *http.Client, tmdbAPIKey string, mediaType string, from time.Time, to time.Time) ([]string, error) {
+	var ids []string
+	var totalPages int64 = 1
+	for page := int64(1); page <= totalPages; page++ {
+		var values = url.Values{}
+		values.Set("api_key", tmdbAPIKey)
+		values.Set("start_date", from.Format("2006-01-02"))
+		values.Set("end_date", to.Format("2006-01-02"))
+		values.Set("page", strconv.FormatInt(page, 10))
+		fullURL := TMDB_API_URL + "/3/" + mediaType + "/changes?" + values.Encode()
+
+		resp, err := client.Get(fullURL)
+		if err != nil {
+			return nil, fmt.Errorf("error while retrieving %s: %w", fullURL, err)
+		}
+		if err := checkResponse(resp, fullURL); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		var response TMDBChangesResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshalling %s changes response: %w", mediaType, err)
+		}
+
+		for _, result := range response.Results {
+			ids = append(ids, strconv.FormatInt(result.ID, 10))
+		}
+		totalPages = response.TotalPages
+	}
+	return ids, nil
+}
+
+func loadChangesSince(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errCast, ok := err.(*fs.PathError); ok && errCast.Err == syscall.ENOENT {
+			return time.Time{}, nil // no previous run
+		}
+		return time.Time{}, err
+	}
+	return time.Parse("2006-01-02", strings.TrimSpace(string(data)))
+}
+
+func saveChangesSince(path string, since time.Time) error {
+	err := os.WriteFile(path+".tmp", []byte(since.Format("2006-01-02")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func mediaKey(mediaType string, tmdbID string) string {
+	return mediaType + "/" + tmdbID
+}
+
+// indexMedia maps each media item to the ids of the companies that list it
+func indexMedia(companiesLUT map[string]*Company) map[string][]string {
+	var index = make(map[string][]string)
+	for companyID, company := range companiesLUT {
+		for _, media := range company.Media {
+			key := mediaKey(media.MediaType, media.TmdbID)
+			index[key] = append(index[key], companyID)
+		}
+	}
+	return index
+}
+
+// patchCompanies applies a changed media item to the companies already in the
+// lut, returning the ids of the companies that were modified
+func patchCompanies(companiesLUT map[string]*Company, index map[string][]string, changed *MediaCompanies) []string {
+	companyIDs := append([]string{}, index[mediaKey(changed.MediaType, changed.TmdbID)]...)
+	for _, companyID := range changed.CompanyIDs {
+		// companies not in the lut are left for discover
+		if _, exists := companiesLUT[companyID]; exists && fileio.FindInSlice(companyIDs, companyID) == -1 {
+			companyIDs = append(companyIDs, companyID)
+		}
+	}
+
+	var patched []string
+	for _, companyID := range companyIDs {
+		company := companiesLUT[companyID]
+		inCompany := changed.Media != nil && fileio.FindInSlice(changed.CompanyIDs, companyID) != -1
+
+		var medias = make([]*Media, 0, len(company.Media)+1)
+		found := false
+		modified := false
+		for _, media := range company.Media {
+			if media.MediaType != changed.MediaType || media.TmdbID != changed.TmdbID {
+				medias = append(medias, media)
+				continue
+			}
+			found = true
+			if !inCompany {
+				modified = true // no longer produced by this company
+				continue
+			}
+			if *media != *changed.Media {
+				modified = true
+			}
+			medias = append(medias, changed.Media)
+		}
+		if inCompany && !found {
+			medias = append(medias, changed.Media)
+			modified = true
+		}
+
+		if modified {
+			company.Media = medias
+			patched = append(patched, companyID)
+		}
+	}
+	return patched
+}
+
+// runChanges patches the media mapping with the movies and tv shows changed
+// since the last run, instead of running discover for every company again
+func runChanges(client *http.Client, tmdbAPIKey string, mediaMappingCSVPath string, since time.Time, workers int) error {
+	statePath := mediaMappingCSVPath + CHANGES_STATE_SUFFIX
+	if since.IsZero() {
+		var err error
+		since, err = loadChangesSince(statePath)
+		if err != nil {
+			return fmt.Errorf("error while reading %s: %w", statePath, err)
+		}
+		if since.IsZero() {
+			return fmt.Errorf("no previous changes run recorded in %s, use -since", statePath)
+		}
+	}
+
+	companiesLUT, db, err := openLUT(mediaMappingCSVPath)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		defer db.Close()
+	}
+
+	// changes made during this run are picked up by the next one
+	started := time.Now().UTC().Truncate(24 * time.Hour)
+
+	var keys []MediaRef
+	var seen = make(map[MediaRef]bool)
+	for _, mediaType := range []string{"movie", "tv"} {
+		for from := since; !from.After(started); from = from.AddDate(0, 0, CHANGES_WINDOW_DAYS) {
+			to := from.AddDate(0, 0, CHANGES_WINDOW_DAYS-1)
+			if to.After(started) {
+				to = started
+			}
+			ids, err := tmdbGetChangedIDs(client, tmdbAPIKey, mediaType, from, to)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				key := MediaRef{MediaType: mediaType, TmdbID: id}
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	fmt.Printf("%d media changed since %s\n", len(keys), since.Format("2006-01-02"))
+
+	bar := newProgressBar(len(keys), "Getting changed media...")
+	// fetched concurrently, then applied in feed order
+	changes, err := tmdbGetMediaCompaniesBatch(client, tmdbAPIKey, keys, workers, bar)
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+
+	index := indexMedia(companiesLUT)
+	var patched = make(map[string]bool)
+	for _, changed := range changes {
+		for _, companyID := range patchCompanies(companiesLUT, index, changed) {
+			patched[companyID] = true
+		}
+	}
+
+	var patchedIDs []string
+	for companyID := range patched {
+		patchedIDs = append(patchedIDs, companyID)
+	}
+	sort.Strings(patchedIDs)
+	fmt.Printf("\n%d companies updated\n", len(patchedIDs))
+
+	if db != nil {
+		for _, companyID := range patchedIDs {
+			err = db.PutCompany(companyToStore(companiesLUT[companyID]))
+			if err != nil {
+				return err
+			}
+		}
+	} else if len(patchedIDs) > 0 {
+		err = saveLUT(companiesLUT, mediaMappingCSVPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return saveChangesSince(statePath, started)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/tmdbstub"
+)
+
+// serveRecorded points TMDB_API_URL at the recorded responses under dir
+func serveRecorded(t *testing.T, dir string) {
+	t.Helper()
+	server := httptest.NewServer(tmdbstub.Handler(dir, nil))
+	previous := TMDB_API_URL
+	TMDB_API_URL = server.URL
+	t.Cleanup(func() {
+		TMDB_API_URL = previous
+		server.Close()
+	})
+}
+
+func copyFile(t *testing.T, from string, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestChanges replays the recorded change feeds onto the recorded mapping
+func TestChanges(t *testing.T) {
+	fixture := "../../testdata/tmdb_changes"
+	serveRecorded(t, filepath.Join(fixture, "responses"))
+
+	mappingPath := filepath.Join(t.TempDir(), "tmdb_media_mapping.csv")
+	copyFile(t, filepath.Join(fixture, "tmdb_media_mapping.csv"), mappingPath)
+
+	since := time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+	err := runChanges(http.DefaultClient, "x", mappingPath, since, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CompareCSV(t, mappingPath, filepath.Join(fixture, "expected_media_mapping.csv"))
+}
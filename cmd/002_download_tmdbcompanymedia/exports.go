@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Media fetched between saves of the mapping and the progress file
+const EXPORTS_CHUNK_SIZE = 500
+
+// Saved next to the media mapping so an interrupted build can carry on
+const EXPORTS_PROGRESS_SUFFIX = ".exports_progress"
+
+// Changed with -exports-url to use a mirror
+var TMDB_EXPORTS_URL = "http://files.tmdb.org/p/exports"
+
+// Daily export file name prefix for each media type
+var EXPORT_FILES = map[string]string{
+	"movie": "movie_ids",
+	"tv":    "tv_series_ids",
+}
+
+type ExportEntry struct {
+	ID    int64 `json:"id"`
+	Adult bool  `json:"adult"`
+	Video bool  `json:"video"`
+}
+
+type ExportsProgress struct {
+	ExportDate string `json:"export_date"`
+	// number of export entries already applied for each media type
+	Done map[string]int `json:"done"`
+}
+
+func exportURL(mediaType string, exportDate time.Time) string {
+	return TMDB_EXPORTS_URL + "/" + EXPORT_FILES[mediaType] + "_" + exportDate.Format("01_02_2006") + ".json.gz"
+}
+
+// readExportIDs reads the ids from a daily export, given as a url or a local
+// file. Adult and video entries are skipped as discover leaves them out too.
+func readExportIDs(client *http.Client, location string) ([]string, error) {
+	var reader io.ReadCloser
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, fmt.Errorf("error while retrieving %s: %w", location, err)
+		}
+		if err := checkResponse(resp, location); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		reader = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		reader = f
+	}
+	defer reader.Close()
+
+	var source io.Reader = reader
+	if strings.HasSuffix(location, ".gz") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		source = gz
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		var entry ExportEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", location, err)
+		}
+		if entry.Adult || entry.Video {
+			continue
+		}
+		ids = append(ids, strconv.FormatInt(entry.ID, 10))
+	}
+	return ids, scanner.Err()
+}
+
+func loadExportsProgress(path string) (*ExportsProgress, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errCast, ok := err.(*fs.PathError); ok && errCast.Err == syscall.ENOENT {
+			return nil, nil // fresh build
+		}
+		return nil, err
+	}
+	var progress ExportsProgress
+	err = json.Unmarshal(data, &progress)
+	return &progress, err
+}
+
+func saveExportsProgress(path string, progress *ExportsProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// addToCompanies inverts a media item into the lut, creating companies as
+// needed, and returns the ids of the companies it was added to
+func addToCompanies(companiesLUT map[string]*Company, mc *MediaCompanies, fetchedAt time.Time) []string {
+	if mc.Media == nil {
+		return nil // removed since the export was made
+	}
+	var touched []string
+	for idx, companyID := range mc.CompanyIDs {
+		company, exists := companiesLUT[companyID]
+		if !exists {
+			company = &Company{
+				TmdbID: companyID,
+				Name:   mc.CompanyNames[idx],
+			}
+			companiesLUT[companyID] = company
+		}
+		found := false
+		for _, media := range company.Media {
+			if media.MediaType == mc.MediaType && media.TmdbID == mc.TmdbID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			company.Media = append(company.Media, mc.Media)
+		}
+		// every title is walked, so the media list is complete
+		company.FetchedAt = fetchedAt
+		company.PagesComplete = true
+		company.TotalResults = int64(len(company.Media))
+		touched = append(touched, companyID)
+	}
+	return touched
+}
+
+// runExports builds the whole mapping by walking the daily id exports and
+// fetching production_companies for each title once
+func runExports(client *http.Client, tmdbAPIKey string, mediaMappingCSVPath string, exportDate time.Time, locations map[string]string, workers int) error {
+	progressPath := mediaMappingCSVPath + EXPORTS_PROGRESS_SUFFIX
+	progress, err := loadExportsProgress(progressPath)
+	if err != nil {
+		return fmt.Errorf("error while reading %s: %w", progressPath, err)
+	}
+
+	companiesLUT, db, err := openLUT(mediaMappingCSVPath)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		defer db.Close()
+	}
+
+	if progress == nil {
+		if len(companiesLUT) > 0 {
+			return fmt.Errorf("%s already has companies, build into a new mapping", mediaMappingCSVPath)
+		}
+		progress = &ExportsProgress{
+			ExportDate: exportDate.Format("2006-01-02"),
+			Done:       make(map[string]int),
+		}
+		err = saveExportsProgress(progressPath, progress)
+		if err != nil {
+			return err
+		}
+	} else if progress.ExportDate != exportDate.Format("2006-01-02") {
+		return fmt.Errorf("%s is for the %s export, remove it and the mapping to start again", progressPath, progress.ExportDate)
+	}
+
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	for _, mediaType := range []string{"movie", "tv"} {
+		location := locations[mediaType]
+		if location == "" {
+			location = exportURL(mediaType, exportDate)
+		}
+		ids, err := readExportIDs(client, location)
+		if err != nil {
+			return err
+		}
+		done := progress.Done[mediaType]
+		if done >= len(ids) {
+			continue
+		}
+		fmt.Printf("%s: %d of %d already done\n", mediaType, done, len(ids))
+
+		bar := newProgressBar(len(ids)-done, "Getting "+mediaType+" companies...")
+		for done < len(ids) {
+			end := done + EXPORTS_CHUNK_SIZE
+			if end > len(ids) {
+				end = len(ids)
+			}
+			var refs []MediaRef
+			for _, id := range ids[done:end] {
+				refs = append(refs, MediaRef{MediaType: mediaType, TmdbID: id})
+			}
+			results, err := tmdbGetMediaCompaniesBatch(client, tmdbAPIKey, refs, workers, bar)
+			if err != nil {
+				return err
+			}
+
+			var touched = make(map[string]bool)
+			for _, mc := range results {
+				for _, companyID := range addToCompanies(companiesLUT, mc, fetchedAt) {
+					touched[companyID] = true
+				}
+			}
+
+			done = end
+			progress.Done[mediaType] = done
+			// rewriting a csv after every chunk would rewrite the whole mapping
+			// thousands of times, so only a store saves as it goes
+			if db == nil {
+				continue
+			}
+
+			// the mapping is saved before the progress so a crash only repeats work
+			var touchedIDs []string
+			for companyID := range touched {
+				touchedIDs = append(touchedIDs, companyID)
+			}
+			sort.Strings(touchedIDs)
+			for _, companyID := range touchedIDs {
+				err = db.PutCompany(companyToStore(companiesLUT[companyID]))
+				if err != nil {
+					return err
+				}
+			}
+			err = saveExportsProgress(progressPath, progress)
+			if err != nil {
+				return err
+			}
+		}
+		bar.Finish()
+		fmt.Println()
+	}
+
+	if db == nil {
+		err = saveLUT(companiesLUT, mediaMappingCSVPath)
+		if err != nil {
+			return err
+		}
+		err = saveExportsProgress(progressPath, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%d companies in mapping\n", len(companiesLUT))
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+)
+
+// TestExports builds the mapping from the recorded exports and titles
+func TestExports(t *testing.T) {
+	fixture := "../../testdata/tmdb_exports"
+	serveRecorded(t, filepath.Join(fixture, "responses"))
+
+	mappingPath := filepath.Join(t.TempDir(), "exports_mapping.csv")
+	locations := map[string]string{
+		"movie": filepath.Join(fixture, "movie_ids.json"),
+		"tv":    filepath.Join(fixture, "tv_series_ids.json"),
+	}
+	exportDate := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	err := runExports(http.DefaultClient, "x", mappingPath, exportDate, locations, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fetched_at is the time of the run
+	testutil.CompareCSV(t, mappingPath, filepath.Join(fixture, "expected_media_mapping.csv"), "fetched_at")
+}
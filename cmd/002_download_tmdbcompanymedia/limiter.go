@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TMDB allows roughly 50 requests per second per IP, stay a bit under it
+const DEFAULT_REQUEST_RATE = 40.0
+const DEFAULT_REQUEST_BURST = 10
+
+// Slowest rate the limiter will back off to after repeated 429s
+const MIN_REQUEST_RATE = 1.0
+
+const MAX_RETRIES = 5
+const DEFAULT_RETRY_AFTER = 1 * time.Second
+const MAX_BACKOFF = 30 * time.Second
+
+// TokenBucket is a rate limiter shared by every worker. It halves its rate
+// when the server says to slow down and creeps back up on each success.
+type TokenBucket struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second
+	maxRate     float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:    rate,
+		maxRate: rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// Wait blocks until a request may be sent
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		var wait time.Duration
+		if now.Before(b.pausedUntil) {
+			wait = b.pausedUntil.Sub(now)
+		} else if b.tokens >= 1 {
+			b.tokens -= 1
+			b.mu.Unlock()
+			return nil
+		} else {
+			wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Throttle pauses all requests for retryAfter and halves the rate
+func (b *TokenBucket) Throttle(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(retryAfter); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+	b.rate /= 2
+	if b.rate < MIN_REQUEST_RATE {
+		b.rate = MIN_REQUEST_RATE
+	}
+	b.tokens = 0
+}
+
+// Success slowly restores the rate after a throttle
+func (b *TokenBucket) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate < b.maxRate {
+		b.rate += b.maxRate / 100
+		if b.rate > b.maxRate {
+			b.rate = b.maxRate
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return DEFAULT_RETRY_AFTER
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return DEFAULT_RETRY_AFTER
+}
+
+// LimitedTransport sends every request through the token bucket and retries
+// responses of 429 Too Many Requests and 5xx server errors. It is the only
+// layer that retries, the base transport must not retry as well
+type LimitedTransport struct {
+	Base    http.RoundTripper
+	Limiter *TokenBucket
+	// First wait before retrying a server error, doubled on each retry.
+	// DEFAULT_RETRY_AFTER when zero
+	Backoff time.Duration
+}
+
+func (t *LimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	backoff := t.Backoff
+	if backoff == 0 {
+		backoff = DEFAULT_RETRY_AFTER
+	}
+	for attempt := 0; ; attempt++ {
+		if err := t.Limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			t.Limiter.Success()
+			return resp, nil
+		}
+		if attempt >= MAX_RETRIES {
+			return resp, nil
+		}
+
+		// drain so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// every worker slows down, not just this one
+			t.Limiter.Throttle(parseRetryAfter(resp.Header.Get("Retry-After")))
+			continue
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+// checkResponse turns an unexpected status into an error
+func checkResponse(resp *http.Response, fullURL string) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d while retrieving %s", resp.StatusCode, fullURL)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveStatuses answers each request with the next of statuses, then with 200
+func serveStatuses(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(atomic.AddInt32(&attempts, 1)) - 1
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		if attempt < len(statuses) {
+			w.WriteHeader(statuses[attempt])
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+func limitedGet(t *testing.T, transport *LimitedTransport, url string) *http.Response {
+	t.Helper()
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	bucket := NewTokenBucket(100, 2)
+
+	start := time.Now()
+	for idx := 0; idx < 3; idx++ {
+		if err := bucket.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the burst is free, the third waits for a token at 100 per second
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("3 requests with a burst of 2 took %s, expected about 10ms", elapsed)
+	}
+
+	bucket.Throttle(50 * time.Millisecond)
+	if bucket.rate != 50 {
+		t.Errorf("rate after a throttle is %0.1f, expected 50", bucket.rate)
+	}
+	start = time.Now()
+	if err := bucket.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waited %s after a throttle of 50ms", elapsed)
+	}
+
+	for idx := 0; idx < 60; idx++ {
+		bucket.Success()
+	}
+	if bucket.rate != bucket.maxRate {
+		t.Errorf("rate after 60 successes is %0.1f, expected it restored to %0.1f", bucket.rate, bucket.maxRate)
+	}
+
+	// never slower than the minimum rate
+	for idx := 0; idx < 20; idx++ {
+		bucket.Throttle(0)
+	}
+	if bucket.rate != MIN_REQUEST_RATE {
+		t.Errorf("rate after repeated throttles is %0.2f, expected %0.1f", bucket.rate, MIN_REQUEST_RATE)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := bucket.Wait(cancelled); err != context.Canceled {
+		t.Errorf("Wait on a cancelled context returned %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":                              DEFAULT_RETRY_AFTER,
+		"3":                             3 * time.Second,
+		"soon":                          DEFAULT_RETRY_AFTER,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0,
+	}
+	for value, expected := range cases {
+		if wait := parseRetryAfter(value); wait != expected {
+			t.Errorf("parseRetryAfter(%q) = %s, expected %s", value, wait, expected)
+		}
+	}
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(later); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %s, expected about an hour", later, wait)
+	}
+}
+
+// TestLimitedTransportTooManyRequests checks a 429 pauses for Retry-After and
+// slows the shared limiter before the retry
+func TestLimitedTransportTooManyRequests(t *testing.T) {
+	server, attempts := serveStatuses(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+	limiter := NewTokenBucket(1000, 10)
+
+	start := time.Now()
+	resp := limitedGet(t, &LimitedTransport{Limiter: limiter}, server.URL)
+	if resp.StatusCode != http.StatusOK || *attempts != 2 {
+		t.Errorf("got %d after %d attempts, expected 200 after 2", resp.StatusCode, *attempts)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, expected the Retry-After of 1s", elapsed)
+	}
+	// halved, then raised a little by the success
+	if limiter.rate >= limiter.maxRate {
+		t.Errorf("rate is %0.1f after a 429, expected it below %0.1f", limiter.rate, limiter.maxRate)
+	}
+}
+
+// TestLimitedTransportServerError checks 5xx responses are retried after a
+// backoff without slowing the shared limiter
+func TestLimitedTransportServerError(t *testing.T) {
+	server, attempts := serveStatuses(t, nil, http.StatusServiceUnavailable, http.StatusBadGateway)
+	limiter := NewTokenBucket(1000, 10)
+
+	start := time.Now()
+	resp := limitedGet(t, &LimitedTransport{Limiter: limiter, Backoff: 10 * time.Millisecond}, server.URL)
+	if resp.StatusCode != http.StatusOK || *attempts != 3 {
+		t.Errorf("got %d after %d attempts, expected 200 after 3", resp.StatusCode, *attempts)
+	}
+	// 10ms, then doubled to 20ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("2 retries took %s, expected at least 30ms of backoff", elapsed)
+	}
+	if limiter.rate != limiter.maxRate {
+		t.Errorf("rate is %0.1f after server errors, expected %0.1f", limiter.rate, limiter.maxRate)
+	}
+}
+
+// TestLimitedTransportRetryCap checks the last response is returned once the
+// retries run out, and that a client error is not retried
+func TestLimitedTransportRetryCap(t *testing.T) {
+	statuses := make([]int, MAX_RETRIES+2)
+	for idx := range statuses {
+		statuses[idx] = http.StatusInternalServerError
+	}
+	server, attempts := serveStatuses(t, nil, statuses...)
+	transport := &LimitedTransport{Limiter: NewTokenBucket(1000, 10), Backoff: time.Millisecond}
+
+	resp := limitedGet(t, transport, server.URL)
+	if resp.StatusCode != http.StatusInternalServerError || *attempts != MAX_RETRIES+1 {
+		t.Errorf("got %d after %d attempts, expected 500 after %d", resp.StatusCode, *attempts, MAX_RETRIES+1)
+	}
+
+	server, attempts = serveStatuses(t, nil, http.StatusNotFound)
+	resp = limitedGet(t, transport, server.URL)
+	if resp.StatusCode != http.StatusNotFound || *attempts != 1 {
+		t.Errorf("got %d after %d attempts, expected 404 after 1", resp.StatusCode, *attempts)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,17 +13,32 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rohfle/quickiedata"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
 	"github.com/schollz/progressbar/v3"
 )
 
 const SAVE_BATCH_SIZE = 20
 
+// Changed with -api-url to replay recorded responses from a local server
+var TMDB_API_URL = "https://api.themoviedb.org"
+
+const DEFAULT_WORKERS = 4
+
+// Pages of one discover query fetched at the same time
+const PAGE_WORKERS = 2
+
+// TMDB allows 20 connections per IP
+const MAX_CONNECTIONS = 20
+
 type Media struct {
 	MediaType  string
 	TmdbID     string
@@ -32,9 +49,63 @@ type Media struct {
 }
 
 type Company struct {
-	TmdbID string
-	Name   string
-	Media  []*Media
+	TmdbID        string
+	Name          string
+	OriginCountry string
+	LogoPath      string
+	Homepage      string
+	Media         []*Media
+	// true when discover could not list all of the media, even split by date
+	Truncated bool
+	// zero when the cached company was saved before fetches were tracked
+	FetchedAt     time.Time
+	TotalResults  int64
+	PagesComplete bool
+	// false when the cached company was saved before details were retrieved
+	DetailsChecked bool
+}
+
+// Columns recording how a company was fetched
+var FETCH_COLUMNS = []string{"truncated", "fetched_at", "pages_complete", "total_results", "details_checked"}
+
+func (c *Company) fetchValues() []string {
+	fetchedAt := ""
+	if !c.FetchedAt.IsZero() {
+		fetchedAt = c.FetchedAt.Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatBool(c.Truncated),
+		fetchedAt,
+		strconv.FormatBool(c.PagesComplete),
+		strconv.FormatInt(c.TotalResults, 10),
+		strconv.FormatBool(c.DetailsChecked),
+	}
+}
+
+func (c *Company) setFetchValue(column string, value string) {
+	switch column {
+	case "truncated":
+		c.Truncated = value == "true"
+	case "fetched_at":
+		c.FetchedAt, _ = time.Parse(time.RFC3339, value)
+	case "pages_complete":
+		c.PagesComplete = value == "true"
+	case "total_results":
+		c.TotalResults, _ = strconv.ParseInt(value, 10, 64)
+	case "details_checked":
+		// older files only had the detail columns once every company had details
+		if value != "" {
+			c.DetailsChecked = value == "true"
+		}
+	}
+}
+
+type TMDBCompanyResponse struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	OriginCountry string `json:"origin_country"`
+	LogoPath      string `json:"logo_path"`
+	Homepage      string `json:"homepage"`
 }
 
 type TMDBDiscoverMovieResponse struct {
@@ -45,7 +116,8 @@ type TMDBDiscoverMovieResponse struct {
 		Title       string  `json:"title"`
 		ReleaseDate string  `json:"release_date"`
 	} `json:"results"`
-	TotalPages int64 `json:"total_pages"`
+	TotalPages   int64 `json:"total_pages"`
+	TotalResults int64 `json:"total_results"`
 }
 
 type TMDBDiscoverTVResponse struct {
@@ -56,36 +128,69 @@ type TMDBDiscoverTVResponse struct {
 		Name         string  `json:"name"`
 		FirstAirDate string  `json:"first_air_date"`
 	} `json:"results"`
-	TotalPages int64 `json:"total_pages"`
+	TotalPages   int64 `json:"total_pages"`
+	TotalResults int64 `json:"total_results"`
+}
+
+// TMDB discover refuses pages above 500, so one query returns at most 10000 results
+const MAX_PAGES = 500
+const MAX_DISCOVER_RESULTS = MAX_PAGES * 20
+
+// Bounds used once a query has to be split by date
+var DISCOVER_EARLIEST = time.Date(1870, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const DISCOVER_YEARS_AHEAD = 20
+
+// Date filter used to split each media type
+var DISCOVER_DATE_FIELDS = map[string]string{
+	"movie": "primary_release_date",
+	"tv":    "first_air_date",
 }
 
-// TODO: multiple pages - get all results
-func tmdbRequestCompanyMediaActual(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string, page int64) ([]*Media, int64, error) {
+// DateRange is an inclusive range of days, nil means unfiltered
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+type DiscoverPage struct {
+	Medias       []*Media
+	TotalPages   int64
+	TotalResults int64
+}
+
+func tmdbRequestCompanyMediaActual(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string, dateRange *DateRange, page int64) (*DiscoverPage, error) {
 	if mediaType != "movie" && mediaType != "tv" {
-		return nil, 0, fmt.Errorf("tmdbRequestCompanyMedia: invalid mediaType %s", mediaType)
+		return nil, fmt.Errorf("tmdbRequestCompanyMedia: invalid mediaType %s", mediaType)
 	}
 
-	baseURL := "https://api.themoviedb.org/3/discover/" + mediaType
+	baseURL := TMDB_API_URL + "/3/discover/" + mediaType
 	var values = url.Values{}
 	values.Set("api_key", tmdbAPIKey)
 	values.Set("with_companies", tmdbCompanyID)
 	values.Set("page", strconv.FormatInt(page, 10))
+	if dateRange != nil {
+		values.Set(DISCOVER_DATE_FIELDS[mediaType]+".gte", dateRange.From.Format("2006-01-02"))
+		values.Set(DISCOVER_DATE_FIELDS[mediaType]+".lte", dateRange.To.Format("2006-01-02"))
+	}
 	fullURL := baseURL + "?" + values.Encode()
 
 	resp, err := client.Get(fullURL)
 	if err != nil {
-		return nil, 0, fmt.Errorf("error while retrieving %s: %w", fullURL, err)
+		return nil, fmt.Errorf("error while retrieving %s: %w", fullURL, err)
 	}
 	defer resp.Body.Close()
+	if err := checkResponse(resp, fullURL); err != nil {
+		return nil, err
+	}
 
-	var medias []*Media
-	var pages int64
+	var discovered DiscoverPage
 
 	if mediaType == "movie" {
 		var response TMDBDiscoverMovieResponse
 		err := json.NewDecoder(resp.Body).Decode(&response)
 		if err != nil {
-			return nil, 0, fmt.Errorf("error while unmarshalling discover movie response: %w", err)
+			return nil, fmt.Errorf("error while unmarshalling discover movie response: %w", err)
 		}
 		for _, result := range response.Results {
 			media := &Media{
@@ -96,14 +201,15 @@ func tmdbRequestCompanyMediaActual(client *http.Client, tmdbAPIKey string, tmdbC
 				Poster:     result.PosterPath,
 				Year:       strings.SplitN(result.ReleaseDate, "-", 2)[0],
 			}
-			medias = append(medias, media)
+			discovered.Medias = append(discovered.Medias, media)
 		}
-		pages = response.TotalPages
+		discovered.TotalPages = response.TotalPages
+		discovered.TotalResults = response.TotalResults
 	} else if mediaType == "tv" {
 		var response TMDBDiscoverTVResponse
 		err := json.NewDecoder(resp.Body).Decode(&response)
 		if err != nil {
-			return nil, 0, fmt.Errorf("error while unmarshalling discover tv response: %w", err)
+			return nil, fmt.Errorf("error while unmarshalling discover tv response: %w", err)
 		}
 		for _, result := range response.Results {
 			media := &Media{
@@ -114,30 +220,51 @@ func tmdbRequestCompanyMediaActual(client *http.Client, tmdbAPIKey string, tmdbC
 				Poster:     result.PosterPath,
 				Year:       strings.SplitN(result.FirstAirDate, "-", 2)[0],
 			}
-			medias = append(medias, media)
+			discovered.Medias = append(discovered.Medias, media)
 		}
-		pages = response.TotalPages
+		discovered.TotalPages = response.TotalPages
+		discovered.TotalResults = response.TotalResults
 	}
-	return medias, pages, nil
+	return &discovered, nil
 }
 
-func tmdbRequestCompanyMedia(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string) ([]*Media, error) {
-	var page int64
-	var totalPages int64 = 1
-	const MAX_PAGES = 1000
+// tmdbRequestRemainingPages gets the pages after first, up to MAX_PAGES
+func tmdbRequestRemainingPages(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string, dateRange *DateRange, first *DiscoverPage) ([]*Media, error) {
+	totalPages := first.TotalPages
+	if totalPages > MAX_PAGES {
+		totalPages = MAX_PAGES
+	}
+	if totalPages <= 1 {
+		return first.Medias, nil
+	}
 
-	var allmedias []*Media
+	// remaining pages are fetched concurrently but kept in page order
+	pages := make([][]*Media, totalPages)
+	errs := make([]error, totalPages)
+	pages[0] = first.Medias
 
-	for page = 1; page <= totalPages; page++ {
-		medias, pageCount, err := tmdbRequestCompanyMediaActual(client, tmdbAPIKey, tmdbCompanyID, mediaType, page)
-		if err != nil {
-			return nil, err
-		}
-		if page == 1 {
-			if pageCount > MAX_PAGES {
-				pageCount = MAX_PAGES
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, PAGE_WORKERS)
+	for page := int64(2); page <= totalPages; page++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(page int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := tmdbRequestCompanyMediaActual(client, tmdbAPIKey, tmdbCompanyID, mediaType, dateRange, page)
+			if err != nil {
+				errs[page-1] = err
+				return
 			}
-			totalPages = pageCount
+			pages[page-1] = result.Medias
+		}(page)
+	}
+	wg.Wait()
+
+	var allmedias []*Media
+	for idx, medias := range pages {
+		if errs[idx] != nil {
+			return nil, errs[idx]
 		}
 		allmedias = append(allmedias, medias...)
 	}
@@ -145,25 +272,180 @@ func tmdbRequestCompanyMedia(client *http.Client, tmdbAPIKey string, tmdbCompany
 	return allmedias, nil
 }
 
-func tmdbGetCompanyMedia(client *http.Client, tmdbAPIKey string, tmdbCompanyID string) ([]*Media, error) {
-	medias, err := tmdbRequestCompanyMedia(client, tmdbAPIKey, tmdbCompanyID, "movie")
+// tmdbRequestCompanyMediaRange halves dateRange until each part fits in one
+// query. Returns true if a single day still has too many results.
+func tmdbRequestCompanyMediaRange(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string, dateRange DateRange) ([]*Media, bool, error) {
+	first, err := tmdbRequestCompanyMediaActual(client, tmdbAPIKey, tmdbCompanyID, mediaType, &dateRange, 1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	days := int(dateRange.To.Sub(dateRange.From).Hours() / 24)
+	if first.TotalResults <= MAX_DISCOVER_RESULTS || days < 1 {
+		medias, err := tmdbRequestRemainingPages(client, tmdbAPIKey, tmdbCompanyID, mediaType, &dateRange, first)
+		return medias, first.TotalResults > MAX_DISCOVER_RESULTS, err
+	}
+
+	middle := dateRange.From.AddDate(0, 0, days/2)
+	medias, truncated, err := tmdbRequestCompanyMediaRange(client, tmdbAPIKey, tmdbCompanyID, mediaType, DateRange{From: dateRange.From, To: middle})
+	if err != nil {
+		return nil, false, err
+	}
+	medias2, truncated2, err := tmdbRequestCompanyMediaRange(client, tmdbAPIKey, tmdbCompanyID, mediaType, DateRange{From: middle.AddDate(0, 0, 1), To: dateRange.To})
+	if err != nil {
+		return nil, false, err
+	}
+	return append(medias, medias2...), truncated || truncated2, nil
+}
+
+// uniqueMedia removes media repeated when results shift between pages
+func uniqueMedia(medias []*Media) []*Media {
+	var seen = make(map[string]bool, len(medias))
+	var unique = make([]*Media, 0, len(medias))
+	for _, media := range medias {
+		if seen[media.TmdbID] {
+			continue
+		}
+		seen[media.TmdbID] = true
+		unique = append(unique, media)
+	}
+	return unique
+}
+
+type MediaList struct {
+	Medias []*Media
+	// as reported by discover for the whole, unsplit query
+	TotalResults int64
+	Truncated    bool
+}
+
+// tmdbRequestCompanyMedia gets all media of one type for a company, splitting
+// the query by date when there are more results than discover will page through
+func tmdbRequestCompanyMedia(client *http.Client, tmdbAPIKey string, tmdbCompanyID string, mediaType string) (*MediaList, error) {
+	first, err := tmdbRequestCompanyMediaActual(client, tmdbAPIKey, tmdbCompanyID, mediaType, nil, 1)
 	if err != nil {
 		return nil, err
 	}
-	medias2, err := tmdbRequestCompanyMedia(client, tmdbAPIKey, tmdbCompanyID, "tv")
+
+	result := &MediaList{TotalResults: first.TotalResults}
+
+	if first.TotalResults <= MAX_DISCOVER_RESULTS {
+		medias, err := tmdbRequestRemainingPages(client, tmdbAPIKey, tmdbCompanyID, mediaType, nil, first)
+		if err != nil {
+			return nil, err
+		}
+		result.Medias = uniqueMedia(medias)
+		return result, nil
+	}
+
+	dateRange := DateRange{
+		From: DISCOVER_EARLIEST,
+		To:   time.Now().UTC().AddDate(DISCOVER_YEARS_AHEAD, 0, 0).Truncate(24 * time.Hour),
+	}
+	medias, truncated, err := tmdbRequestCompanyMediaRange(client, tmdbAPIKey, tmdbCompanyID, mediaType, dateRange)
 	if err != nil {
 		return nil, err
 	}
-	return append(medias, medias2...), nil
+	result.Medias = uniqueMedia(medias)
+	// media without a date, or dated outside the range, can not be reached by splitting
+	result.Truncated = truncated || int64(len(result.Medias)) < first.TotalResults
+	return result, nil
 }
 
-func FindInSlice(haystack []string, needle string) int {
-	for idx, hay := range haystack {
-		if hay == needle {
-			return idx
+func tmdbGetCompanyDetails(client *http.Client, tmdbAPIKey string, company *Company) error {
+	var values = url.Values{}
+	values.Set("api_key", tmdbAPIKey)
+	fullURL := TMDB_API_URL + "/3/company/" + url.PathEscape(company.TmdbID) + "?" + values.Encode()
+
+	resp, err := client.Get(fullURL)
+	if err != nil {
+		return fmt.Errorf("error while retrieving %s: %w", fullURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		company.DetailsChecked = true
+		return nil // company removed from tmdb
+	}
+	if err := checkResponse(resp, fullURL); err != nil {
+		return err
+	}
+
+	var response TMDBCompanyResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("error while unmarshalling company response: %w", err)
+	}
+
+	company.OriginCountry = response.OriginCountry
+	company.LogoPath = response.LogoPath
+	company.Homepage = response.Homepage
+	company.DetailsChecked = true
+	return nil
+}
+
+// tmdbGetCompanyMedia replaces the media of company, recording when and how completely it was fetched
+func tmdbGetCompanyMedia(client *http.Client, tmdbAPIKey string, company *Company) error {
+	var tvMedias *MediaList
+	var tvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tvMedias, tvErr = tmdbRequestCompanyMedia(client, tmdbAPIKey, company.TmdbID, "tv")
+	}()
+
+	movieMedias, err := tmdbRequestCompanyMedia(client, tmdbAPIKey, company.TmdbID, "movie")
+	<-done
+	if err != nil {
+		return err
+	}
+	if tvErr != nil {
+		return tvErr
+	}
+
+	// movies always come before tv whichever finishes first
+	company.Media = append(movieMedias.Medias, tvMedias.Medias...)
+	company.Truncated = movieMedias.Truncated || tvMedias.Truncated
+	company.TotalResults = movieMedias.TotalResults + tvMedias.TotalResults
+	// fewer than reported means results moved between pages while paging
+	company.PagesComplete = int64(len(company.Media)) >= company.TotalResults
+	company.FetchedAt = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+// needsFetch returns why the media of a cached company should be downloaded
+// again, or an empty string when it is fresh and complete
+func needsFetch(company *Company, maxAge time.Duration, now time.Time) string {
+	if company.FetchedAt.IsZero() {
+		// saved before fetches were tracked, a full first page may have more after it
+		if len(company.Media) >= 20 {
+			return "unknown completeness"
 		}
+		if maxAge > 0 {
+			return "unknown age"
+		}
+		return ""
+	}
+	if maxAge > 0 && now.Sub(company.FetchedAt) > maxAge {
+		return "stale"
+	}
+	// truncated companies can not be completed, only refreshed once stale
+	if !company.PagesComplete && !company.Truncated {
+		return "incomplete"
 	}
-	return -1
+	return ""
+}
+
+// parseMaxAge accepts a go duration or a number of days such as 30d
+func parseMaxAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid max age %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
 }
 
 func estimateRowCount(path string) (int, error) {
@@ -191,31 +473,42 @@ func estimateRowCount(path string) (int, error) {
 	}
 }
 
-func loadLUT(path string) (map[string]*Company, error) {
-	var companiesLUT = make(map[string]*Company)
+// forEachLUTCompany reads the mapping one company at a time, so a mapping can
+// be copied without holding it. A company is passed once for each run of
+// rows, which is once for a mapping written by saveLUT.
+func forEachLUTCompany(path string, fn func(company *Company) error) error {
 	f, err := os.Open(path)
 	if err != nil {
 		if errCast, ok := err.(*fs.PathError); ok && errCast.Err == syscall.ENOENT {
-			return companiesLUT, nil // no such file - this is ok, just return an empty lut
+			return nil // no such file - this is ok, there are no companies yet
 		}
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
 	csvReader := csv.NewReader(f)
 	// read headers
-	_, err = csvReader.Read()
+	headers, err := csvReader.Read()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	// older files do not have company details
+	originCountryIdx := fileio.FindInSlice(headers, "origin_country")
+	logoPathIdx := fileio.FindInSlice(headers, "logo_path")
+	homepageIdx := fileio.FindInSlice(headers, "homepage")
+	var fetchIdxs = make([]int, len(FETCH_COLUMNS))
+	for idx, column := range FETCH_COLUMNS {
+		fetchIdxs[idx] = fileio.FindInSlice(headers, column)
 	}
 
+	var company *Company
 	for {
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		companyID := record[0]
@@ -233,13 +526,27 @@ func loadLUT(path string) (map[string]*Company, error) {
 			continue
 		}
 
-		company, exists := companiesLUT[companyID]
-		if !exists {
+		if company == nil || company.TmdbID != companyID {
+			if company != nil {
+				if err := fn(company); err != nil {
+					return err
+				}
+			}
 			company = &Company{
 				TmdbID: companyID,
 				Name:   companyName,
 			}
-			companiesLUT[companyID] = company
+			if originCountryIdx != -1 && logoPathIdx != -1 && homepageIdx != -1 {
+				company.OriginCountry = record[originCountryIdx]
+				company.LogoPath = record[logoPathIdx]
+				company.Homepage = record[homepageIdx]
+				company.DetailsChecked = true
+			}
+			for idx, column := range FETCH_COLUMNS {
+				if fetchIdxs[idx] != -1 {
+					company.setFetchValue(column, record[fetchIdxs[idx]])
+				}
+			}
 		}
 
 		if media.TmdbID != "" {
@@ -247,10 +554,38 @@ func loadLUT(path string) (map[string]*Company, error) {
 		}
 
 	}
+	if company != nil {
+		return fn(company)
+	}
+	return nil
+}
+
+// loadLUTFor loads the companies in companyIDs from the mapping, or every
+// company when companyIDs is nil
+func loadLUTFor(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	var companiesLUT = make(map[string]*Company)
+	err := forEachLUTCompany(path, func(company *Company) error {
+		if companyIDs != nil && !companyIDs[company.TmdbID] {
+			return nil
+		}
+		if existing, exists := companiesLUT[company.TmdbID]; exists {
+			existing.Media = append(existing.Media, company.Media...)
+			return nil
+		}
+		companiesLUT[company.TmdbID] = company
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return companiesLUT, nil
 }
 
-func saveLUT(companiesLUT map[string]*Company, path string) error {
+func loadLUT(path string) (map[string]*Company, error) {
+	return loadLUTFor(path, nil)
+}
+
+func writeLUTFile(path string, fn func(csvWriter *csv.Writer) error) error {
 	f, err := os.Create(path + ".tmp")
 	if err != nil {
 		return err
@@ -259,43 +594,15 @@ func saveLUT(companiesLUT map[string]*Company, path string) error {
 
 	csvWriter := csv.NewWriter(f)
 	// write headers
-	err = csvWriter.Write([]string{"company_id", "company_name", "id", "type", "title", "year", "popularity", "poster"})
+	headers := []string{"company_id", "company_name", "id", "type", "title", "year", "popularity", "poster", "origin_country", "logo_path", "homepage"}
+	err = csvWriter.Write(append(headers, FETCH_COLUMNS...))
 	if err != nil {
 		return err
 	}
 
-	for _, company := range companiesLUT {
-		if len(company.Media) == 0 {
-			err = csvWriter.Write([]string{
-				company.TmdbID,
-				company.Name,
-				"",
-				"",
-				"",
-				"",
-				"",
-				"",
-			})
-			if err != nil {
-				return err
-			}
-		} else {
-			for _, media := range company.Media {
-				err = csvWriter.Write([]string{
-					company.TmdbID,
-					company.Name,
-					media.TmdbID,
-					media.MediaType,
-					media.Title,
-					media.Year,
-					media.Popularity,
-					media.Poster,
-				})
-				if err != nil {
-					return err
-				}
-			}
-		}
+	err = fn(csvWriter)
+	if err != nil {
+		return err
 	}
 
 	csvWriter.Flush()
@@ -308,31 +615,325 @@ func saveLUT(companiesLUT map[string]*Company, path string) error {
 		return err
 	}
 
-	err = os.Rename(path+".tmp", path)
+	return os.Rename(path+".tmp", path)
+}
+
+func writeLUTCompany(csvWriter *csv.Writer, company *Company) error {
+	details := append([]string{company.OriginCountry, company.LogoPath, company.Homepage}, company.fetchValues()...)
+	if len(company.Media) == 0 {
+		return csvWriter.Write(append([]string{
+			company.TmdbID,
+			company.Name,
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+		}, details...))
+	}
+	for _, media := range company.Media {
+		err := csvWriter.Write(append([]string{
+			company.TmdbID,
+			company.Name,
+			media.TmdbID,
+			media.MediaType,
+			media.Title,
+			media.Year,
+			media.Popularity,
+			media.Poster,
+		}, details...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedIDs returns the company ids of the lut, so the output does not depend
+// on the order companies were fetched in
+func sortedIDs(companiesLUT map[string]*Company) []string {
+	companyIDs := make([]string, 0, len(companiesLUT))
+	for companyID := range companiesLUT {
+		companyIDs = append(companyIDs, companyID)
+	}
+	sort.Strings(companyIDs)
+	return companyIDs
+}
+
+func saveLUT(companiesLUT map[string]*Company, path string) error {
+	return writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		for _, companyID := range sortedIDs(companiesLUT) {
+			if err := writeLUTCompany(csvWriter, companiesLUT[companyID]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeLUT saves the companies of the lut over those in the mapping at path,
+// copying the other companies through one at a time, so only the companies
+// being fetched are held in memory. A mapping not written by saveLUT is loaded whole and
+// saved sorted instead
+func mergeLUT(companiesLUT map[string]*Company, path string) error {
+	err := mergeSortedLUT(companiesLUT, path)
+	if err != errUnsorted {
+		return err
+	}
+	fullLUT, err := loadLUT(path)
 	if err != nil {
 		return err
 	}
+	for companyID, company := range companiesLUT {
+		fullLUT[companyID] = company
+	}
+	return saveLUT(fullLUT, path)
+}
 
-	return nil
+// errUnsorted stops a merge of a mapping whose companies are out of order or
+// split over several runs of rows
+var errUnsorted = errors.New("mapping is not sorted by company id")
+
+// mergeSortedLUT merges the lut into a mapping sorted by company id
+func mergeSortedLUT(companiesLUT map[string]*Company, path string) error {
+	companyIDs := sortedIDs(companiesLUT)
+	return writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		next := 0
+		previous := ""
+		err := forEachLUTCompany(path, func(company *Company) error {
+			if previous != "" && company.TmdbID <= previous {
+				return errUnsorted
+			}
+			previous = company.TmdbID
+			for ; next < len(companyIDs) && companyIDs[next] < company.TmdbID; next++ {
+				if err := writeLUTCompany(csvWriter, companiesLUT[companyIDs[next]]); err != nil {
+					return err
+				}
+			}
+			if _, exists := companiesLUT[company.TmdbID]; exists {
+				return nil
+			}
+			return writeLUTCompany(csvWriter, company)
+		})
+		if err != nil {
+			return err
+		}
+		for ; next < len(companyIDs); next++ {
+			if err := writeLUTCompany(csvWriter, companiesLUT[companyIDs[next]]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func companyToStore(company *Company) *store.Company {
+	result := &store.Company{
+		Source: store.SOURCE_TMDB,
+		ID:     company.TmdbID,
+		Name:   company.Name,
+		Details: map[string]string{
+			"origin_country": company.OriginCountry,
+			"logo_path":      company.LogoPath,
+			"homepage":       company.Homepage,
+		},
+		DetailsChecked: company.DetailsChecked,
+	}
+	for idx, value := range company.fetchValues() {
+		result.Details[FETCH_COLUMNS[idx]] = value
+	}
+	for _, media := range company.Media {
+		result.Media = append(result.Media, &store.Media{
+			ID:         media.TmdbID,
+			Type:       media.MediaType,
+			Title:      media.Title,
+			Year:       media.Year,
+			Popularity: media.Popularity,
+			Poster:     media.Poster,
+		})
+	}
+	return result
+}
+
+func companyFromStore(c *store.Company) *Company {
+	company := &Company{
+		TmdbID:         c.ID,
+		Name:           c.Name,
+		OriginCountry:  c.Details["origin_country"],
+		LogoPath:       c.Details["logo_path"],
+		Homepage:       c.Details["homepage"],
+		DetailsChecked: c.DetailsChecked,
+	}
+	for _, column := range FETCH_COLUMNS {
+		company.setFetchValue(column, c.Details[column])
+	}
+	for _, media := range c.Media {
+		company.Media = append(company.Media, &Media{
+			MediaType:  media.Type,
+			TmdbID:     media.ID,
+			Title:      media.Title,
+			Year:       media.Year,
+			Popularity: media.Popularity,
+			Poster:     media.Poster,
+		})
+	}
+	return company
+}
+
+func loadStoreLUT(db *store.Store) (map[string]*Company, error) {
+	var companiesLUT = make(map[string]*Company)
+	err := db.ForEachCompany(store.SOURCE_TMDB, func(c *store.Company) error {
+		company := companyFromStore(c)
+		companiesLUT[company.TmdbID] = company
+		return nil
+	})
+	return companiesLUT, err
+}
+
+// loadStoreCompany reads one company from the store, or nil if it is not there
+func loadStoreCompany(db *store.Store, tmdbID string) (*Company, error) {
+	c, err := db.Company(store.SOURCE_TMDB, tmdbID)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return companyFromStore(c), nil
+}
+
+// openLUT loads the media mapping. A .db mapping also returns the store so it
+// can be updated one company at a time instead of rewriting the csv
+func openLUT(path string) (map[string]*Company, *store.Store, error) {
+	if !store.IsStorePath(path) {
+		companiesLUT, err := loadLUT(path)
+		return companiesLUT, nil, err
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	companiesLUT, err := loadStoreLUT(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return companiesLUT, db, nil
+}
+
+type fetchJob struct {
+	// copy of the cached company, only touched by the worker that has it
+	Company    *Company
+	FetchMedia bool
+}
+
+type fetchResult struct {
+	Company *Company
+	Err     error
+}
+
+func fetchWorker(client *http.Client, tmdbAPIKey string, jobs <-chan *fetchJob, results chan<- *fetchResult) {
+	for job := range jobs {
+		company := job.Company
+		var err error
+		if job.FetchMedia {
+			err = tmdbGetCompanyMedia(client, tmdbAPIKey, company)
+		}
+		if err == nil {
+			err = tmdbGetCompanyDetails(client, tmdbAPIKey, company)
+		}
+		results <- &fetchResult{Company: company, Err: err}
+	}
 }
 
 func main() {
+	workers := flag.Int("workers", DEFAULT_WORKERS, "number of companies fetched at the same time")
+	requestRate := flag.Float64("rate", DEFAULT_REQUEST_RATE, "maximum requests per second sent to TMDB")
+	var maxAge time.Duration
+	flag.Func("max-age", "re-fetch media older than this, eg 720h or 30d (default never)", func(value string) error {
+		var err error
+		maxAge, err = parseMaxAge(value)
+		return err
+	})
+	changes := flag.Bool("changes", false, "patch the mapping from the TMDB changes feed instead of running discover")
+	var since time.Time
+	flag.Func("since", "with -changes, read changes from this date (default the last changes run)", func(value string) error {
+		var err error
+		since, err = time.Parse("2006-01-02", value)
+		return err
+	})
+	strategy := flag.String("strategy", "discover", "discover media for the companies in the title compare csv, or walk the daily id exports for every company")
+	// exports are published for the previous day
+	exportDate := time.Now().UTC().AddDate(0, 0, -1)
+	flag.Func("export-date", "with -strategy exports, date of the exports to walk (default yesterday)", func(value string) error {
+		var err error
+		exportDate, err = time.Parse("2006-01-02", value)
+		return err
+	})
+	var exportLocations = make(map[string]string)
+	flag.Func("movie-ids", "with -strategy exports, local path or url of the movie_ids export", func(value string) error {
+		exportLocations["movie"] = value
+		return nil
+	})
+	flag.Func("tv-ids", "with -strategy exports, local path or url of the tv_series_ids export", func(value string) error {
+		exportLocations["tv"] = value
+		return nil
+	})
+	flag.StringVar(&TMDB_API_URL, "api-url", TMDB_API_URL, "TMDB api url")
+	flag.StringVar(&TMDB_EXPORTS_URL, "exports-url", TMDB_EXPORTS_URL, "TMDB daily exports url")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run . [options] <title compare csv> <tmdb media mapping>")
+		fmt.Println("       go run . -changes [options] <tmdb media mapping>")
+		fmt.Println("       go run . -strategy exports [options] <tmdb media mapping>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	mappingOnly := *changes || *strategy == "exports"
+	if *strategy != "discover" && *strategy != "exports" {
+		fmt.Printf("Unknown strategy %s\n", *strategy)
+		os.Exit(1)
+	}
+	if flag.NArg() < 2 && !(mappingOnly && flag.NArg() == 1) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	client := quickiedata.QuickieHTTPClient(&quickiedata.HTTPClientSettings{
 		UserAgent:       "quickiedata (rohfle@gmail.com) Wikidata:Property_proposal/TMDB_company_ID",
-		RequestInterval: 300 * time.Millisecond,
-		Backoff:         1 * time.Second,
-		MaxBackoff:      30 * time.Second,
-		MaxRetries:      5,
-		MaxConnsPerHost: 1,
+		RequestInterval: 0, // paced by the shared limiter instead
+		// retried by LimitedTransport, which also slows every worker on a 429.
+		// Retrying here as well would multiply the attempts per request
+		MaxRetries:      0,
+		MaxConnsPerHost: MAX_CONNECTIONS,
 	})
+	client.Transport = &LimitedTransport{
+		Base:    client.Transport,
+		Limiter: NewTokenBucket(*requestRate, DEFAULT_REQUEST_BURST),
+	}
 
-	compareCSVPath := os.Args[1]
-	mediaMappingCSVPath := os.Args[2]
 	TMDB_API_KEY := os.Getenv("TMDB_API_KEY")
 	if TMDB_API_KEY == "" {
 		log.Fatal("TMDB_API_KEY environment variable not set")
 	}
 
+	if *changes {
+		err := runChanges(client, TMDB_API_KEY, flag.Arg(flag.NArg()-1), since, *workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *strategy == "exports" {
+		err := runExports(client, TMDB_API_KEY, flag.Arg(flag.NArg()-1), exportDate, exportLocations, *workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	compareCSVPath := flag.Arg(0)
+	mediaMappingCSVPath := flag.Arg(1)
+
 	rowCount, err := estimateRowCount(compareCSVPath)
 	if err != nil {
 		log.Fatal(err)
@@ -355,25 +956,94 @@ func main() {
 		log.Fatal(err)
 	}
 
-	tmdbIDIdx := FindInSlice(headers, "tmdbID")
-	tmdbNameIdx := FindInSlice(headers, "tmdbName")
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdbID")
+	tmdbNameIdx := fileio.FindInSlice(headers, "tmdbName")
 
 	if tmdbIDIdx == -1 ||
 		tmdbNameIdx == -1 {
 		log.Fatal("Invalid CSV given: must have fields tmdbID, tmdbName")
 	}
 
-	companiesLUT, err := loadLUT(mediaMappingCSVPath)
-	if err != nil {
-		log.Fatal(err)
+	var candidates []*Company
+	var seen = make(map[string]bool)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tmdbID := record[tmdbIDIdx]
+		if tmdbID == "" || seen[tmdbID] {
+			continue
+		}
+		seen[tmdbID] = true
+		candidates = append(candidates, &Company{
+			TmdbID: tmdbID,
+			Name:   record[tmdbNameIdx],
+		})
 	}
 
-	bar := progressbar.NewOptions(rowCount,
+	// a .db mapping is read one candidate at a time, and of a csv mapping only
+	// the candidates are loaded, instead of loading it all
+	var companiesLUT map[string]*Company
+	var db *store.Store
+	if store.IsStorePath(mediaMappingCSVPath) {
+		db, err = store.Open(mediaMappingCSVPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+	} else {
+		companiesLUT, err = loadLUTFor(mediaMappingCSVPath, seen)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var jobs []*fetchJob
+	var reasons = make(map[string]int)
+	now := time.Now()
+	for _, candidate := range candidates {
+		company, exists := companiesLUT[candidate.TmdbID]
+		if db != nil {
+			company, err = loadStoreCompany(db, candidate.TmdbID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			exists = company != nil
+		}
+		reason := "new"
+		if exists {
+			reason = needsFetch(company, maxAge, now)
+		}
+
+		if reason != "" {
+			reasons[reason] += 1
+			jobs = append(jobs, &fetchJob{
+				Company:    candidate,
+				FetchMedia: true,
+			})
+		} else if !company.DetailsChecked {
+			companyCopy := *company
+			jobs = append(jobs, &fetchJob{Company: &companyCopy})
+		}
+	}
+
+	fmt.Printf("Fetching media for companies: %v\n", reasons)
+	if len(jobs) == 0 {
+		fmt.Println("Nothing to do")
+		return
+	}
+
+	bar := progressbar.NewOptions(len(jobs),
 		progressbar.OptionSetWidth(15),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
 		progressbar.OptionShowDescriptionAtLineEnd(),
-		progressbar.OptionSetDescription("[cyan][1/3][reset] Writing moshable file..."),
+		progressbar.OptionSetDescription("Getting companies..."),
 		progressbar.OptionSetTheme(progressbar.Theme{
 			Saucer:        "[green]=[reset]",
 			SaucerHead:    "[green]>[reset]",
@@ -382,42 +1052,42 @@ func main() {
 			BarEnd:        "]",
 		}))
 
-	recordsUnsaved := 0
-	for {
-		bar.Describe("Reading rows...")
-		record, err := csvReader.Read()
-		bar.Add(1)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatal(err)
+	jobQueue := make(chan *fetchJob)
+	results := make(chan *fetchResult)
+	for idx := 0; idx < *workers; idx++ {
+		go fetchWorker(client, TMDB_API_KEY, jobQueue, results)
+	}
+	go func() {
+		for _, job := range jobs {
+			jobQueue <- job
 		}
+		close(jobQueue)
+	}()
 
-		tmdbID := record[tmdbIDIdx]
-		tmdbName := record[tmdbNameIdx]
-
-		if tmdbID == "" {
-			continue
+	// results arrive in any order, only this goroutine touches the lut
+	recordsUnsaved := 0
+	for range jobs {
+		result := <-results
+		if result.Err != nil {
+			log.Fatal(result.Err)
 		}
+		company := result.Company
+		bar.Describe("Got company " + company.TmdbID + " " + company.Name)
+		bar.Add(1)
 
-		if company, exists := companiesLUT[tmdbID]; !exists || len(company.Media) >= 20 {
-			companiesLUT[tmdbID] = &Company{
-				TmdbID: tmdbID,
-				Name:   tmdbName,
-			}
-			bar.Describe("Getting media for company " + tmdbID + " " + tmdbName)
-			medias, err := tmdbGetCompanyMedia(client, TMDB_API_KEY, tmdbID)
+		if db != nil {
+			err = db.PutCompany(companyToStore(company))
 			if err != nil {
 				log.Fatal(err)
 			}
-			companiesLUT[tmdbID].Media = medias
-			recordsUnsaved += 1
+			continue
 		}
 
+		companiesLUT[company.TmdbID] = company
+		recordsUnsaved += 1
 		if recordsUnsaved >= SAVE_BATCH_SIZE {
 			bar.Describe("Saving to disk...")
-			err := saveLUT(companiesLUT, mediaMappingCSVPath)
+			err := mergeLUT(companiesLUT, mediaMappingCSVPath)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -427,7 +1097,7 @@ func main() {
 
 	if recordsUnsaved > 0 {
 		bar.Describe("Saving to disk...")
-		err := saveLUT(companiesLUT, mediaMappingCSVPath)
+		err := mergeLUT(companiesLUT, mediaMappingCSVPath)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+)
+
+func lutCompany(tmdbID string, name string, mediaIDs ...string) *Company {
+	company := &Company{TmdbID: tmdbID, Name: name, DetailsChecked: true, OriginCountry: "US"}
+	for _, mediaID := range mediaIDs {
+		company.Media = append(company.Media, &Media{TmdbID: mediaID, MediaType: "movie", Title: "Title " + mediaID, Year: "2001"})
+	}
+	return company
+}
+
+// Merging only the fetched companies gives the mapping saving all of them would
+func TestMergeLUT(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tmdb_media_mapping.csv")
+	err := saveLUT(map[string]*Company{
+		"1":  lutCompany("1", "One", "11", "12"),
+		"10": lutCompany("10", "Ten", "101"),
+		"2":  lutCompany("2", "Two"),
+		"3":  lutCompany("3", "Three", "31"),
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	companiesLUT, err := loadLUTFor(path, map[string]bool{"10": true, "25": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(companiesLUT) != 1 || companiesLUT["10"] == nil {
+		t.Fatalf("loaded %d companies, expected only 10", len(companiesLUT))
+	}
+	companiesLUT["10"] = lutCompany("10", "Ten", "101", "102")
+	companiesLUT["25"] = lutCompany("25", "Twenty Five", "251")
+	if err := mergeLUT(companiesLUT, path); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := filepath.Join(dir, "expected.csv")
+	err = saveLUT(map[string]*Company{
+		"1":  lutCompany("1", "One", "11", "12"),
+		"10": lutCompany("10", "Ten", "101", "102"),
+		"2":  lutCompany("2", "Two"),
+		"25": lutCompany("25", "Twenty Five", "251"),
+		"3":  lutCompany("3", "Three", "31"),
+	}, expectedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CompareCSV(t, path, expectedPath)
+}
+
+// A mapping out of order, or with a company over two runs of rows, is saved
+// sorted with the fetched companies merged in
+func TestMergeLUTUnsorted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tmdb_media_mapping.csv")
+	err := writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		for _, company := range []*Company{
+			lutCompany("3", "Three", "31"),
+			lutCompany("1", "One", "11"),
+			lutCompany("10", "Ten", "101"),
+			lutCompany("1", "One", "12"),
+		} {
+			if err := writeLUTCompany(csvWriter, company); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mergeLUT(map[string]*Company{
+		"10": lutCompany("10", "Ten", "101", "102"),
+		"25": lutCompany("25", "Twenty Five", "251"),
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := filepath.Join(dir, "expected.csv")
+	err = saveLUT(map[string]*Company{
+		"1":  lutCompany("1", "One", "11", "12"),
+		"10": lutCompany("10", "Ten", "101", "102"),
+		"25": lutCompany("25", "Twenty Five", "251"),
+		"3":  lutCompany("3", "Three", "31"),
+	}, expectedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CompareCSV(t, path, expectedPath)
+}
+
+type discoverMovie struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	ReleaseDate string `json:"release_date"`
+}
+
+// serveDiscover points TMDB_API_URL at a discover endpoint over the movies of
+// each company, in id order, filtered by release date and paged like TMDB
+func serveDiscover(t *testing.T, companies map[string][]discoverMovie) *http.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		page, _ := strconv.Atoi(query.Get("page"))
+		if r.URL.Path != "/3/discover/movie" || page < 1 || page > MAX_PAGES {
+			http.Error(w, "invalid page", http.StatusBadRequest)
+			return
+		}
+		from, to := query.Get("primary_release_date.gte"), query.Get("primary_release_date.lte")
+		var movies []discoverMovie
+		for _, movie := range companies[query.Get("with_companies")] {
+			filtered := from != "" || to != ""
+			if filtered && (movie.ReleaseDate == "" || movie.ReleaseDate < from || movie.ReleaseDate > to) {
+				continue
+			}
+			movies = append(movies, movie)
+		}
+		start, end := (page-1)*20, page*20
+		if start > len(movies) {
+			start = len(movies)
+		}
+		if end > len(movies) {
+			end = len(movies)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results":       movies[start:end],
+			"total_pages":   (len(movies) + 19) / 20,
+			"total_results": len(movies),
+		})
+	}))
+	previous := TMDB_API_URL
+	TMDB_API_URL = server.URL
+	t.Cleanup(func() {
+		TMDB_API_URL = previous
+		server.Close()
+	})
+	return server.Client()
+}
+
+// discoverMovies returns count movies from firstID, released on days from
+// start, a day apart for days of 1 or more and undated for days of 0
+func discoverMovies(firstID int64, count int, start time.Time, days int) []discoverMovie {
+	var movies []discoverMovie
+	for idx := 0; idx < count; idx++ {
+		movie := discoverMovie{ID: firstID + int64(idx), Title: fmt.Sprintf("Movie %d", firstID+int64(idx))}
+		if days > 0 {
+			movie.ReleaseDate = start.AddDate(0, 0, idx%days).Format("2006-01-02")
+		}
+		movies = append(movies, movie)
+	}
+	return movies
+}
+
+// TestCompanyMediaSplit checks a company with more results than discover pages
+// through is split by date and merged back, and is marked truncated when a
+// single day is still too big or media have no date
+func TestCompanyMediaSplit(t *testing.T) {
+	day := time.Date(2010, 5, 5, 0, 0, 0, 0, time.UTC)
+	client := serveDiscover(t, map[string][]discoverMovie{
+		// spread over 3000 days, each half fits
+		"1": discoverMovies(1, MAX_DISCOVER_RESULTS+1000, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), 3000),
+		// one day over the limit, only its first 500 pages can be fetched
+		"2": append(discoverMovies(1, MAX_DISCOVER_RESULTS+500, day, 1), discoverMovies(100001, 100, day.AddDate(0, 0, 1), 100)...),
+		// undated media are lost once the query is split
+		"3": append(discoverMovies(1, MAX_DISCOVER_RESULTS+1, day, 100), discoverMovies(100001, 10, day, 0)...),
+	})
+
+	cases := []struct {
+		companyID string
+		total     int64
+		fetched   int
+		truncated bool
+	}{
+		{"1", MAX_DISCOVER_RESULTS + 1000, MAX_DISCOVER_RESULTS + 1000, false},
+		{"2", MAX_DISCOVER_RESULTS + 600, MAX_DISCOVER_RESULTS + 100, true},
+		{"3", MAX_DISCOVER_RESULTS + 11, MAX_DISCOVER_RESULTS + 1, true},
+	}
+	// the media are unique, so fetching all of them means every part was merged
+	for _, c := range cases {
+		result, err := tmdbRequestCompanyMedia(client, "key", c.companyID, "movie")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.TotalResults != c.total || len(result.Medias) != c.fetched || result.Truncated != c.truncated {
+			t.Errorf("company %s: got %d of %d, truncated %v, expected %d of %d, truncated %v", c.companyID,
+				len(result.Medias), result.TotalResults, result.Truncated, c.fetched, c.total, c.truncated)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+type TMDBMediaResponse struct {
+	ID                  int64   `json:"id"`
+	Title               string  `json:"title"`
+	Name                string  `json:"name"`
+	ReleaseDate         string  `json:"release_date"`
+	FirstAirDate        string  `json:"first_air_date"`
+	Popularity          float64 `json:"popularity"`
+	PosterPath          string  `json:"poster_path"`
+	ProductionCompanies []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"production_companies"`
+}
+
+type MediaRef struct {
+	MediaType string
+	TmdbID    string
+}
+
+// MediaCompanies is a media item with the companies that produced it
+type MediaCompanies struct {
+	MediaType string
+	TmdbID    string
+	// nil when the media was removed from TMDB
+	Media        *Media
+	CompanyIDs   []string
+	CompanyNames []string
+}
+
+func tmdbGetMediaCompanies(client *http.Client, tmdbAPIKey string, mediaType string, tmdbID string) (*MediaCompanies, error) {
+	var values = url.Values{}
+	values.Set("api_key", tmdbAPIKey)
+	fullURL := TMDB_API_URL + "/3/" + mediaType + "/" + url.PathEscape(tmdbID) + "?" + values.Encode()
+
+	resp, err := client.Get(fullURL)
+	if err != nil {
+		return nil, fmt.Errorf("error while retrieving %s: %w", fullURL, err)
+	}
+	defer resp.Body.Close()
+
+	changed := &MediaCompanies{MediaType: mediaType, TmdbID: tmdbID}
+	if resp.StatusCode == http.StatusNotFound {
+		return changed, nil // media removed from tmdb
+	}
+	if err := checkResponse(resp, fullURL); err != nil {
+		return nil, err
+	}
+
+	var response TMDBMediaResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling %s response: %w", mediaType, err)
+	}
+
+	changed.Media = &Media{
+		MediaType:  mediaType,
+		TmdbID:     tmdbID,
+		Title:      response.Title,
+		Popularity: strconv.FormatFloat(response.Popularity, 'f', 4, 64),
+		Poster:     response.PosterPath,
+		Year:       strings.SplitN(response.ReleaseDate, "-", 2)[0],
+	}
+	if mediaType == "tv" {
+		changed.Media.Title = response.Name
+		changed.Media.Year = strings.SplitN(response.FirstAirDate, "-", 2)[0]
+	}
+	for _, company := range response.ProductionCompanies {
+		changed.CompanyIDs = append(changed.CompanyIDs, strconv.FormatInt(company.ID, 10))
+		changed.CompanyNames = append(changed.CompanyNames, company.Name)
+	}
+	return changed, nil
+}
+
+// tmdbGetMediaCompaniesBatch fetches refs concurrently, returning them in the order given
+func tmdbGetMediaCompaniesBatch(client *http.Client, tmdbAPIKey string, refs []MediaRef, workers int, bar *progressbar.ProgressBar) ([]*MediaCompanies, error) {
+	results := make([]*MediaCompanies, len(refs))
+	errs := make([]error, len(refs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for idx, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, ref MediaRef) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[idx], errs[idx] = tmdbGetMediaCompanies(client, tmdbAPIKey, ref.MediaType, ref.TmdbID)
+			bar.Add(1)
+		}(idx, ref)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func newProgressBar(max int, description string) *progressbar.ProgressBar {
+	return progressbar.NewOptions(max,
+		progressbar.OptionSetWidth(15),
+		progressbar.OptionEnableColorCodes(true),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowDescriptionAtLineEnd(),
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "[green]=[reset]",
+			SaucerHead:    "[green]>[reset]",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
+)
+
+// Saved next to the media mapping with the works whose class and TMDB ids disagree
+const QUALITY_SUFFIX = ".quality.csv"
+
+// Common subclasses, used by -dump when no -classes file is given
+var DEFAULT_CLASS_KINDS = map[string][]string{
+	"Q202866":   {"film"},      // animated film
+	"Q93204":    {"film"},      // documentary film
+	"Q24869":    {"film"},      // feature film
+	"Q229390":   {"film"},      // 3D film
+	"Q581714":   {"tv_series"}, // animated series
+	"Q1259759":  {"tv_series"}, // miniseries
+	"Q526877":   {"tv_series"}, // web series
+	"Q63952888": {"tv_series"}, // anime television series
+}
+
+// addKind adds a kind keeping matching.WORK_KINDS order, and drops audiovisual_work
+// once a more specific kind is known
+func addKind(kinds []string, kind string) []string {
+	kinds = appendUnique(kinds, kind)
+	var ordered []string
+	for _, workKind := range matching.WORK_KINDS {
+		if fileio.FindInSlice(kinds, workKind.Name) != -1 {
+			ordered = append(ordered, workKind.Name)
+		}
+	}
+	if len(ordered) > 1 && ordered[len(ordered)-1] == "audiovisual_work" {
+		ordered = ordered[:len(ordered)-1]
+	}
+	return ordered
+}
+
+// defaultClassKinds returns the kinds of the matching.WORK_KINDS classes themselves
+// and of DEFAULT_CLASS_KINDS
+func defaultClassKinds() map[string][]string {
+	var classKinds = make(map[string][]string)
+	for _, workKind := range matching.WORK_KINDS {
+		classKinds[workKind.QID] = []string{workKind.Name}
+	}
+	for qid, kinds := range DEFAULT_CLASS_KINDS {
+		classKinds[qid] = kinds
+	}
+	return classKinds
+}
+
+// loadClassKinds reads the subclasses of each matching.WORK_KINDS class, as exported
+// from the query service with columns class and root
+func loadClassKinds(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	classIdx := fileio.FindInSlice(headers, "class")
+	rootIdx := fileio.FindInSlice(headers, "root")
+	if classIdx == -1 || rootIdx == -1 {
+		return nil, fmt.Errorf("%s: must have fields class, root", path)
+	}
+
+	classKinds := defaultClassKinds()
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the query service exports entity urls
+		kind := matching.KindByQID(filepath.Base(record[rootIdx]))
+		if kind == nil {
+			continue
+		}
+		class := filepath.Base(record[classIdx])
+		classKinds[class] = addKind(classKinds[class], kind.Name)
+	}
+	return classKinds, nil
+}
+
+// typeFinding checks the TMDB id type of a work against its kinds, returning
+// an empty string when they agree or the class is not known
+func typeFinding(media *Media) string {
+	if media.TmdbID == "" {
+		return ""
+	}
+	return matching.TypeFinding(media.Kinds, media.MediaType)
+}
+
+// addFindings adds the works of a company whose class does not fit their
+// TMDB ids, keyed by mediaKey
+func addFindings(findings map[string][]string, company *Company) {
+	for _, media := range company.Media {
+		finding := typeFinding(media)
+		if finding == "" {
+			continue
+		}
+		findings[mediaKey(media)] = []string{
+			media.ID,
+			media.Title,
+			media.MediaType,
+			media.TmdbID,
+			strings.Join(media.Kinds, ";"),
+			finding,
+		}
+	}
+}
+
+// saveQualityReport writes the findings, returning the number of them
+func saveQualityReport(findings map[string][]string, path string) (int, error) {
+	var keys []string
+	for key := range findings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{"qid", "title", "type", "id", "class", "finding"})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := csvWriter.Write(findings[key]); err != nil {
+			return 0, err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return 0, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(keys), os.Rename(path+".tmp", path)
+}
+
+// reportQuality saves the quality report next to the media mapping
+func reportQuality(companiesLUT map[string]*Company, mediaMappingCSVPath string) error {
+	var findings = make(map[string][]string)
+	for _, company := range companiesLUT {
+		addFindings(findings, company)
+	}
+	return writeQualityReport(findings, mediaMappingCSVPath)
+}
+
+// reportStoreQuality is reportQuality for a .db mapping, reading one company
+// at a time
+func reportStoreQuality(db *store.Store, mediaMappingCSVPath string) error {
+	var findings = make(map[string][]string)
+	err := db.ForEachCompany(store.SOURCE_WIKIDATA, func(c *store.Company) error {
+		addFindings(findings, companyFromStore(c))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeQualityReport(findings, mediaMappingCSVPath)
+}
+
+// reportCSVQuality is reportQuality for the whole of a csv mapping, reading
+// one company at a time
+func reportCSVQuality(mediaMappingCSVPath string) error {
+	var findings = make(map[string][]string)
+	err := forEachLUTCompany(mediaMappingCSVPath, func(company *Company) error {
+		addFindings(findings, company)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeQualityReport(findings, mediaMappingCSVPath)
+}
+
+func writeQualityReport(findings map[string][]string, mediaMappingCSVPath string) error {
+	path := mediaMappingCSVPath + QUALITY_SUFFIX
+	count, err := saveQualityReport(findings, path)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		fmt.Printf("%d works have a class that does not fit their TMDB id, see %s\n", count, path)
+	}
+	return nil
+}
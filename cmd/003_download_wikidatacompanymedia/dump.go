@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
+	"github.com/schollz/progressbar/v3"
+)
+
+// Properties linking a work to a company: production company, distributed by
+// and original broadcaster. Each row records which, as the live query and 004
+// only use production company.
+var DUMP_COMPANY_PROPERTIES = []string{"P272", "P750", "P449"}
+
+// Commons files are given as a url by the query service, the dump only has the name
+const COMMONS_FILE_URL = "http://commons.wikimedia.org/wiki/Special:FilePath/"
+
+// Entities are only fully decoded when the line mentions one of these
+var DUMP_INTERESTING = [][]byte{[]byte(`"P272"`), []byte(`"P750"`), []byte(`"P449"`), []byte(`"P11806"`), []byte(`"P297"`)}
+
+type DumpEntity struct {
+	ID     string `json:"id"`
+	Labels map[string]struct {
+		Value string `json:"value"`
+	} `json:"labels"`
+	Claims    map[string][]DumpStatement `json:"claims"`
+	Sitelinks map[string]json.RawMessage `json:"sitelinks"`
+}
+
+type DumpStatement struct {
+	Mainsnak struct {
+		Snaktype  string `json:"snaktype"`
+		Datavalue struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"datavalue"`
+	} `json:"mainsnak"`
+	Rank string `json:"rank"`
+}
+
+// dumpCompany holds what the dump says about an item that is, or may become, a company
+type dumpCompany struct {
+	Name           string
+	TmdbCompanyIDs []string
+	CountryIDs     []string
+	Websites       []string
+}
+
+// truthy keeps the statements the query service returns for wdt:, the
+// preferred ones if there are any, otherwise the normal ones
+func truthy(statements []DumpStatement) []DumpStatement {
+	var preferred, normal []DumpStatement
+	for _, statement := range statements {
+		if statement.Mainsnak.Snaktype != "value" {
+			continue
+		}
+		switch statement.Rank {
+		case "preferred":
+			preferred = append(preferred, statement)
+		case "normal":
+			normal = append(normal, statement)
+		}
+	}
+	if len(preferred) > 0 {
+		return preferred
+	}
+	return normal
+}
+
+func (e *DumpEntity) strings(property string) []string {
+	var values []string
+	for _, statement := range truthy(e.Claims[property]) {
+		var value string
+		if json.Unmarshal(statement.Mainsnak.Datavalue.Value, &value) == nil {
+			values = appendUnique(values, value)
+		}
+	}
+	return values
+}
+
+func (e *DumpEntity) items(property string) []string {
+	var values []string
+	for _, statement := range truthy(e.Claims[property]) {
+		var value struct {
+			ID        string `json:"id"`
+			NumericID int64  `json:"numeric-id"`
+		}
+		if json.Unmarshal(statement.Mainsnak.Datavalue.Value, &value) != nil {
+			continue
+		}
+		if value.ID == "" && value.NumericID != 0 {
+			value.ID = "Q" + strconv.FormatInt(value.NumericID, 10) // older dumps
+		}
+		values = appendUnique(values, value.ID)
+	}
+	return values
+}
+
+// year returns the earliest year of a time property, like MIN(YEAR(?date))
+func (e *DumpEntity) year(property string) string {
+	var earliest *int64
+	for _, statement := range truthy(e.Claims[property]) {
+		var value struct {
+			Time string `json:"time"`
+		}
+		if json.Unmarshal(statement.Mainsnak.Datavalue.Value, &value) != nil || len(value.Time) < 2 {
+			continue
+		}
+		// +2015-03-01T00:00:00Z
+		end := strings.IndexByte(value.Time[1:], '-') + 1
+		if end <= 0 {
+			continue
+		}
+		year, err := strconv.ParseInt(value.Time[:end], 10, 64)
+		if err != nil {
+			continue
+		}
+		if earliest == nil || year < *earliest {
+			earliest = &year
+		}
+	}
+	if earliest == nil {
+		return ""
+	}
+	return strconv.FormatInt(*earliest, 10)
+}
+
+// label prefers english and otherwise takes the first language, so the
+// result does not depend on map order
+func (e *DumpEntity) label() string {
+	if label, exists := e.Labels["en"]; exists {
+		return label.Value
+	}
+	var languages []string
+	for language := range e.Labels {
+		languages = append(languages, language)
+	}
+	if len(languages) == 0 {
+		return ""
+	}
+	sort.Strings(languages)
+	return e.Labels[languages[0]].Value
+}
+
+// media returns a Media for each TMDB movie and TV ID of the work, or one
+// without an id when it has none. classKinds gives the kinds of each instance
+// of (P31) class.
+func (e *DumpEntity) media(classKinds map[string][]string) []*Media {
+	work := Media{
+		ID:        e.ID,
+		Title:     e.label(),
+		Year:      e.year("P577"),
+		Sitelinks: strconv.Itoa(len(e.Sitelinks)),
+	}
+	if posters := e.strings("P3383"); len(posters) > 0 {
+		work.Poster = COMMONS_FILE_URL + url.PathEscape(posters[0])
+	}
+	for _, class := range e.items("P31") {
+		for _, kind := range classKinds[class] {
+			work.Kinds = addKind(work.Kinds, kind)
+		}
+	}
+
+	var medias []*Media
+	var seen = make(map[string]bool)
+	add := func(mediaType string, tmdbID string) {
+		media := work
+		media.MediaType = mediaType
+		media.TmdbID = tmdbID
+		if tmdbID != "" && !seen[mediaKey(&media)] {
+			seen[mediaKey(&media)] = true
+			medias = append(medias, &media)
+		}
+	}
+	for _, tmdbID := range e.strings("P4947") {
+		add("movie", tmdbID)
+	}
+	for _, tmdbID := range e.strings("P4983") {
+		add("tv", tmdbSeriesID(tmdbID))
+	}
+	if len(medias) == 0 {
+		medias = append(medias, &work)
+	}
+	return medias
+}
+
+func (e *DumpEntity) company() *dumpCompany {
+	return &dumpCompany{
+		Name:           e.label(),
+		TmdbCompanyIDs: e.strings("P11806"),
+		CountryIDs:     e.items("P17"),
+		Websites:       e.strings("P856"),
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	bar    *progressbar.ProgressBar
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bar.Add(n)
+	return n, err
+}
+
+// openDump opens a dump given as a path, or - for stdin, decompressing by
+// extension. The progress bar follows the compressed bytes read.
+func openDump(path string) (io.Reader, func() error, *progressbar.ProgressBar, error) {
+	var f *os.File
+	var size int64 = -1
+	if path == "-" {
+		f = os.Stdin
+	} else {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+
+	bar := progressbar.NewOptions64(size,
+		progressbar.OptionEnableColorCodes(true),
+		progressbar.OptionSetWidth(15),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowDescriptionAtLineEnd(),
+		progressbar.OptionSetDescription("Reading dump..."),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "[green]=[reset]",
+			SaucerHead:    "[green]>[reset]",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}))
+
+	var reader io.Reader = &countingReader{reader: f, bar: bar}
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		reader = bzip2.NewReader(reader)
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		reader = gz
+	}
+	return reader, f.Close, bar, nil
+}
+
+func isInteresting(line []byte, companies map[string]*dumpCompany, refs map[string]bool) bool {
+	for _, marker := range DUMP_INTERESTING {
+		if bytes.Contains(line, marker) {
+			return true
+		}
+	}
+	if len(refs) == 0 {
+		return false
+	}
+	// companies referenced earlier in the dump without any of the above. The
+	// entity id comes before the claims, so the first id is the entity's
+	start := bytes.Index(line, []byte(`"id":"`))
+	if start == -1 {
+		return false
+	}
+	start += len(`"id":"`)
+	end := bytes.IndexByte(line[start:], '"')
+	if end == -1 {
+		return false
+	}
+	entityID := string(line[start : start+end])
+	_, captured := companies[entityID]
+	return refs[entityID] && !captured
+}
+
+// readDump makes one pass over a Wikidata json dump, or a subset of it with one
+// entity per line, returning the works of each company along with the
+// details of the companies it could capture on the way
+func readDump(path string, classKinds map[string][]string) (map[string][]*Media, map[string]*dumpCompany, map[string]string, error) {
+	reader, closeDump, bar, err := openDump(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer closeDump()
+
+	var companyMedia = make(map[string][]*Media)
+	// companies referenced by a work so far
+	var refs = make(map[string]bool)
+	// company details, kept for referenced companies and any item with a TMDB
+	// company ID, as a company can come before its works in the dump
+	var companies = make(map[string]*dumpCompany)
+	// ISO 3166-1 alpha-2 code (P297) of each country
+	var countryCodes = make(map[string]string)
+
+	lines := bufio.NewReaderSize(reader, 1024*1024)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, nil, err
+		}
+		// the full dump is one json array with an entity on each line
+		entityLine := bytes.TrimRight(bytes.TrimSpace(line), ",")
+		if len(entityLine) > 1 && isInteresting(entityLine, companies, refs) {
+			var entity DumpEntity
+			if jsonErr := json.Unmarshal(entityLine, &entity); jsonErr != nil {
+				return nil, nil, nil, fmt.Errorf("error while unmarshalling dump entity: %w", jsonErr)
+			}
+
+			if codes := entity.strings("P297"); len(codes) > 0 {
+				countryCodes[entity.ID] = codes[0]
+			}
+			if refs[entity.ID] || len(entity.Claims["P11806"]) > 0 {
+				companies[entity.ID] = entity.company()
+			}
+
+			if medias := entity.media(classKinds); len(medias) > 0 {
+				// company => properties linking the work to it
+				var linked = make(map[string][]string)
+				var linkedIDs []string
+				for _, property := range DUMP_COMPANY_PROPERTIES {
+					for _, companyID := range entity.items(property) {
+						linkedIDs = appendUnique(linkedIDs, companyID)
+						linked[companyID] = appendUnique(linked[companyID], property)
+					}
+				}
+				for _, companyID := range linkedIDs {
+					for _, media := range medias {
+						linkedMedia := *media
+						linkedMedia.Properties = linked[companyID]
+						companyMedia[companyID] = append(companyMedia[companyID], &linkedMedia)
+					}
+					refs[companyID] = true
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	bar.Finish()
+	fmt.Println()
+
+	for _, medias := range companyMedia {
+		// same order as the query service gives
+		sort.SliceStable(medias, func(i, j int) bool {
+			left, _ := strconv.Atoi(medias[i].Sitelinks)
+			right, _ := strconv.Atoi(medias[j].Sitelinks)
+			return left > right
+		})
+	}
+	return companyMedia, companies, countryCodes, nil
+}
+
+// runDump replaces the media of every company in the mapping with the works
+// found in the dump, adding the companies that are new
+func runDump(dumpPath string, mediaMappingCSVPath string, classKinds map[string][]string) error {
+	var db *store.Store
+	var companiesLUT map[string]*Company
+	var err error
+	if store.IsStorePath(mediaMappingCSVPath) {
+		db, err = store.Open(mediaMappingCSVPath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		companiesLUT, err = loadStoreLUT(db)
+	} else {
+		companiesLUT, err = loadLUT(mediaMappingCSVPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the dump is a snapshot, so its media are as old as the file
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+	if info, err := os.Stat(dumpPath); err == nil && dumpPath != "-" {
+		fetchedAt = info.ModTime().UTC().Truncate(time.Second)
+	}
+
+	companyMedia, companies, countryCodes, err := readDump(dumpPath, classKinds)
+	if err != nil {
+		return err
+	}
+
+	for companyID := range companyMedia {
+		if _, exists := companiesLUT[companyID]; !exists {
+			companiesLUT[companyID] = &Company{ID: companyID}
+		}
+	}
+
+	missing := 0
+	var companyIDs []string
+	for companyID, company := range companiesLUT {
+		companyIDs = append(companyIDs, companyID)
+		// a company without works in the dump has none
+		company.Media = companyMedia[companyID]
+		company.FetchedAt = fetchedAt
+		company.Migrated = false
+
+		detail := companies[companyID]
+		if detail == nil {
+			if _, referenced := companyMedia[companyID]; referenced && !company.DetailsChecked {
+				missing += 1
+			}
+			continue
+		}
+		if detail.Name != "" {
+			company.Name = detail.Name
+		}
+		company.TmdbCompanyIDs = detail.TmdbCompanyIDs
+		company.Countries = nil
+		for _, countryID := range detail.CountryIDs {
+			company.Countries = appendUnique(company.Countries, countryCodes[countryID])
+		}
+		company.Websites = detail.Websites
+		company.DetailsChecked = true
+	}
+	sort.Strings(companyIDs)
+
+	fmt.Printf("%d companies with media in dump\n", len(companyMedia))
+	if missing > 0 {
+		fmt.Printf("%d companies came before their works in the dump, their details are retrieved by the next run without -dump\n", missing)
+	}
+
+	if db != nil {
+		err = storeCompanies(db, companiesLUT, companyIDs)
+		if err != nil {
+			return err
+		}
+		return reportStoreQuality(db, mediaMappingCSVPath)
+	}
+	err = saveLUT(companiesLUT, mediaMappingCSVPath)
+	if err != nil {
+		return err
+	}
+	return reportQuality(companiesLUT, mediaMappingCSVPath)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+)
+
+// TestDump builds the mapping from the synthetic dump
+func TestDump(t *testing.T) {
+	fixture := "../../testdata/wikidata_dump"
+	classKinds, err := loadClassKinds(filepath.Join(fixture, "classes.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappingPath := filepath.Join(t.TempDir(), "wikidata_media_mapping.csv")
+	err = runDump(filepath.Join(fixture, "latest-all.json"), mappingPath, classKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := filepath.Join(fixture, "expected_media_mapping.csv")
+	// fetched_at is the time of the dump file
+	testutil.CompareCSV(t, mappingPath, expectedPath, "fetched_at")
+	testutil.CompareCSV(t, mappingPath+QUALITY_SUFFIX, expectedPath+QUALITY_SUFFIX)
+}
+
+// TestDumpCompressed reads the same dump compressed as it is downloaded
+func TestDumpCompressed(t *testing.T) {
+	fixture := "../../testdata/wikidata_dump"
+	classKinds, err := loadClassKinds(filepath.Join(fixture, "classes.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := filepath.Join(fixture, "expected_media_mapping.csv")
+	for _, suffix := range []string{".gz", ".bz2"} {
+		t.Run(suffix, func(t *testing.T) {
+			mappingPath := filepath.Join(t.TempDir(), "wikidata_media_mapping.csv")
+			err := runDump(filepath.Join(fixture, "latest-all.json"+suffix), mappingPath, classKinds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CompareCSV(t, mappingPath, expectedPath, "fetched_at")
+			testutil.CompareCSV(t, mappingPath+QUALITY_SUFFIX, expectedPath+QUALITY_SUFFIX)
+		})
+	}
+}
@@ -4,46 +4,126 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/rohfle/quickiedata"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
 	"github.com/schollz/progressbar/v3"
 )
 
 const RETRIEVE_BATCH_SIZE = 10
 const SAVE_BATCH_SIZE = 100
 
+// Written in the mapping_version column. Version 1 mappings had no qid column,
+// and the id column held the TMDB ID until a reload lost it.
+const MAPPING_VERSION = "2"
+
 type Media struct {
-	ID        string
+	ID        string // QID of the work
 	MediaType string
 	TmdbID    string
 	Title     string
 	Year      string
 	Sitelinks string
 	Poster    string
+	// matching.WORK_KINDS names of the work's instance of (P31), empty when not known
+	Kinds []string
+	// properties linking the work to the company, see DUMP_COMPANY_PROPERTIES
+	Properties []string
 }
 
 type Company struct {
 	ID    string
 	Name  string
 	Media []*Media
+	// Existing TMDB company IDs (P11806) on the wikidata item
+	TmdbCompanyIDs []string
+	Countries      []string // ISO 3166-1 alpha-2 codes of country (P17)
+	Websites       []string // official website (P856)
+	// false when the cached company was saved before details were retrieved
+	DetailsChecked bool
+	// zero when the cached company was saved before fetches were tracked
+	FetchedAt time.Time
+	// loaded from an older mapping version, so the media is fetched again
+	Migrated bool
+	// mapping_version the company was loaded with, empty for the first layout
+	LoadedVersion string
+}
+
+// mappingVersion is the layout the company's media is in. A migrated company
+// keeps its old version until its media is fetched again, so a run that does
+// not fetch it does not pass the old rows off as the new layout.
+func (c *Company) mappingVersion() string {
+	if c.Migrated {
+		return c.LoadedVersion
+	}
+	return MAPPING_VERSION
+}
+
+type CompanyDetails struct {
+	TmdbCompanyIDs []string
+	Countries      []string
+	Websites       []string
+}
+
+func appendUnique(values []string, value string) []string {
+	if value == "" || fileio.FindInSlice(values, value) != -1 {
+		return values
+	}
+	return append(values, value)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ";")
+}
+
+// isQID reports whether id is a wikidata item id such as Q42
+func isQID(id string) bool {
+	if len(id) < 2 || id[0] != 'Q' || id[1] == '0' {
+		return false
+	}
+	for _, c := range id[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Candidate is the id and name columns of one of the resultN candidates written by 001
+type Candidate struct {
+	IDIdx   int
+	NameIdx int
 }
 
-func FindInSlice(haystack []string, needle string) int {
-	for idx, hay := range haystack {
-		if hay == needle {
-			return idx
+// findCandidateColumns finds result1ID, result1Name, result2ID... for as many
+// candidates as the title compare csv has
+func findCandidateColumns(headers []string) []Candidate {
+	var candidates []Candidate
+	for n := 1; ; n++ {
+		idIdx := fileio.FindInSlice(headers, fmt.Sprintf("result%dID", n))
+		nameIdx := fileio.FindInSlice(headers, fmt.Sprintf("result%dName", n))
+		if idIdx == -1 || nameIdx == -1 {
+			return candidates
 		}
+		candidates = append(candidates, Candidate{IDIdx: idIdx, NameIdx: nameIdx})
 	}
-	return -1
 }
 
 func estimateRowCount(path string) (int, error) {
@@ -71,66 +151,150 @@ func estimateRowCount(path string) (int, error) {
 	}
 }
 
-func loadLUT(path string) (map[string]*Company, error) {
-	var companiesLUT = make(map[string]*Company)
+// forEachLUTCompany reads the mapping one company at a time, so a mapping can
+// be copied without holding it. A company is passed once for each run of
+// rows, which is once for a mapping written by saveLUT.
+func forEachLUTCompany(path string, fn func(company *Company) error) error {
 	f, err := os.Open(path)
 	if err != nil {
 		if errCast, ok := err.(*fs.PathError); ok && errCast.Err == syscall.ENOENT {
-			return companiesLUT, nil // no such file - this is ok, just return an empty lut
+			return nil // no such file - this is ok, there are no companies yet
 		}
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
 	csvReader := csv.NewReader(f)
 	// read headers
-	_, err = csvReader.Read()
+	headers, err := csvReader.Read()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// older files do not have these columns, so details need to be retrieved
+	tmdbCompanyIDsIdx := fileio.FindInSlice(headers, "tmdb_company_ids")
+	countryIdx := fileio.FindInSlice(headers, "country")
+	websiteIdx := fileio.FindInSlice(headers, "website")
+	fetchedAtIdx := fileio.FindInSlice(headers, "fetched_at")
+	detailsCheckedIdx := fileio.FindInSlice(headers, "details_checked")
+	qidIdx := fileio.FindInSlice(headers, "qid")
+	// not in mappings saved before classes were fetched
+	classIdx := fileio.FindInSlice(headers, "class")
+	// not in mappings saved before the dump kept distributors and broadcasters
+	propertyIdx := fileio.FindInSlice(headers, "property")
+	versionIdx := fileio.FindInSlice(headers, "mapping_version")
 
+	var company *Company
 	for {
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		companyID := record[0]
 		companyName := record[1]
 		media := &Media{
-			ID:        record[2],
 			MediaType: record[3],
+			TmdbID:    record[2],
 			Title:     record[4],
 			Year:      record[5],
 			Sitelinks: record[6],
 			Poster:    record[7],
 		}
+		version := ""
+		if versionIdx != -1 {
+			version = record[versionIdx]
+		}
+		migrated := version != MAPPING_VERSION
+		if qidIdx != -1 {
+			media.ID = record[qidIdx]
+		}
+		if classIdx != -1 {
+			media.Kinds = splitList(record[classIdx])
+		}
+		if propertyIdx != -1 {
+			media.Properties = splitList(record[propertyIdx])
+		}
 
-		if companyID == "" || companyID[0] != 'Q' {
+		if !isQID(companyID) {
 			continue
 		}
 
-		company, exists := companiesLUT[companyID]
-		if !exists {
+		if company == nil || company.ID != companyID {
+			if company != nil {
+				if err := fn(company); err != nil {
+					return err
+				}
+			}
 			company = &Company{
 				ID:   companyID,
 				Name: companyName,
 			}
-			companiesLUT[companyID] = company
+			if tmdbCompanyIDsIdx != -1 && countryIdx != -1 && websiteIdx != -1 {
+				company.TmdbCompanyIDs = splitList(record[tmdbCompanyIDsIdx])
+				company.Countries = splitList(record[countryIdx])
+				company.Websites = splitList(record[websiteIdx])
+				company.DetailsChecked = true
+			}
+			if detailsCheckedIdx != -1 {
+				company.DetailsChecked = record[detailsCheckedIdx] == "true"
+			}
+			if fetchedAtIdx != -1 {
+				company.FetchedAt, _ = time.Parse(time.RFC3339, record[fetchedAtIdx])
+			}
+			company.Migrated = migrated
+			company.LoadedVersion = version
 		}
 
-		if media.ID != "" {
+		if media.TmdbID != "" || media.ID != "" {
 			company.Media = append(company.Media, media)
 		}
 
 	}
+	if company != nil {
+		return fn(company)
+	}
+	return nil
+}
+
+// loadLUTFor loads the companies in companyIDs from the mapping, or every
+// company when companyIDs is nil
+func loadLUTFor(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	var companiesLUT = make(map[string]*Company)
+	err := forEachLUTCompany(path, func(company *Company) error {
+		if companyIDs != nil && !companyIDs[company.ID] {
+			return nil
+		}
+		if existing, exists := companiesLUT[company.ID]; exists {
+			existing.Media = append(existing.Media, company.Media...)
+			return nil
+		}
+		companiesLUT[company.ID] = company
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := 0
+	for _, company := range companiesLUT {
+		if company.Migrated {
+			migrated += 1
+		}
+	}
+	if migrated > 0 {
+		fmt.Printf("%d companies in %s are from an older mapping version, their media is fetched again\n", migrated, path)
+	}
 	return companiesLUT, nil
 }
 
-func saveLUT(companiesLUT map[string]*Company, path string) error {
+func loadLUT(path string) (map[string]*Company, error) {
+	return loadLUTFor(path, nil)
+}
+
+func writeLUTFile(path string, fn func(csvWriter *csv.Writer) error) error {
 	f, err := os.Create(path + ".tmp")
 	if err != nil {
 		return err
@@ -139,43 +303,14 @@ func saveLUT(companiesLUT map[string]*Company, path string) error {
 
 	csvWriter := csv.NewWriter(f)
 	// write headers
-	err = csvWriter.Write([]string{"company_id", "company_name", "id", "type", "title", "year", "sitelinks", "poster"})
+	err = csvWriter.Write([]string{"company_id", "company_name", "id", "type", "title", "year", "sitelinks", "poster", "qid", "class", "property", "tmdb_company_ids", "country", "website", "fetched_at", "details_checked", "mapping_version"})
 	if err != nil {
 		return err
 	}
 
-	for _, company := range companiesLUT {
-		if len(company.Media) == 0 {
-			err = csvWriter.Write([]string{
-				company.ID,
-				company.Name,
-				"",
-				"",
-				"",
-				"",
-				"",
-				"",
-			})
-			if err != nil {
-				return err
-			}
-		} else {
-			for _, media := range company.Media {
-				err = csvWriter.Write([]string{
-					company.ID,
-					company.Name,
-					media.TmdbID,
-					media.MediaType,
-					media.Title,
-					media.Year,
-					media.Sitelinks,
-					media.Poster,
-				})
-				if err != nil {
-					return err
-				}
-			}
-		}
+	err = fn(csvWriter)
+	if err != nil {
+		return err
 	}
 
 	csvWriter.Flush()
@@ -188,11 +323,279 @@ func saveLUT(companiesLUT map[string]*Company, path string) error {
 		return err
 	}
 
-	err = os.Rename(path+".tmp", path)
+	return os.Rename(path+".tmp", path)
+}
+
+func writeLUTCompany(csvWriter *csv.Writer, company *Company) error {
+	tmdbCompanyIDs := strings.Join(company.TmdbCompanyIDs, ";")
+	countries := strings.Join(company.Countries, ";")
+	websites := strings.Join(company.Websites, ";")
+	fetchedAt := formatFetchedAt(company.FetchedAt)
+	detailsChecked := strconv.FormatBool(company.DetailsChecked)
+	if len(company.Media) == 0 {
+		return csvWriter.Write([]string{
+			company.ID,
+			company.Name,
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			tmdbCompanyIDs,
+			countries,
+			websites,
+			fetchedAt,
+			detailsChecked,
+			company.mappingVersion(),
+		})
+	}
+	for _, media := range company.Media {
+		err := csvWriter.Write([]string{
+			company.ID,
+			company.Name,
+			media.TmdbID,
+			media.MediaType,
+			media.Title,
+			media.Year,
+			media.Sitelinks,
+			media.Poster,
+			media.ID,
+			strings.Join(media.Kinds, ";"),
+			strings.Join(media.Properties, ";"),
+			tmdbCompanyIDs,
+			countries,
+			websites,
+			fetchedAt,
+			detailsChecked,
+			company.mappingVersion(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedIDs(companiesLUT map[string]*Company) []string {
+	var companyIDs []string
+	for companyID := range companiesLUT {
+		companyIDs = append(companyIDs, companyID)
+	}
+	sort.Strings(companyIDs)
+	return companyIDs
+}
+
+func saveLUT(companiesLUT map[string]*Company, path string) error {
+	return writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		for _, companyID := range sortedIDs(companiesLUT) {
+			if err := writeLUTCompany(csvWriter, companiesLUT[companyID]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeLUT saves the companies of the lut over those in the mapping at path,
+// copying the other companies through one at a time, so only the candidates
+// are held in memory. A mapping not written by saveLUT is loaded whole and
+// saved sorted instead
+func mergeLUT(companiesLUT map[string]*Company, path string) error {
+	err := mergeSortedLUT(companiesLUT, path)
+	if err != errUnsorted {
+		return err
+	}
+	fullLUT, err := loadLUT(path)
 	if err != nil {
 		return err
 	}
+	for companyID, company := range companiesLUT {
+		fullLUT[companyID] = company
+	}
+	return saveLUT(fullLUT, path)
+}
+
+// errUnsorted stops a merge of a mapping whose companies are out of order or
+// split over several runs of rows
+var errUnsorted = errors.New("mapping is not sorted by company id")
+
+// mergeSortedLUT merges the lut into a mapping sorted by company id
+func mergeSortedLUT(companiesLUT map[string]*Company, path string) error {
+	companyIDs := sortedIDs(companiesLUT)
+	return writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		next := 0
+		previous := ""
+		err := forEachLUTCompany(path, func(company *Company) error {
+			if previous != "" && company.ID <= previous {
+				return errUnsorted
+			}
+			previous = company.ID
+			for ; next < len(companyIDs) && companyIDs[next] < company.ID; next++ {
+				if err := writeLUTCompany(csvWriter, companiesLUT[companyIDs[next]]); err != nil {
+					return err
+				}
+			}
+			if _, exists := companiesLUT[company.ID]; exists {
+				return nil
+			}
+			return writeLUTCompany(csvWriter, company)
+		})
+		if err != nil {
+			return err
+		}
+		for ; next < len(companyIDs); next++ {
+			if err := writeLUTCompany(csvWriter, companiesLUT[companyIDs[next]]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readCandidateIDs returns the wikidata companies of the title compare csv
+func readCandidateIDs(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	candidates := findCandidateColumns(headers)
+
+	var companyIDs = make(map[string]bool)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			if isQID(record[candidate.IDIdx]) {
+				companyIDs[record[candidate.IDIdx]] = true
+			}
+		}
+	}
+	return companyIDs, nil
+}
+
+func formatFetchedAt(fetchedAt time.Time) string {
+	if fetchedAt.IsZero() {
+		return ""
+	}
+	return fetchedAt.Format(time.RFC3339)
+}
+
+// isStale reports whether the media of a cached company is older than maxAge,
+// counting companies saved before fetches were tracked as stale
+func isStale(company *Company, maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	return company.FetchedAt.IsZero() || now.Sub(company.FetchedAt) > maxAge
+}
+
+// parseMaxAge accepts a go duration or a number of days such as 30d
+func parseMaxAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid max age %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
 
+func companyToStore(company *Company) *store.Company {
+	result := &store.Company{
+		Source: store.SOURCE_WIKIDATA,
+		ID:     company.ID,
+		Name:   company.Name,
+		Details: map[string]string{
+			"tmdb_company_ids": strings.Join(company.TmdbCompanyIDs, ";"),
+			"country":          strings.Join(company.Countries, ";"),
+			"website":          strings.Join(company.Websites, ";"),
+			"fetched_at":       formatFetchedAt(company.FetchedAt),
+			"details_checked":  strconv.FormatBool(company.DetailsChecked),
+			"mapping_version":  company.mappingVersion(),
+		},
+		DetailsChecked: company.DetailsChecked,
+	}
+	for _, media := range company.Media {
+		result.Media = append(result.Media, &store.Media{
+			ID:        media.TmdbID,
+			QID:       media.ID,
+			Class:     strings.Join(media.Kinds, ";"),
+			Property:  strings.Join(media.Properties, ";"),
+			Type:      media.MediaType,
+			Title:     media.Title,
+			Year:      media.Year,
+			Sitelinks: media.Sitelinks,
+			Poster:    media.Poster,
+		})
+	}
+	return result
+}
+
+func companyFromStore(c *store.Company) *Company {
+	company := &Company{
+		ID:             c.ID,
+		Name:           c.Name,
+		TmdbCompanyIDs: splitList(c.Details["tmdb_company_ids"]),
+		Countries:      splitList(c.Details["country"]),
+		Websites:       splitList(c.Details["website"]),
+		DetailsChecked: c.DetailsChecked,
+		Migrated:       c.Details["mapping_version"] != MAPPING_VERSION,
+		LoadedVersion:  c.Details["mapping_version"],
+	}
+	company.FetchedAt, _ = time.Parse(time.RFC3339, c.Details["fetched_at"])
+	for _, media := range c.Media {
+		company.Media = append(company.Media, &Media{
+			ID:         media.QID,
+			Kinds:      splitList(media.Class),
+			Properties: splitList(media.Property),
+			MediaType:  media.Type,
+			TmdbID:     media.ID,
+			Title:      media.Title,
+			Year:       media.Year,
+			Sitelinks:  media.Sitelinks,
+			Poster:     media.Poster,
+		})
+	}
+	return company
+}
+
+func loadStoreLUT(db *store.Store) (map[string]*Company, error) {
+	var companiesLUT = make(map[string]*Company)
+	err := db.ForEachCompany(store.SOURCE_WIKIDATA, func(c *store.Company) error {
+		company := companyFromStore(c)
+		companiesLUT[company.ID] = company
+		return nil
+	})
+	return companiesLUT, err
+}
+
+// storeCompanies upserts the retrieved companies, each with its media, and
+// drops them from the lut as the store has them now
+func storeCompanies(db *store.Store, companiesLUT map[string]*Company, companyIDs []string) error {
+	for _, companyID := range companyIDs {
+		err := db.PutCompany(companyToStore(companiesLUT[companyID]))
+		if err != nil {
+			return err
+		}
+		delete(companiesLUT, companyID)
+	}
 	return nil
 }
 
@@ -206,12 +609,52 @@ func main() {
 		MaxConnsPerHost: 1,
 	})
 
-	compareCSVPath := os.Args[1]
-	mediaMappingCSVPath := os.Args[2]
-	forceRefresh := false
-	if len(os.Args) > 3 && os.Args[3] == "--force" {
-		forceRefresh = true
+	forceRefresh := flag.Bool("force", false, "re-fetch the media of every company")
+	var maxAge time.Duration
+	flag.Func("max-age", "re-fetch media older than this, eg 720h or 30d (default never)", func(value string) error {
+		var err error
+		maxAge, err = parseMaxAge(value)
+		return err
+	})
+	classesPath := flag.String("classes", "", "with -dump, csv of the subclasses of each work kind (columns class, root) exported from the query service")
+	dumpPath := flag.String("dump", "", "build the mapping for every company from a wikidata json dump (.json, .gz, .bz2 or - for stdin) instead of querying")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run . [options] <title compare csv> <wikidata media mapping>")
+		fmt.Println("       go run . -dump <latest-all.json.bz2> <wikidata media mapping>")
+		flag.PrintDefaults()
 	}
+	flag.Parse()
+
+	if flag.NArg() < 2 && !(*dumpPath != "" && flag.NArg() == 1) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *dumpPath != "" {
+		classKinds := defaultClassKinds()
+		if *classesPath != "" {
+			var err error
+			classKinds, err = loadClassKinds(*classesPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err := runDump(*dumpPath, flag.Arg(flag.NArg()-1), classKinds)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	compareCSVPath := flag.Arg(0)
+	mediaMappingCSVPath := flag.Arg(1)
+	// older usage put --force after the paths
+	if flag.Arg(2) == "--force" {
+		*forceRefresh = true
+	}
+	now := time.Now()
+	// companies fetched during this run, so they are not fetched twice
+	var requested = make(map[string]bool)
 
 	rowCount, err := estimateRowCount(compareCSVPath)
 	if err != nil {
@@ -235,24 +678,38 @@ func main() {
 		log.Fatal(err)
 	}
 
-	result1IDIdx := FindInSlice(headers, "result1ID")
-	result1NameIdx := FindInSlice(headers, "result1Name")
-	result2IDIdx := FindInSlice(headers, "result2ID")
-	result2NameIdx := FindInSlice(headers, "result2Name")
-
-	if result1IDIdx == -1 ||
-		result1NameIdx == -1 ||
-		result2IDIdx == -1 ||
-		result2NameIdx == -1 {
-		log.Fatal("Invalid CSV given: must have fields result1ID, result1Name, result2ID, result2Name")
+	candidates := findCandidateColumns(headers)
+	if len(candidates) == 0 {
+		log.Fatal("Invalid CSV given: must have fields result1ID, result1Name")
 	}
 
-	companiesLUT, err := loadLUT(mediaMappingCSVPath)
-	if err != nil {
-		log.Fatal(err)
+	// a .db mapping is updated one company at a time instead of rewriting the
+	// csv, and only the candidates being fetched are kept in the lut
+	var db *store.Store
+	var companiesLUT map[string]*Company
+	if store.IsStorePath(mediaMappingCSVPath) {
+		db, err = store.Open(mediaMappingCSVPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		companiesLUT = make(map[string]*Company)
+	} else {
+		// of a csv mapping only the candidates are loaded, and saving copies
+		// the other companies through
+		companyIDs, err := readCandidateIDs(compareCSVPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		companiesLUT, err = loadLUTFor(mediaMappingCSVPath, companyIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	var companyIDsToGet = make([]string, 0, 21)
+	// cached companies that only need their details
+	var existingIDsToGet = make([]string, 0, 21)
 
 	bar := progressbar.NewOptions(rowCount,
 		progressbar.OptionEnableColorCodes(true),
@@ -280,52 +737,62 @@ func main() {
 			log.Fatal(err)
 		}
 
-		cID1 := record[result1IDIdx]
-		cName1 := record[result1NameIdx]
-		cID2 := record[result2IDIdx]
-		cName2 := record[result2NameIdx]
-
-		if cID1 == "" || cID1[0] != 'Q' {
-			continue
-		}
-
-		if _, exists := companiesLUT[cID1]; forceRefresh || !exists {
-			companiesLUT[cID1] = &Company{
-				ID:   cID1,
-				Name: cName1,
+		for _, candidate := range candidates {
+			cID := record[candidate.IDIdx]
+			cName := record[candidate.NameIdx]
+			// 001 leaves unused candidates empty
+			if !isQID(cID) {
+				continue
 			}
-			companyIDsToGet = append(companyIDsToGet, cID1)
-		}
 
-		if cID2 == "" || cID1[0] != 'Q' {
-			continue
-		}
+			if _, exists := companiesLUT[cID]; !exists && db != nil && !requested[cID] {
+				c, err := db.Company(store.SOURCE_WIKIDATA, cID)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if c != nil {
+					companiesLUT[cID] = companyFromStore(c)
+				}
+			}
 
-		if _, exists := companiesLUT[cID2]; forceRefresh || !exists {
-			companiesLUT[cID2] = &Company{
-				ID:   cID2,
-				Name: cName2,
+			if company, exists := companiesLUT[cID]; !requested[cID] && (*forceRefresh || !exists || company.Migrated || isStale(company, maxAge, now)) {
+				requested[cID] = true
+				companiesLUT[cID] = &Company{
+					ID:   cID,
+					Name: cName,
+				}
+				companyIDsToGet = append(companyIDsToGet, cID)
+			} else if !requested[cID] && !company.DetailsChecked && fileio.FindInSlice(existingIDsToGet, cID) == -1 {
+				existingIDsToGet = append(existingIDsToGet, cID)
+				if company.Name == "" {
+					company.Name = cName // left empty by -dump
+				}
+			} else if db != nil && !requested[cID] && fileio.FindInSlice(existingIDsToGet, cID) == -1 {
+				delete(companiesLUT, cID) // up to date in the store
 			}
-			companyIDsToGet = append(companyIDsToGet, cID2)
 		}
 
-		if len(companyIDsToGet) >= RETRIEVE_BATCH_SIZE {
-			bar.Describe("Getting " + strings.Join(companyIDsToGet, ", "))
-			medias, err := getWDCompanyMedia(wd, companyIDsToGet)
+		if len(companyIDsToGet)+len(existingIDsToGet) >= RETRIEVE_BATCH_SIZE {
+			bar.Describe("Getting " + strings.Join(append(companyIDsToGet, existingIDsToGet...), ", "))
+			updated, err := retrieveCompanies(wd, companiesLUT, companyIDsToGet, existingIDsToGet)
 			if err != nil {
 				log.Fatal(err)
 			}
-			// empty the slice
-			companyIDsToGet = companyIDsToGet[:0]
-
-			for companyID, media := range medias {
-				companiesLUT[companyID].Media = media
-				recordsUnsaved += 1
+			if db != nil {
+				err = storeCompanies(db, companiesLUT, append(companyIDsToGet, existingIDsToGet...))
+				if err != nil {
+					log.Fatal(err)
+				}
+				updated = 0
 			}
+			// empty the slices
+			companyIDsToGet = companyIDsToGet[:0]
+			existingIDsToGet = existingIDsToGet[:0]
+			recordsUnsaved += updated
 
 			if recordsUnsaved >= SAVE_BATCH_SIZE {
 				bar.Describe("Saving to disk...")
-				err := saveLUT(companiesLUT, mediaMappingCSVPath)
+				err := mergeLUT(companiesLUT, mediaMappingCSVPath)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -335,35 +802,165 @@ func main() {
 	}
 
 	// Handle unprocessed entities
-	if len(companyIDsToGet) > 0 {
-		bar.Describe("Getting " + strings.Join(companyIDsToGet, ", "))
-		medias, err := getWDCompanyMedia(wd, companyIDsToGet)
+	if len(companyIDsToGet)+len(existingIDsToGet) > 0 {
+		bar.Describe("Getting " + strings.Join(append(companyIDsToGet, existingIDsToGet...), ", "))
+		updated, err := retrieveCompanies(wd, companiesLUT, companyIDsToGet, existingIDsToGet)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		for companyID, media := range medias {
-			companiesLUT[companyID].Media = media
-			recordsUnsaved += 1
+		if db != nil {
+			err = storeCompanies(db, companiesLUT, append(companyIDsToGet, existingIDsToGet...))
+			if err != nil {
+				log.Fatal(err)
+			}
+			updated = 0
 		}
+		recordsUnsaved += updated
 	}
 
 	if recordsUnsaved > 0 {
 		bar.Describe("Saving to disk...")
-		err := saveLUT(companiesLUT, mediaMappingCSVPath)
+		err := mergeLUT(companiesLUT, mediaMappingCSVPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 		recordsUnsaved = 0
 	}
 	bar.Finish()
+	fmt.Println()
+
+	if db != nil {
+		err = reportStoreQuality(db, mediaMappingCSVPath)
+	} else {
+		err = reportCSVQuality(mediaMappingCSVPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// retrieveCompanies gets media for companyIDs and details for both companyIDs
+// and existingIDs, returning the number of companies updated
+func retrieveCompanies(wd *quickiedata.WikidataClient, companiesLUT map[string]*Company, companyIDs []string, existingIDs []string) (int, error) {
+	updated := 0
+	if len(companyIDs) > 0 {
+		medias, err := getWDCompanyMedia(wd, companyIDs)
+		if err != nil {
+			return 0, err
+		}
+
+		fetchedAt := time.Now().UTC().Truncate(time.Second)
+		for _, companyID := range companyIDs {
+			companiesLUT[companyID].FetchedAt = fetchedAt
+			companiesLUT[companyID].Migrated = false
+		}
+
+		for companyID, media := range medias {
+			companiesLUT[companyID].Media = media
+			updated += 1
+		}
+	}
+
+	allIDs := append(append([]string{}, companyIDs...), existingIDs...)
+	details, err := getWDCompanyDetails(wd, allIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, companyID := range allIDs {
+		company := companiesLUT[companyID]
+		company.TmdbCompanyIDs = nil
+		company.Countries = nil
+		company.Websites = nil
+		if detail := details[companyID]; detail != nil {
+			company.TmdbCompanyIDs = detail.TmdbCompanyIDs
+			company.Countries = detail.Countries
+			company.Websites = detail.Websites
+		}
+		company.DetailsChecked = true
+	}
+	updated += len(existingIDs)
+
+	return updated, nil
+}
+
+// getWDCompanyDetails gets any TMDB company IDs (P11806) already on the
+// companies, along with their country codes and websites
+func getWDCompanyDetails(wd *quickiedata.WikidataClient, companyIDs []string) (map[string]*CompanyDetails, error) {
+	query := quickiedata.NewSPARQLQuery()
+	query.Template = `
+		SELECT ?company ?tmdbCompanyID ?countryCode ?website
+		WHERE
+		{
+		OPTIONAL { ?company wdt:P11806 ?tmdbCompanyID }
+		OPTIONAL {
+			?company wdt:P17 ?country.
+			?country wdt:P297 ?countryCode.
+		}
+		OPTIONAL { ?company wdt:P856 ?website }
+		}
+	`
+
+	var cids []quickiedata.WikidataID
+	for _, cid := range companyIDs {
+		cids = append(cids, quickiedata.WikidataID("wd:"+cid))
+	}
+
+	query.Variables["company"] = cids
+
+	options := quickiedata.NewSPARQLQueryOptions()
+	sdata, err := wd.SPARQLQuerySimple(context.Background(), query, options)
+	if err != nil {
+		return nil, fmt.Errorf("error in SPARQLQuerySimple: %w", err)
+	}
+
+	var details = make(map[string]*CompanyDetails)
+	for _, result := range sdata.Results {
+		companyID := result["company"].ValueAsString()
+		detail := details[companyID]
+		if detail == nil {
+			detail = &CompanyDetails{}
+			details[companyID] = detail
+		}
+		if v := result["tmdbCompanyID"]; v != nil {
+			detail.TmdbCompanyIDs = appendUnique(detail.TmdbCompanyIDs, v.ValueAsString())
+		}
+		if v := result["countryCode"]; v != nil {
+			detail.Countries = appendUnique(detail.Countries, v.ValueAsString())
+		}
+		if v := result["website"]; v != nil {
+			detail.Websites = appendUnique(detail.Websites, v.ValueAsString())
+		}
+	}
+
+	return details, nil
+}
+
+// tmdbSeriesID resolves a TMDB TV ID (P4983), which can point at a season or
+// an episode such as 1399/season/1/episode/2, to the series
+func tmdbSeriesID(value string) string {
+	seriesID := strings.SplitN(value, "/", 2)[0]
+	if _, err := strconv.ParseInt(seriesID, 10, 64); err != nil {
+		return ""
+	}
+	return seriesID
+}
+
+// mediaKey identifies a work and one of its TMDB ids, as a work can have
+// several, or both a movie and a TV ID
+func mediaKey(media *Media) string {
+	return media.ID + "/" + media.MediaType + "/" + media.TmdbID
 }
 
 func getWDCompanyMedia(wd *quickiedata.WikidataClient, companyIDs []string) (map[string][]*Media, error) {
+	var kindClasses []string
+	for _, workKind := range matching.WORK_KINDS {
+		kindClasses = append(kindClasses, "wd:"+workKind.QID)
+	}
 
 	query := quickiedata.NewSPARQLQuery()
 	query.Template = `
-		SELECT ?item ?productionCompany ?itemLabel ?linkCount ?poster ?tmdbMovieID ?tmdbTVID (MIN(?year2) AS ?year)
+		SELECT ?item ?productionCompany ?itemLabel ?linkCount ?poster ?tmdbMovieID ?tmdbTVID ?kindClass (MIN(?year2) AS ?year)
 		WHERE
 		{
 		?item wdt:P272 ?productionCompany.
@@ -375,7 +972,10 @@ func getWDCompanyMedia(wd *quickiedata.WikidataClient, companyIDs []string) (map
 		}
 		OPTIONAL { ?item wdt:P4947 ?tmdbMovieID }
 		OPTIONAL { ?item wdt:P4983 ?tmdbTVID }
-		FILTER(?tmdbMovieID != "" || ?tmdbTVID != "")
+		OPTIONAL {
+			?item wdt:P31/wdt:P279* ?kindClass.
+			VALUES ?kindClass { ` + strings.Join(kindClasses, " ") + ` }
+		}
 		OPTIONAL {
 			?item rdfs:label ?itemLabel
 			FILTER langMatches(lang(?itemLabel), "en")
@@ -383,7 +983,7 @@ func getWDCompanyMedia(wd *quickiedata.WikidataClient, companyIDs []string) (map
 		OPTIONAL {
 			?item rdfs:label ?itemLabel
 		}
-		} GROUP BY ?item ?productionCompany ?itemLabel ?linkCount ?poster ?tmdbMovieID ?tmdbTVID ORDER BY DESC(?linkCount)
+		} GROUP BY ?item ?productionCompany ?itemLabel ?linkCount ?poster ?tmdbMovieID ?tmdbTVID ?kindClass ORDER BY DESC(?linkCount)
 	`
 
 	var cids []quickiedata.WikidataID
@@ -404,30 +1004,60 @@ func getWDCompanyMedia(wd *quickiedata.WikidataClient, companyIDs []string) (map
 		companyID := result["productionCompany"].ValueAsString()
 		companyMedia := mediaList[companyID]
 		if companyMedia == nil {
-			companyMedia = make(map[string]*Media) // TODO: change to a map to prevent duplicates
+			companyMedia = make(map[string]*Media)
 		}
-		media := &Media{
+		work := Media{
 			ID:     result["item"].ValueAsString(),
 			Title:  result["itemLabel"].ValueAsString(),
 			Poster: result["poster"].ValueAsString(),
+			// the query only follows production company
+			Properties: []string{"P272"},
 		}
 
 		if year := result["year"].ValueAsInteger(); year != nil {
-			media.Year = strconv.FormatInt(*year, 10)
+			work.Year = strconv.FormatInt(*year, 10)
 		}
 
 		if sitelinks := result["linkCount"].ValueAsInteger(); sitelinks != nil {
-			media.Sitelinks = strconv.FormatInt(*sitelinks, 10)
+			work.Sitelinks = strconv.FormatInt(*sitelinks, 10)
 		}
 
-		if v := result["tmdbMovieID"]; v != nil {
-			media.MediaType = "movie"
-			media.TmdbID = v.ValueAsString()
-		} else if v := result["tmdbTVID"]; v != nil {
-			media.MediaType = "tv"
-			media.TmdbID = strings.SplitN(v.ValueAsString(), "/", 2)[0] // removes 111/season/1 etc
+		// a row for each class the work is an instance of, directly or not
+		kindName := ""
+		if v := result["kindClass"]; v != nil {
+			if kind := matching.KindByQID(v.ValueAsString()); kind != nil {
+				kindName = kind.Name
+			}
+		}
+		add := func(mediaType string, tmdbID string) {
+			media := work
+			media.MediaType = mediaType
+			media.TmdbID = tmdbID
+			if existing := companyMedia[mediaKey(&media)]; existing != nil {
+				media.Kinds = existing.Kinds
+			}
+			if kindName != "" {
+				media.Kinds = addKind(media.Kinds, kindName)
+			}
+			companyMedia[mediaKey(&media)] = &media
+		}
+
+		// each row has one movie and one tv id of the work, keep both
+		hasID := false
+		if v := result["tmdbMovieID"]; v != nil && v.ValueAsString() != "" {
+			add("movie", v.ValueAsString())
+			hasID = true
+		}
+		if v := result["tmdbTVID"]; v != nil {
+			if seriesID := tmdbSeriesID(v.ValueAsString()); seriesID != "" {
+				add("tv", seriesID)
+				hasID = true
+			}
+		}
+		// works without a TMDB id are matched by title and year in 004
+		if !hasID {
+			add("", "")
 		}
-		companyMedia[media.ID] = media
 		mediaList[companyID] = companyMedia
 	}
 
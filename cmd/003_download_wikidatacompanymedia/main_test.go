@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A migrated company that was not fetched again stays migrated when saved
+func TestSaveLUTKeepsMigratedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wikidata_media_mapping.csv")
+	companiesLUT := map[string]*Company{
+		"Q1": {ID: "Q1", Name: "Old", Migrated: true, Media: []*Media{{TmdbID: "Q10", Title: "Old layout"}}},
+		"Q2": {ID: "Q2", Name: "New", Media: []*Media{{ID: "Q20", MediaType: "movie", TmdbID: "20"}}},
+	}
+	if err := saveLUT(companiesLUT, path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadLUT(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded["Q1"].Migrated {
+		t.Error("Q1 was saved as the current mapping version without being fetched again")
+	}
+	if loaded["Q2"].Migrated {
+		t.Error("Q2 was fetched in the current mapping version")
+	}
+}
+
+// Merging only the fetched candidates keeps the other companies of the mapping
+func TestMergeLUT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wikidata_media_mapping.csv")
+	err := saveLUT(map[string]*Company{
+		"Q1":  {ID: "Q1", Name: "One", Media: []*Media{{ID: "Q11", MediaType: "movie", TmdbID: "11"}}},
+		"Q10": {ID: "Q10", Name: "Ten", Migrated: true, Media: []*Media{{TmdbID: "Q101", Title: "Old layout"}}},
+		"Q3":  {ID: "Q3", Name: "Three"},
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	companiesLUT, err := loadLUTFor(path, map[string]bool{"Q3": true, "Q25": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(companiesLUT) != 1 || companiesLUT["Q3"] == nil {
+		t.Fatalf("loaded %d companies, expected only Q3", len(companiesLUT))
+	}
+	companiesLUT["Q3"].Media = []*Media{{ID: "Q31", MediaType: "tv", TmdbID: "31"}}
+	companiesLUT["Q25"] = &Company{ID: "Q25", Name: "Twenty Five"}
+	if err := mergeLUT(companiesLUT, path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadLUT(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, companyID := range []string{"Q1", "Q10", "Q25", "Q3"} {
+		if loaded[companyID] == nil {
+			t.Errorf("%s is missing from the merged mapping", companyID)
+		}
+	}
+	if len(loaded["Q3"].Media) != 1 || loaded["Q3"].Media[0].ID != "Q31" {
+		t.Errorf("Q3 was not saved with its fetched media")
+	}
+	if !loaded["Q10"].Migrated {
+		t.Error("Q10 was copied as the current mapping version")
+	}
+}
+
+// A mapping out of order, or with a company over two runs of rows, is saved
+// sorted with the fetched candidates merged in
+func TestMergeLUTUnsorted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wikidata_media_mapping.csv")
+	err := writeLUTFile(path, func(csvWriter *csv.Writer) error {
+		for _, company := range []*Company{
+			{ID: "Q3", Name: "Three", Media: []*Media{{ID: "Q31", MediaType: "tv", TmdbID: "31"}}},
+			{ID: "Q1", Name: "One", Media: []*Media{{ID: "Q11", MediaType: "movie", TmdbID: "11"}}},
+			{ID: "Q10", Name: "Ten"},
+			{ID: "Q1", Name: "One", Media: []*Media{{ID: "Q12", MediaType: "movie", TmdbID: "12"}}},
+		} {
+			if err := writeLUTCompany(csvWriter, company); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mergeLUT(map[string]*Company{
+		"Q10": {ID: "Q10", Name: "Ten", Media: []*Media{{ID: "Q101", MediaType: "movie", TmdbID: "101"}}},
+		"Q25": {ID: "Q25", Name: "Twenty Five"},
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	err = forEachLUTCompany(path, func(company *Company) error {
+		order = append(order, company.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "Q1,Q10,Q25,Q3" {
+		t.Errorf("saved companies %v, expected Q1,Q10,Q25,Q3 once each", order)
+	}
+
+	loaded, err := loadLUT(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded["Q1"].Media) != 2 {
+		t.Errorf("Q1 has %d media, expected both runs of rows", len(loaded["Q1"].Media))
+	}
+	if len(loaded["Q10"].Media) != 1 || loaded["Q10"].Media[0].ID != "Q101" {
+		t.Errorf("Q10 was not saved with its fetched media")
+	}
+}
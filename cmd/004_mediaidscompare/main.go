@@ -2,12 +2,21 @@ package main
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/classifier"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/stats"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
 )
 
 type Item struct {
@@ -20,6 +29,18 @@ type Possibility struct {
 	WikidataID  string
 	CompanyName string
 	Score       float64
+	// found by 014 from the media shared, rather than by name
+	ByMedia bool
+}
+
+// Weight scales the media score of a candidate. A candidate found by its
+// media counts as at least this good a name match, so it ranks by the media
+// it shares without the name score it has anyway holding it back
+func (p *Possibility) Weight() float64 {
+	if p.ByMedia && p.Score < MEDIA_CANDIDATE_WEIGHT {
+		return MEDIA_CANDIDATE_WEIGHT
+	}
+	return p.Score
 }
 
 type Match struct {
@@ -30,9 +51,25 @@ type Match struct {
 	NameScore           float64
 	MappingScore        float64
 	MapMatchCount       int
-	TmdbMapCount        int
-	WikidataMapCount    int
-	TotalScore          float64
+	// common media found by title and year for wikidata works without a TMDB id
+	FuzzyScore       float64
+	FuzzyMatchCount  int
+	TmdbMapCount     int
+	WikidataMapCount int
+	TotalScore       float64
+	LinkStatus       string
+	LinkedTmdbIDs    []string
+	Decided          bool
+	// -1 when no model is loaded
+	Probability float64
+}
+
+// Better orders matches by total score, then name score
+func (m *Match) Better(other *Match) bool {
+	if m.TotalScore != other.TotalScore {
+		return m.TotalScore > other.TotalScore
+	}
+	return m.NameScore > other.NameScore
 }
 
 func (m Match) String() string {
@@ -49,10 +86,27 @@ func (m Match) String() string {
 		m.TotalScore)
 }
 
-type Media struct {
-	Movies []int64
-	TV     []int64
-	Count  int
+// Fuzzy common media only count for this much of a common TMDB id
+const FUZZY_MEDIA_WEIGHT = 0.5
+
+// Weight of a candidate 014 found by its media, see Possibility.Weight
+const MEDIA_CANDIDATE_WEIGHT = 0.5
+
+const (
+	LINK_STATUS_NEW      = "NEW"
+	LINK_STATUS_LINKED   = "LINKED"
+	LINK_STATUS_CONFLICT = "CONFLICT"
+)
+
+// LinkStatus compares a TMDB company ID with the IDs already on the wikidata company
+func LinkStatus(tmdbID string, wikidataMapping *matching.Company) string {
+	if len(wikidataMapping.LinkedTmdbIDs) == 0 {
+		return LINK_STATUS_NEW
+	}
+	if dumbInSlice(wikidataMapping.LinkedTmdbIDs, tmdbID) {
+		return LINK_STATUS_LINKED
+	}
+	return LINK_STATUS_CONFLICT
 }
 
 func dumbInSlice(haystack []string, needle string) bool {
@@ -118,101 +172,126 @@ func loadCompareCSV(path string) ([]*Item, error) {
 	return results, err
 }
 
-func loadMediaMappingCSV(path string) (map[string]*Media, error) {
-	f, err := os.Open(path)
+// withMedia keeps the companies that have media, with or without TMDB ids
+func withMedia(companies map[string]*matching.Company, err error) (map[string]*matching.Company, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	csvReader := csv.NewReader(f)
-	_, err = csvReader.Read() // ignore header
-	if err != nil {
-		log.Fatal(err)
+	for companyID, company := range companies {
+		if company.Media.Count == 0 && len(company.UnlinkedWorks) == 0 {
+			delete(companies, companyID)
+		}
 	}
+	return companies, nil
+}
 
-	var results = make(map[string]*Media)
-
-	for {
-		record, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatal(err)
-		}
+// shardOf returns the shard of a wikidata company
+func shardOf(qid string, shards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(qid))
+	return int(hash.Sum32() % uint32(shards))
+}
 
-		if record[2] == "" {
-			continue
+// candidateIndex returns the position of a candidate of an item, or -1
+func candidateIndex(item *Item, qid string) int {
+	for idx, possibility := range item.Possibilites {
+		if possibility.WikidataID == qid {
+			return idx
 		}
+	}
+	return -1
+}
 
-		tmdbID, err := strconv.ParseInt(record[2], 10, 64)
-		if err != nil {
-			log.Printf("invalid score found in mapping csv: %s", record[2])
+// shardItems returns the items with the candidates in the shard. An accepted
+// pair is only scored in the shard of its QID.
+func shardItems(compareSet []*Item, store *decisions.Store, shard int, shards int) []*Item {
+	var items []*Item
+	for _, item := range compareSet {
+		if accepted := store.Accepted(item.TmdbID); accepted != nil && shardOf(accepted.QID, shards) != shard {
 			continue
 		}
-		cID := record[0]
-		tmdbType := record[3]
-
-		media, exists := results[cID]
-		if !exists {
-			media = &Media{}
-			results[cID] = media
+		var possibilities []*Possibility
+		for _, possibility := range item.Possibilites {
+			if shardOf(possibility.WikidataID, shards) == shard {
+				possibilities = append(possibilities, possibility)
+			}
 		}
-
-		if tmdbType == "movie" {
-			media.Movies = append(media.Movies, tmdbID)
-		} else if tmdbType == "tv" {
-			media.TV = append(media.TV, tmdbID)
-		} else {
-			log.Printf("invalid media type found in mapping csv: %s", tmdbType)
+		if len(possibilities) == 0 && store.Accepted(item.TmdbID) == nil {
 			continue
 		}
-		media.Count += 1
+		items = append(items, &Item{
+			TmdbID:       item.TmdbID,
+			CompanyName:  item.CompanyName,
+			Possibilites: possibilities,
+		})
 	}
-
-	return results, err
+	return items
 }
 
-func main() {
-	titleCompareCSVPath := os.Args[1]
-	tmdbMediaCSVPath := os.Args[2]
-	wikidataMediaCSVPath := os.Args[3]
-	outputMatchCSVPath := os.Args[4]
-
-	compareSet, err := loadCompareCSV(titleCompareCSVPath)
-	if err != nil {
-		log.Fatalf("error while loading compare csv: %s", err)
+// loadShard loads the companies of the items and their candidates from the
+// mappings, so memory grows with the shard instead of the mappings
+func loadShard(items []*Item, store *decisions.Store, tmdbMediaCSVPath string, wikidataMediaCSVPath string) (map[string]*matching.Company, map[string]*matching.Company, error) {
+	var tmdbIDs = make(map[string]bool)
+	var qids = make(map[string]bool)
+	for _, item := range items {
+		tmdbIDs[item.TmdbID] = true
+		for _, possibility := range item.Possibilites {
+			qids[possibility.WikidataID] = true
+		}
+		if accepted := store.Accepted(item.TmdbID); accepted != nil {
+			qids[accepted.QID] = true
+		}
 	}
 
-	tmdbMediaSet, err := loadMediaMappingCSV(tmdbMediaCSVPath)
+	tmdbMediaSet, err := withMedia(matching.LoadTmdbMediaMapping(tmdbMediaCSVPath, tmdbIDs))
 	if err != nil {
-		log.Fatalf("error while loading tmdb media set csv: %s", err)
+		return nil, nil, fmt.Errorf("error while loading tmdb media mapping: %w", err)
 	}
 
-	wikidataMediaSet, err := loadMediaMappingCSV(wikidataMediaCSVPath)
+	wikidataMediaSet, err := withMedia(matching.LoadWikidataMediaMapping(wikidataMediaCSVPath, qids))
 	if err != nil {
-		log.Fatalf("error while loading wikidata media set csv: %s", err)
+		return nil, nil, fmt.Errorf("error while loading wikidata media mapping: %w", err)
 	}
+	return tmdbMediaSet, wikidataMediaSet, nil
+}
 
+// scoreItems finds the best scoring candidate of each item
+func scoreItems(items []*Item, tmdbMediaSet map[string]*matching.Company, wikidataMediaSet map[string]*matching.Company, store *decisions.Store, model *classifier.Model) []*Match {
 	var matches []*Match
 
-	var matchedIDs []string
-
-	for _, item := range compareSet {
+	for _, item := range items {
 		var bestResult *Match
+		accepted := store.Accepted(item.TmdbID)
 		tmdbMapping, exists := tmdbMediaSet[item.TmdbID]
 		if !exists {
-			continue
+			if accepted == nil {
+				continue
+			}
+			tmdbMapping = &matching.Company{ID: item.TmdbID}
 		}
 		for _, possibility := range item.Possibilites {
+			if store.IsRejected(item.TmdbID, possibility.WikidataID) {
+				continue
+			}
+			// only the accepted pair is scored when there is one
+			if accepted != nil && possibility.WikidataID != accepted.QID {
+				continue
+			}
 			wikidataMapping, exists := wikidataMediaSet[possibility.WikidataID]
 			if !exists {
-				continue
+				if accepted == nil {
+					continue
+				}
+				wikidataMapping = &matching.Company{ID: possibility.WikidataID}
 			}
 
-			mappingScore, mapMatchCount := calculateMappingScoreOverlapCoeff(tmdbMapping, wikidataMapping)
-			totalScore := mappingScore * possibility.Score
+			mappingScore, mapMatchCount := matching.OverlapCoeff(&tmdbMapping.Media, &wikidataMapping.Media)
+			fuzzyScore, fuzzyMatchCount := matching.FuzzyCommon(tmdbMapping, wikidataMapping)
+			mediaScore := mappingScore
+			if FUZZY_MEDIA_WEIGHT*fuzzyScore > mediaScore {
+				mediaScore = FUZZY_MEDIA_WEIGHT * fuzzyScore
+			}
+			totalScore := mediaScore * possibility.Weight()
 
 			saveTheResult := bestResult == nil
 			saveTheResult = saveTheResult || totalScore > bestResult.TotalScore
@@ -226,61 +305,201 @@ func main() {
 					WikidataCompanyName: possibility.CompanyName,
 					NameScore:           possibility.Score,
 					MappingScore:        mappingScore,
-					TmdbMapCount:        tmdbMapping.Count,
-					WikidataMapCount:    wikidataMapping.Count,
+					TmdbMapCount:        tmdbMapping.Media.Count,
+					WikidataMapCount:    wikidataMapping.Media.Count,
 					MapMatchCount:       mapMatchCount,
+					FuzzyScore:          fuzzyScore,
+					FuzzyMatchCount:     fuzzyMatchCount,
 					TotalScore:          totalScore,
+					LinkStatus:          LinkStatus(item.TmdbID, wikidataMapping),
+					LinkedTmdbIDs:       wikidataMapping.LinkedTmdbIDs,
+					Probability:         -1,
+				}
+				if model != nil {
+					bestResult.Probability = model.Predict(classifier.Features(tmdbMapping, wikidataMapping))
+				}
+			}
+		}
+		if accepted != nil {
+			if bestResult == nil {
+				// accepted pair was not in the title compare candidates
+				bestResult = &Match{
+					TmdbID:              item.TmdbID,
+					TmdbCompanyName:     item.CompanyName,
+					WikidataID:          accepted.QID,
+					WikidataCompanyName: accepted.QID,
+					TmdbMapCount:        tmdbMapping.Media.Count,
+					LinkStatus:          LINK_STATUS_NEW,
+					Probability:         -1,
+				}
+				if wikidataMapping, exists := wikidataMediaSet[accepted.QID]; exists {
+					bestResult.WikidataMapCount = wikidataMapping.Media.Count
+					bestResult.LinkStatus = LinkStatus(item.TmdbID, wikidataMapping)
+					bestResult.LinkedTmdbIDs = wikidataMapping.LinkedTmdbIDs
 				}
 			}
+			bestResult.Decided = true
 		}
+
 		// i am interested in 3 quadrants
 		// POSITIVE POSITIVES
 		// POSITIVE NEGATIVES (name match = low, high mapping match)
 		// NEGATIVE POSITIVES (name match = high, zero mapping match)
 		if bestResult != nil {
 			matches = append(matches, bestResult)
-			matchedIDs = append(matchedIDs, bestResult.WikidataID)
 		}
 	}
 
-	sort.Slice(matches, func(i int, j int) bool {
-		m1 := matches[i]
-		m2 := matches[j]
-		if m1.TotalScore != m2.TotalScore {
-			return m1.TotalScore > m2.TotalScore
+	return matches
+}
+
+func main() {
+	modelPath := flag.String("model", "", "classifier model json used to add match probabilities")
+	showStats := flag.Bool("stats", false, "print the run time and peak memory")
+	shards := flag.Int("shards", 1, "score the candidates in this many parts to bound memory, each reads the mappings again")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <title compare csv> <tmdb media mapping> <wikidata media mapping> <output> [decisions csv]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 4 || *shards < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	titleCompareCSVPath := flag.Arg(0)
+	tmdbMediaCSVPath := flag.Arg(1)
+	wikidataMediaCSVPath := flag.Arg(2)
+	outputMatchCSVPath := flag.Arg(3)
+	decisionsPath := flag.Arg(4)
+
+	var run *stats.Run
+	if *showStats {
+		run = stats.Start("004_mediaidscompare")
+	}
+
+	var model *classifier.Model
+	if *modelPath != "" {
+		var err error
+		model, err = classifier.LoadModel(*modelPath)
+		if err != nil {
+			log.Fatalf("error while loading model: %s", err)
 		}
-		return m1.NameScore > m2.NameScore
-	})
+	}
 
-	saveMatches(matches, outputMatchCSVPath)
-}
+	decisionStore, err := store.LoadDecisions(decisionsPath)
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
 
-func saveMatches(matches []*Match, path string) error {
-	f, err := os.Create(path + ".tmp")
+	var compareSet []*Item
+	if store.IsStorePath(titleCompareCSVPath) {
+		compareSet, err = loadComparePairs(titleCompareCSVPath)
+	} else {
+		compareSet, err = loadCompareCSV(titleCompareCSVPath)
+	}
 	if err != nil {
-		return err
+		log.Fatalf("error while loading compare csv: %s", err)
 	}
-	defer f.Close()
 
-	csvWriter := csv.NewWriter(f)
-	// write headers
-	err = csvWriter.Write([]string{
-		"match",
-		"tmdb_id",
-		"tmdb_company_name",
-		"wikidata_id",
-		"wikidata_company_name",
-		"total_score",
-		"name_match_subscore",
-		"common_media_subscore",
-		"tmdb_media_count",
-		"wikidata_media_count",
-		"common_media_count",
+	mediaCandidates, err := matching.LoadMediaCandidates(titleCompareCSVPath)
+	if err != nil {
+		log.Fatalf("error while loading media candidates: %s", err)
+	}
+	for _, item := range compareSet {
+		for _, possibility := range item.Possibilites {
+			possibility.ByMedia = mediaCandidates.Has(item.TmdbID, possibility.WikidataID)
+		}
+	}
+
+	// every shard reads the mappings again but only keeps its own companies.
+	// The wikidata companies are split by QID, so each is loaded by one shard,
+	// and an item is scored in each shard holding one of its candidates
+	var position = make(map[string]int, len(compareSet))
+	for idx, item := range compareSet {
+		position[item.TmdbID] = idx
+	}
+	var best = make(map[string]*Match, len(compareSet))
+	var found []*Suggestion
+	for shard := 0; shard < *shards; shard++ {
+		items := shardItems(compareSet, decisionStore, shard, *shards)
+		tmdbMediaSet, wikidataMediaSet, err := loadShard(items, decisionStore, tmdbMediaCSVPath, wikidataMediaCSVPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shardMatches := scoreItems(items, tmdbMediaSet, wikidataMediaSet, decisionStore, model)
+		for _, match := range shardMatches {
+			// on a tie the first candidate wins, as when scored in one part
+			current := best[match.TmdbID]
+			item := compareSet[position[match.TmdbID]]
+			if current == nil || match.Better(current) || !current.Better(match) && candidateIndex(item, match.WikidataID) < candidateIndex(item, current.WikidataID) {
+				best[match.TmdbID] = match
+			}
+		}
+		found = append(found, findSuggestions(shardMatches, tmdbMediaSet, wikidataMediaSet)...)
+	}
+
+	// in title compare order first, so ties sort the same whatever the shards
+	var matches []*Match
+	for _, item := range compareSet {
+		if match := best[item.TmdbID]; match != nil {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i int, j int) bool {
+		return matches[i].Better(matches[j])
+	})
+
+	// only the suggestions of the best candidate of each item are kept
+	var suggestions []*Suggestion
+	for _, suggestion := range found {
+		if best[suggestion.Match.TmdbID] == suggestion.Match {
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	sort.SliceStable(suggestions, func(i int, j int) bool {
+		return position[suggestions[i].Match.TmdbID] < position[suggestions[j].Match.TmdbID]
 	})
+
+	err = saveMatches(matches, outputMatchCSVPath)
 	if err != nil {
-		return err
+		log.Fatalf("error while saving matches: %s", err)
 	}
 
+	err = reportSuggestions(dedupeSuggestions(suggestions), outputMatchCSVPath)
+	if err != nil {
+		log.Fatalf("error while saving media suggestions: %s", err)
+	}
+
+	if run != nil {
+		run.Report()
+	}
+}
+
+var RESULT_HEADER = []string{
+	"match",
+	"tmdb_id",
+	"tmdb_company_name",
+	"wikidata_id",
+	"wikidata_company_name",
+	"total_score",
+	"name_match_subscore",
+	"common_media_subscore",
+	"tmdb_media_count",
+	"wikidata_media_count",
+	"common_media_count",
+	"link_status",
+	"linked_tmdb_ids",
+	"match_probability",
+	"fuzzy_media_subscore",
+	"fuzzy_common_media_count",
+}
+
+// resultRecords returns the result rows of the matches, leaving out NOPE, and
+// prints the count of each label
+func resultRecords(matches []*Match) [][]string {
+	var records [][]string
 	counts := make(map[string]int)
 
 	for _, match := range matches {
@@ -289,7 +508,11 @@ func saveMatches(matches []*Match, path string) error {
 		if label == "NOPE" {
 			continue
 		}
-		csvWriter.Write([]string{
+		probability := ""
+		if match.Probability >= 0 {
+			probability = strconv.FormatFloat(match.Probability, 'f', 4, 64)
+		}
+		records = append(records, []string{
 			label,
 			match.TmdbID,
 			match.TmdbCompanyName,
@@ -301,9 +524,40 @@ func saveMatches(matches []*Match, path string) error {
 			strconv.FormatInt(int64(match.TmdbMapCount), 10),
 			strconv.FormatInt(int64(match.WikidataMapCount), 10),
 			strconv.FormatInt(int64(match.MapMatchCount), 10),
+			match.LinkStatus,
+			strings.Join(match.LinkedTmdbIDs, ";"),
+			probability,
+			strconv.FormatFloat(match.FuzzyScore, 'f', 4, 64),
+			strconv.FormatInt(int64(match.FuzzyMatchCount), 10),
 		})
 	}
 
+	fmt.Printf("COUNTS: %v\n", counts)
+	return records
+}
+
+func saveMatches(matches []*Match, path string) error {
+	if store.IsStorePath(path) {
+		return saveScores(matches, path)
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	// write headers
+	err = csvWriter.Write(RESULT_HEADER)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range resultRecords(matches) {
+		csvWriter.Write(record)
+	}
+
 	csvWriter.Flush()
 	if err := csvWriter.Error(); err != nil {
 		return err
@@ -319,19 +573,82 @@ func saveMatches(matches []*Match, path string) error {
 		return err
 	}
 
-	fmt.Printf("COUNTS: %v\n", counts)
-
 	return nil
 }
 
+// saveScores replaces the scores in the pipeline store with the matches
+func saveScores(matches []*Match, path string) error {
+	db, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var scores []*store.Score
+	for _, record := range resultRecords(matches) {
+		score := &store.Score{
+			TmdbID: record[1],
+			QID:    record[3],
+			Values: make(map[string]string, len(RESULT_HEADER)),
+		}
+		for idx, column := range RESULT_HEADER {
+			score.Values[column] = record[idx]
+		}
+		scores = append(scores, score)
+	}
+	err = db.PutScores(RESULT_HEADER, scores)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// loadComparePairs reads the candidates 001 wrote to the pipeline store
+func loadComparePairs(path string) ([]*Item, error) {
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	pairs, err := db.Pairs()
+	if err != nil {
+		return nil, err
+	}
+	var results []*Item
+	for _, pair := range pairs {
+		if len(results) == 0 || results[len(results)-1].TmdbID != pair.TmdbID {
+			results = append(results, &Item{
+				TmdbID:      pair.TmdbID,
+				CompanyName: pair.TmdbName,
+			})
+		}
+		item := results[len(results)-1]
+		item.Possibilites = append(item.Possibilites, &Possibility{
+			WikidataID:  pair.QID,
+			CompanyName: pair.WikidataName,
+			Score:       pair.NameScore,
+		})
+	}
+	return results, nil
+}
+
 func (m Match) Label() string {
+	if m.Decided {
+		return "DECIDED"
+	}
+
 	nameMatchGood := m.NameScore > 0.72
 	mappingMatchGood := m.MappingScore > 0.0
+	// titles are weaker evidence, they never make a PROBABLY on their own
+	fuzzyMatchGood := m.FuzzyScore > 0.0
 
 	if nameMatchGood && mappingMatchGood {
 		return "PROBABLY"
 	} else if !nameMatchGood && mappingMatchGood {
 		return "MAYBE"
+	} else if nameMatchGood && fuzzyMatchGood {
+		return "MAYBE"
 	} else if nameMatchGood && !mappingMatchGood {
 		if m.NameScore > 0.9 {
 			return "MAYBE"
@@ -341,38 +658,3 @@ func (m Match) Label() string {
 		return "NOPE"
 	}
 }
-
-func calculateMappingScoreOverlapCoeff(tmdbMapping *Media, wikidataMapping *Media) (float64, int) {
-	var union int
-	if tmdbMapping.Count > wikidataMapping.Count {
-		union = wikidataMapping.Count
-	} else {
-		union = tmdbMapping.Count
-	}
-	if union == 0 {
-		return 0, 0 // avoid a divide by zero error
-	}
-
-	intersection := 0
-	for _, tmdbID := range tmdbMapping.Movies {
-		for _, wdTmdbID := range wikidataMapping.Movies {
-			if tmdbID == wdTmdbID {
-				intersection += 1
-			}
-		}
-	}
-	for _, tmdbID := range tmdbMapping.TV {
-		for _, wdTmdbID := range wikidataMapping.TV {
-			if tmdbID == wdTmdbID {
-				intersection += 1
-			}
-		}
-	}
-
-	// union = wikidataMapping.Count + tmdbMapping.Count - intersection
-	// if union == 0 {
-	// 	return 0, 0 // avoid a divide by zero error
-	// }
-	// return float64(intersection) / float64(union), intersection
-	return float64(intersection) / float64(union), intersection
-}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/quickstatements"
+)
+
+// Saved next to the result with the TMDB ids suggested for wikidata works
+const SUGGESTIONS_SUFFIX = ".media_suggestions.csv"
+const SUGGESTIONS_QS_SUFFIX = ".media_suggestions.qs.txt"
+
+// Wikidata property for the TMDB id of each media type
+var TMDB_ID_PROPERTIES = map[string]string{
+	"movie": "P4947",
+	"tv":    "P4983",
+}
+
+// Only works of these company matches get suggestions. Only the ones of a
+// DECIDED match go into the batch, the others are listed as unconfirmed
+var SUGGESTION_LABELS = []string{"DECIDED", "PROBABLY"}
+
+const (
+	FINDING_SUGGESTION = "suggestion"
+	// the company match was not reviewed, so the suggestion is for review
+	FINDING_UNCONFIRMED  = "unconfirmed"
+	FINDING_DIFFERENT_ID = "different_id"
+	// the work was paired with different ids through different companies
+	FINDING_AMBIGUOUS = "ambiguous"
+)
+
+type Suggestion struct {
+	Property string
+	Tmdb     matching.MediaTitle
+	Work     matching.MediaTitle
+	Finding  string
+	// the company match the work was found through
+	Match *Match
+}
+
+func (s *Suggestion) Evidence() string {
+	return fmt.Sprintf("%s: %s [%s] <=> [%s] %s (total_score: %0.4f)",
+		s.Match.Label(),
+		s.Match.TmdbCompanyName,
+		s.Match.TmdbID,
+		s.Match.WikidataID,
+		s.Match.WikidataCompanyName,
+		s.Match.TotalScore)
+}
+
+func (s *Suggestion) key() string {
+	return s.Work.Work + "/" + s.Property + "/" + strconv.FormatInt(s.Tmdb.TmdbID, 10)
+}
+
+// findSuggestions pairs the media of confirmed company matches by title and
+// year. Works without an id of the media type are suggested the TMDB id, works
+// with a different one are flagged. A work can be found through several
+// companies, dedupeSuggestions keeps one.
+func findSuggestions(matches []*Match, tmdbMediaSet map[string]*matching.Company, wikidataMediaSet map[string]*matching.Company) []*Suggestion {
+	var suggestions []*Suggestion
+	add := func(match *Match, titleMatch matching.TitleMatch, finding string) {
+		suggestions = append(suggestions, &Suggestion{
+			Property: TMDB_ID_PROPERTIES[titleMatch.Tmdb.MediaType],
+			Tmdb:     titleMatch.Tmdb,
+			Work:     titleMatch.Work,
+			Finding:  finding,
+			Match:    match,
+		})
+	}
+
+	for _, match := range matches {
+		if !dumbInSlice(SUGGESTION_LABELS, match.Label()) {
+			continue
+		}
+		tmdbMapping, exists := tmdbMediaSet[match.TmdbID]
+		if !exists {
+			continue
+		}
+		wikidataMapping, exists := wikidataMediaSet[match.WikidataID]
+		if !exists {
+			continue
+		}
+		for _, titleMatch := range matching.FuzzyMatches(tmdbMapping, wikidataMapping) {
+			// a tv series is not given a movie id, as 003 would report it
+			if matching.TypeFinding(titleMatch.Work.Kinds(), titleMatch.Tmdb.MediaType) != "" {
+				continue
+			}
+			if match.Decided {
+				add(match, titleMatch, FINDING_SUGGESTION)
+			} else {
+				add(match, titleMatch, FINDING_UNCONFIRMED)
+			}
+		}
+		for _, titleMatch := range matching.FuzzyConflicts(tmdbMapping, wikidataMapping) {
+			add(match, titleMatch, FINDING_DIFFERENT_ID)
+		}
+	}
+	return suggestions
+}
+
+// dedupeSuggestions keeps each suggestion once, with a decided company match
+// or else the best one as evidence, and marks the works suggested more than
+// one id
+func dedupeSuggestions(found []*Suggestion) []*Suggestion {
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Match.Decided != found[j].Match.Decided {
+			return found[i].Match.Decided
+		}
+		return found[i].Match.Better(found[j].Match)
+	})
+	var suggestions []*Suggestion
+	var seen = make(map[string]bool)
+	for _, suggestion := range found {
+		if !seen[suggestion.key()] {
+			seen[suggestion.key()] = true
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+
+	// a work suggested more than one id of a property is left for review
+	var suggested = make(map[string]int)
+	isSuggested := func(suggestion *Suggestion) bool {
+		return suggestion.Finding == FINDING_SUGGESTION || suggestion.Finding == FINDING_UNCONFIRMED
+	}
+	for _, suggestion := range suggestions {
+		if isSuggested(suggestion) {
+			suggested[suggestion.Work.Work+"/"+suggestion.Property] += 1
+		}
+	}
+	for _, suggestion := range suggestions {
+		if isSuggested(suggestion) && suggested[suggestion.Work.Work+"/"+suggestion.Property] > 1 {
+			suggestion.Finding = FINDING_AMBIGUOUS
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Work.Work < suggestions[j].Work.Work
+	})
+	return suggestions
+}
+
+func formatYear(year int) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(year)
+}
+
+// saveSuggestions writes every suggestion and flagged work with the company
+// match as evidence
+func saveSuggestions(suggestions []*Suggestion, path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{
+		"finding",
+		"qid",
+		"property",
+		"tmdb_id",
+		"existing_tmdb_id",
+		"work_title",
+		"work_year",
+		"tmdb_title",
+		"tmdb_year",
+		"tmdb_company_id",
+		"wikidata_company_id",
+		"evidence",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, suggestion := range suggestions {
+		existing := ""
+		if suggestion.Work.TmdbID != 0 {
+			existing = strconv.FormatInt(suggestion.Work.TmdbID, 10)
+		}
+		err = csvWriter.Write([]string{
+			suggestion.Finding,
+			suggestion.Work.Work,
+			suggestion.Property,
+			strconv.FormatInt(suggestion.Tmdb.TmdbID, 10),
+			existing,
+			suggestion.Work.Name,
+			formatYear(suggestion.Work.Year),
+			suggestion.Tmdb.Name,
+			formatYear(suggestion.Tmdb.Year),
+			suggestion.Match.TmdbID,
+			suggestion.Match.WikidataID,
+			suggestion.Evidence(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// saveSuggestionsQuickStatements writes the suggestions as tab separated
+// QuickStatements V1 commands, as in 005. Only the suggestions of DECIDED
+// company matches are written. The property differs from line to
+// line, which the CSV format cannot give a reference to in one column group.
+func saveSuggestionsQuickStatements(suggestions []*Suggestion, path string, retrieved time.Time) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, suggestion := range suggestions {
+		if suggestion.Finding != FINDING_SUGGESTION {
+			continue
+		}
+		line := strings.Join([]string{
+			suggestion.Work.Work,
+			suggestion.Property,
+			strconv.Quote(strconv.FormatInt(suggestion.Tmdb.TmdbID, 10)),
+			"S248", quickstatements.STATED_IN_TMDB,
+			"S813", quickstatements.FormatRetrievedDate(retrieved),
+			"S887", quickstatements.DEFAULT_HEURISTIC,
+		}, "\t")
+		_, err := fmt.Fprintln(f, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// reportSuggestions saves the suggestions next to the result
+func reportSuggestions(suggestions []*Suggestion, outputMatchCSVPath string) error {
+	err := saveSuggestions(suggestions, outputMatchCSVPath+SUGGESTIONS_SUFFIX)
+	if err != nil {
+		return err
+	}
+	err = saveSuggestionsQuickStatements(suggestions, outputMatchCSVPath+SUGGESTIONS_QS_SUFFIX, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var counts = make(map[string]int)
+	for _, suggestion := range suggestions {
+		counts[suggestion.Finding] += 1
+	}
+	if len(suggestions) > 0 {
+		var parts []string
+		for _, finding := range []string{FINDING_SUGGESTION, FINDING_UNCONFIRMED, FINDING_DIFFERENT_ID, FINDING_AMBIGUOUS} {
+			parts = append(parts, fmt.Sprintf("%s: %d", finding, counts[finding]))
+		}
+		fmt.Printf("MEDIA SUGGESTIONS: %s, see %s\n", strings.Join(parts, ", "), outputMatchCSVPath+SUGGESTIONS_SUFFIX)
+	}
+	return nil
+}
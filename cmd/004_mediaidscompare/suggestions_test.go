@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+func decidedMatch(tmdbID string, qid string) *Match {
+	return &Match{TmdbID: tmdbID, WikidataID: qid, Decided: true}
+}
+
+func probablyMatch(tmdbID string, qid string, totalScore float64) *Match {
+	return &Match{TmdbID: tmdbID, WikidataID: qid, NameScore: 0.9, MappingScore: 0.5, TotalScore: totalScore}
+}
+
+func suggestion(match *Match, qid string, tmdbID int64, finding string) *Suggestion {
+	return &Suggestion{
+		Property: TMDB_ID_PROPERTIES["movie"],
+		Tmdb:     matching.MediaTitle{MediaType: "movie", TmdbID: tmdbID},
+		Work:     matching.MediaTitle{Work: qid},
+		Finding:  finding,
+		Match:    match,
+	}
+}
+
+// fuzzyCompanyPair returns companies sharing a film by title, and a tv series
+// on wikidata that only has a movie of the same title on TMDB
+func fuzzyCompanyPair(id string) (*matching.Company, *matching.Company) {
+	tmdb := &matching.Company{ID: id, Titles: []matching.MediaTitle{
+		{Title: "film " + id, Year: 2001, MediaType: "movie", TmdbID: 100},
+		{Title: "series " + id, Year: 2001, MediaType: "movie", TmdbID: 200},
+	}}
+	wikidata := &matching.Company{ID: "Q" + id, UnlinkedWorks: []matching.MediaTitle{
+		{Title: "film " + id, Year: 2001, Work: "Q" + id + "film", Class: "film"},
+		{Title: "series " + id, Year: 2001, Work: "Q" + id + "series", Class: "tv_series"},
+	}}
+	return tmdb, wikidata
+}
+
+func TestFindSuggestions(t *testing.T) {
+	tmdb := map[string]*matching.Company{}
+	wikidata := map[string]*matching.Company{}
+	for _, id := range []string{"1", "2", "3"} {
+		tmdb[id], wikidata["Q"+id] = fuzzyCompanyPair(id)
+	}
+	matches := []*Match{
+		decidedMatch("1", "Q1"),
+		probablyMatch("2", "Q2", 0.5),
+		// MAYBE matches get no suggestions
+		{TmdbID: "3", WikidataID: "Q3", NameScore: 0.5, MappingScore: 0.5},
+	}
+
+	var findings = make(map[string]string)
+	for _, found := range findSuggestions(matches, tmdb, wikidata) {
+		findings[found.Work.Work] = found.Finding
+	}
+	expected := map[string]string{
+		"Q1film": FINDING_SUGGESTION,
+		"Q2film": FINDING_UNCONFIRMED,
+	}
+	if len(findings) != len(expected) {
+		t.Errorf("got %v, expected %v", findings, expected)
+	}
+	for work, finding := range expected {
+		if findings[work] != finding {
+			t.Errorf("%s is %q, expected %q", work, findings[work], finding)
+		}
+	}
+}
+
+func TestDedupeSuggestions(t *testing.T) {
+	decided := decidedMatch("1", "Q1")
+	better := probablyMatch("2", "Q2", 0.9)
+	worse := probablyMatch("3", "Q3", 0.4)
+	suggestions := dedupeSuggestions([]*Suggestion{
+		// found through all three, the decided match is kept over a better one
+		suggestion(better, "Q10", 10, FINDING_UNCONFIRMED),
+		suggestion(worse, "Q10", 10, FINDING_UNCONFIRMED),
+		suggestion(decided, "Q10", 10, FINDING_SUGGESTION),
+		// found through two unconfirmed matches, the better is kept
+		suggestion(worse, "Q20", 20, FINDING_UNCONFIRMED),
+		suggestion(better, "Q20", 20, FINDING_UNCONFIRMED),
+		// suggested two ids, the confirmed one as well
+		suggestion(decided, "Q30", 30, FINDING_SUGGESTION),
+		suggestion(worse, "Q30", 31, FINDING_UNCONFIRMED),
+		suggestion(worse, "Q40", 40, FINDING_DIFFERENT_ID),
+	})
+
+	type kept struct {
+		work    string
+		tmdbID  int64
+		finding string
+		match   *Match
+	}
+	expected := []kept{
+		{"Q10", 10, FINDING_SUGGESTION, decided},
+		{"Q20", 20, FINDING_UNCONFIRMED, better},
+		{"Q30", 30, FINDING_AMBIGUOUS, decided},
+		{"Q30", 31, FINDING_AMBIGUOUS, worse},
+		{"Q40", 40, FINDING_DIFFERENT_ID, worse},
+	}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("kept %d suggestions, expected %d", len(suggestions), len(expected))
+	}
+	for idx, suggestion := range suggestions {
+		got := kept{suggestion.Work.Work, suggestion.Tmdb.TmdbID, suggestion.Finding, suggestion.Match}
+		if got != expected[idx] {
+			t.Errorf("suggestion %d: got %+v, expected %+v", idx, got, expected[idx])
+		}
+	}
+
+	// only the suggestion through the decided match goes into the batch
+	path := filepath.Join(t.TempDir(), "result.csv"+SUGGESTIONS_QS_SUFFIX)
+	err := saveSuggestionsQuickStatements(suggestions, path, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "Q10\tP4947\t\"10\"\t") {
+		t.Errorf("got batch %q, expected only Q10", string(data))
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/quickstatements"
+)
+
+const TMDB_COMPANY_ID_PROPERTY = "P11806"
+
+type Match struct {
+	Label               string
+	TmdbID              string
+	TmdbCompanyName     string
+	WikidataID          string
+	WikidataCompanyName string
+	TotalScore          float64
+	NameScore           float64
+	MappingScore        float64
+	LinkStatus          string
+	LinkedTmdbIDs       string
+}
+
+type Filter struct {
+	Labels          []string
+	MinTotalScore   float64
+	MinNameScore    float64
+	MinMappingScore float64
+}
+
+func (f *Filter) Allows(m *Match) bool {
+	if len(f.Labels) > 0 && fileio.FindInSlice(f.Labels, m.Label) == -1 {
+		return false
+	}
+	return m.TotalScore >= f.MinTotalScore &&
+		m.NameScore >= f.MinNameScore &&
+		m.MappingScore >= f.MinMappingScore
+}
+
+func loadMatchesCSV(path string) ([]*Match, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	labelIdx := fileio.FindInSlice(headers, "match")
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	tmdbNameIdx := fileio.FindInSlice(headers, "tmdb_company_name")
+	wikidataIDIdx := fileio.FindInSlice(headers, "wikidata_id")
+	wikidataNameIdx := fileio.FindInSlice(headers, "wikidata_company_name")
+	totalScoreIdx := fileio.FindInSlice(headers, "total_score")
+	nameScoreIdx := fileio.FindInSlice(headers, "name_match_subscore")
+	mappingScoreIdx := fileio.FindInSlice(headers, "common_media_subscore")
+	// older result files do not have link status columns
+	linkStatusIdx := fileio.FindInSlice(headers, "link_status")
+	linkedTmdbIDsIdx := fileio.FindInSlice(headers, "linked_tmdb_ids")
+
+	if labelIdx == -1 ||
+		tmdbIDIdx == -1 ||
+		wikidataIDIdx == -1 ||
+		totalScoreIdx == -1 ||
+		nameScoreIdx == -1 ||
+		mappingScoreIdx == -1 {
+		return nil, fmt.Errorf("invalid CSV given: must have fields match, tmdb_id, wikidata_id, total_score, name_match_subscore, common_media_subscore")
+	}
+
+	var matches []*Match
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		match := &Match{
+			Label:      record[labelIdx],
+			TmdbID:     record[tmdbIDIdx],
+			WikidataID: record[wikidataIDIdx],
+		}
+		if tmdbNameIdx != -1 {
+			match.TmdbCompanyName = record[tmdbNameIdx]
+		}
+		if wikidataNameIdx != -1 {
+			match.WikidataCompanyName = record[wikidataNameIdx]
+		}
+		if linkStatusIdx != -1 {
+			match.LinkStatus = record[linkStatusIdx]
+		}
+		if linkedTmdbIDsIdx != -1 {
+			match.LinkedTmdbIDs = record[linkedTmdbIDsIdx]
+		}
+
+		if match.TmdbID == "" || match.WikidataID == "" || match.WikidataID[0] != 'Q' {
+			log.Printf("skipping invalid row: %v", record)
+			continue
+		}
+
+		match.TotalScore, err = strconv.ParseFloat(record[totalScoreIdx], 64)
+		if err == nil {
+			match.NameScore, err = strconv.ParseFloat(record[nameScoreIdx], 64)
+		}
+		if err == nil {
+			match.MappingScore, err = strconv.ParseFloat(record[mappingScoreIdx], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid score found for %s <=> %s: %w", match.TmdbID, match.WikidataID, err)
+		}
+
+		matches = append(matches, match)
+	}
+
+	return matches, nil
+}
+
+// saveConflicts writes matches where the wikidata item already has a different
+// TMDB company ID so they can be reviewed by hand
+func saveConflicts(matches []*Match, path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{
+		"match",
+		"tmdb_id",
+		"tmdb_company_name",
+		"wikidata_id",
+		"wikidata_company_name",
+		"linked_tmdb_ids",
+		"total_score",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		err = csvWriter.Write([]string{
+			match.Label,
+			match.TmdbID,
+			match.TmdbCompanyName,
+			match.WikidataID,
+			match.WikidataCompanyName,
+			match.LinkedTmdbIDs,
+			strconv.FormatFloat(match.TotalScore, 'f', 4, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+type Exporter struct {
+	Retrieved string
+	Heuristic string
+}
+
+// saveQuickStatementsV1 writes tab separated QuickStatements V1 commands
+func (e *Exporter) saveQuickStatementsV1(matches []*Match, path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, match := range matches {
+		line := strings.Join([]string{
+			match.WikidataID,
+			TMDB_COMPANY_ID_PROPERTY,
+			strconv.Quote(match.TmdbID),
+			"S248", quickstatements.STATED_IN_TMDB,
+			"S813", e.Retrieved,
+			"S887", e.Heuristic,
+		}, "\t")
+		_, err := fmt.Fprintln(f, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// saveQuickStatementsCSV writes the QuickStatements CSV format.
+// Lowercase s in the header continues the reference group started by S248.
+func (e *Exporter) saveQuickStatementsCSV(matches []*Match, path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{"qid", TMDB_COMPANY_ID_PROPERTY, "S248", "s813", "s887", "#"})
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		err = csvWriter.Write([]string{
+			match.WikidataID,
+			strconv.Quote(match.TmdbID),
+			quickstatements.STATED_IN_TMDB,
+			e.Retrieved,
+			e.Heuristic,
+			fmt.Sprintf("%s: %s <=> %s (total_score: %0.4f)", match.Label, match.TmdbCompanyName, match.WikidataCompanyName, match.TotalScore),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func main() {
+	var filter Filter
+	var labels string
+	var retrieved string
+	var exporter Exporter
+	var decisionsPath string
+
+	flag.StringVar(&labels, "labels", "DECIDED,PROBABLY", "comma separated match labels to export (empty for all)")
+	flag.Float64Var(&filter.MinTotalScore, "min-total", 0, "minimum total_score")
+	flag.Float64Var(&filter.MinNameScore, "min-name", 0, "minimum name_match_subscore")
+	flag.Float64Var(&filter.MinMappingScore, "min-media", 0, "minimum common_media_subscore")
+	flag.StringVar(&retrieved, "retrieved", time.Now().Format("2006-01-02"), "retrieved date (P813) as YYYY-MM-DD")
+	flag.StringVar(&exporter.Heuristic, "heuristic", quickstatements.DEFAULT_HEURISTIC, "item used for based on heuristic (P887)")
+	flag.StringVar(&decisionsPath, "decisions", "", "decisions csv, rejected pairs are never exported")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <result csv> <output prefix>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	resultCSVPath := flag.Arg(0)
+	outputPrefix := flag.Arg(1)
+
+	if labels != "" {
+		filter.Labels = strings.Split(labels, ",")
+	}
+
+	retrievedDate, err := time.Parse("2006-01-02", retrieved)
+	if err != nil {
+		log.Fatalf("invalid retrieved date: %s", err)
+	}
+	exporter.Retrieved = quickstatements.FormatRetrievedDate(retrievedDate)
+
+	matches, err := loadMatchesCSV(resultCSVPath)
+	if err != nil {
+		log.Fatalf("error while loading result csv: %s", err)
+	}
+
+	store, err := decisions.Load(decisionsPath)
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	var selected []*Match
+	var conflicts []*Match
+	linked := 0
+	rejected := 0
+	for _, match := range matches {
+		if store.IsRejected(match.TmdbID, match.WikidataID) {
+			rejected += 1
+			continue
+		}
+		if !filter.Allows(match) {
+			continue
+		}
+		switch match.LinkStatus {
+		case "LINKED":
+			linked += 1
+		case "CONFLICT":
+			conflicts = append(conflicts, match)
+		default:
+			selected = append(selected, match)
+		}
+	}
+
+	err = exporter.saveQuickStatementsV1(selected, outputPrefix+".qs.txt")
+	if err != nil {
+		log.Fatalf("error while saving quickstatements: %s", err)
+	}
+
+	err = exporter.saveQuickStatementsCSV(selected, outputPrefix+".qs.csv")
+	if err != nil {
+		log.Fatalf("error while saving quickstatements csv: %s", err)
+	}
+
+	err = saveConflicts(conflicts, outputPrefix+".conflicts.csv")
+	if err != nil {
+		log.Fatalf("error while saving conflicts: %s", err)
+	}
+
+	fmt.Printf("Exported %d of %d matches (already linked: %d, conflicts: %d, rejected: %d)\n", len(selected), len(matches), linked, len(conflicts), rejected)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+const TOP_TITLES = 3
+
+// Entry type for the catalog: film production company
+const ENTRY_TYPE = "Q1762059"
+
+type TMDBItem struct {
+	ID   int64
+	Name string
+}
+
+type Media struct {
+	Title      string
+	Year       string
+	Popularity float64
+}
+
+type Company struct {
+	OriginCountry string
+	Media         []*Media
+}
+
+// loadTmdbMediaCSV loads the company details and media from the 002 media mapping
+func loadTmdbMediaCSV(path string) (map[string]*Company, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	// older files do not have company details
+	originCountryIdx := fileio.FindInSlice(headers, "origin_country")
+
+	var companies = make(map[string]*Company)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		companyID := record[0]
+		company, exists := companies[companyID]
+		if !exists {
+			company = &Company{}
+			if originCountryIdx != -1 {
+				company.OriginCountry = record[originCountryIdx]
+			}
+			companies[companyID] = company
+		}
+
+		if record[2] == "" {
+			continue
+		}
+
+		popularity, _ := strconv.ParseFloat(record[6], 64)
+		company.Media = append(company.Media, &Media{
+			Title:      record[4],
+			Year:       record[5],
+			Popularity: popularity,
+		})
+	}
+
+	return companies, nil
+}
+
+// loadAutoMatches loads the wikidata ids of PROBABLY and DECIDED matches from
+// the 004 result, leaving out pairs rejected by a reviewer
+func loadAutoMatches(path string, store *decisions.Store) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	labelIdx := fileio.FindInSlice(headers, "match")
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	wikidataIDIdx := fileio.FindInSlice(headers, "wikidata_id")
+	linkStatusIdx := fileio.FindInSlice(headers, "link_status")
+
+	if labelIdx == -1 || tmdbIDIdx == -1 || wikidataIDIdx == -1 {
+		return nil, fmt.Errorf("invalid CSV given: must have fields match, tmdb_id, wikidata_id")
+	}
+
+	var matches = make(map[string]string)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if record[labelIdx] != "PROBABLY" && record[labelIdx] != "DECIDED" {
+			continue
+		}
+		if store.IsRejected(record[tmdbIDIdx], record[wikidataIDIdx]) {
+			continue
+		}
+		if linkStatusIdx != -1 && record[linkStatusIdx] == "CONFLICT" {
+			continue
+		}
+		matches[record[tmdbIDIdx]] = record[wikidataIDIdx]
+	}
+
+	return matches, nil
+}
+
+func describe(company *Company) string {
+	if company == nil {
+		return ""
+	}
+
+	var parts []string
+	if company.OriginCountry != "" {
+		parts = append(parts, "country: "+company.OriginCountry)
+	}
+
+	medias := append([]*Media{}, company.Media...)
+	sort.SliceStable(medias, func(i int, j int) bool {
+		return medias[i].Popularity > medias[j].Popularity
+	})
+
+	var titles []string
+	for idx, media := range medias {
+		if idx >= TOP_TITLES {
+			break
+		}
+		title := media.Title
+		if media.Year != "" {
+			title += " (" + media.Year + ")"
+		}
+		titles = append(titles, title)
+	}
+	if len(titles) > 0 {
+		parts = append(parts, "titles: "+strings.Join(titles, ", "))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// cleanField removes characters that would break the tab separated format
+func cleanField(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Println("Usage: go run main.go <tmdb data> <tmdb media mapping> <result csv> <output tsv> [decisions csv]")
+		os.Exit(1)
+	}
+
+	tmdbDataPath := os.Args[1]
+	tmdbMediaCSVPath := os.Args[2]
+	resultCSVPath := os.Args[3]
+	outputPath := os.Args[4]
+	var decisionsPath string
+	if len(os.Args) > 5 {
+		decisionsPath = os.Args[5]
+	}
+
+	store, err := decisions.Load(decisionsPath)
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	companies, err := loadTmdbMediaCSV(tmdbMediaCSVPath)
+	if err != nil {
+		log.Fatalf("error while loading tmdb media mapping csv: %s", err)
+	}
+
+	autoMatches, err := loadAutoMatches(resultCSVPath, store)
+	if err != nil {
+		log.Fatalf("error while loading result csv: %s", err)
+	}
+
+	var tmdbData fileio.JSONLines
+	err = tmdbData.Load(tmdbDataPath)
+	if err != nil {
+		log.Fatalf("error while loading tmdb data: %s", err)
+	}
+	defer tmdbData.Close()
+
+	f, err := os.Create(outputPath + ".tmp")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, strings.Join([]string{"id", "name", "desc", "url", "type", "q"}, "\t"))
+
+	count := 0
+	matched := 0
+	for {
+		var item TMDBItem
+		if err := tmdbData.Next(&item); err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Fatalf("error while reading tmdb data: %s", err)
+		}
+
+		tmdbID := strconv.FormatInt(item.ID, 10)
+		qid := autoMatches[tmdbID]
+		if accepted := store.Accepted(tmdbID); accepted != nil {
+			qid = accepted.QID
+		}
+		if qid != "" {
+			matched += 1
+		}
+
+		fmt.Fprintln(w, strings.Join([]string{
+			tmdbID,
+			cleanField(item.Name),
+			cleanField(describe(companies[tmdbID])),
+			"https://www.themoviedb.org/company/" + tmdbID,
+			ENTRY_TYPE,
+			qid,
+		}, "\t"))
+		count += 1
+	}
+
+	err = w.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.Rename(outputPath+".tmp", outputPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Exported %d companies (%d auto-matched)\n", count, matched)
+}
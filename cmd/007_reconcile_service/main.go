@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+const DEFAULT_LIMIT = 5
+const MAX_LIMIT = 25
+
+// Scores are reported 0-100, a candidate is a match above this score
+// when it is also clearly ahead of the next candidate
+const MATCH_SCORE = 85
+const MATCH_MARGIN = 10
+
+const TMDB_COMPANY_ID_PROPERTY = "P11806"
+
+// A JSONP callback is written into the response as script, so only a plain
+// function name is accepted
+var JSONP_CALLBACK = regexp.MustCompile(`^[A-Za-z0-9_.$]+$`)
+
+type WikidataCompany struct {
+	ID             string
+	Name           string
+	NormalizedName string
+	Logo           string
+	Media          *Media
+}
+
+type TMDBCompany struct {
+	ID    string
+	Name  string
+	Media *Media
+}
+
+type Media struct {
+	matching.MediaSet
+	Titles []string
+	// TMDB company IDs (P11806) already on the wikidata company
+	LinkedTmdbIDs []string
+}
+
+type Service struct {
+	BaseURL           string
+	WikidataCompanies []*WikidataCompany
+	WikidataByID      map[string]*WikidataCompany
+	TmdbCompanies     map[string]*TMDBCompany
+}
+
+type Query struct {
+	Query      string `json:"query"`
+	Type       string `json:"type"`
+	Limit      int    `json:"limit"`
+	Properties []struct {
+		PID   string      `json:"pid"`
+		Value interface{} `json:"v"`
+	} `json:"properties"`
+}
+
+type Candidate struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	Score float64   `json:"score"`
+	Match bool      `json:"match"`
+	Type  []TypeRef `json:"type"`
+	// not part of the api, used to break ties
+	nameScore float64
+}
+
+type TypeRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+var DEFAULT_TYPE = TypeRef{ID: "Q1762059", Name: "film production company"}
+
+func loadWikidataCompanies(path string) ([]*WikidataCompany, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	csvReader.FieldsPerRecord = -1
+
+	var seenIDs = make(map[string]bool)
+	var companies []*WikidataCompany
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		company := &WikidataCompany{
+			ID:   filepath.Base(record[0]),
+			Name: record[1],
+		}
+		if company.ID == "" || company.ID[0] != 'Q' || seenIDs[company.ID] {
+			continue
+		}
+		if len(record) > 2 {
+			company.Logo = record[2]
+		}
+		company.NormalizedName = matching.NormalizeName(company.Name)
+		seenIDs[company.ID] = true
+		companies = append(companies, company)
+	}
+
+	return companies, nil
+}
+
+// loadMediaMappingCSV loads a 002 or 003 media mapping, returning the company
+// names and media keyed by company id
+func loadMediaMappingCSV(path string) (map[string]string, map[string]*Media, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	linkedIdx := fileio.FindInSlice(headers, "tmdb_company_ids")
+	qidIdx := fileio.FindInSlice(headers, "qid")
+	propertyIdx := fileio.FindInSlice(headers, "property")
+
+	var names = make(map[string]string)
+	var results = make(map[string]*Media)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cID := record[0]
+		names[cID] = record[1]
+
+		media, exists := results[cID]
+		if !exists {
+			media = &Media{}
+			if linkedIdx != -1 && record[linkedIdx] != "" {
+				media.LinkedTmdbIDs = strings.Split(record[linkedIdx], ";")
+			}
+			results[cID] = media
+		}
+
+		if record[2] == "" {
+			continue
+		}
+		// distributors and broadcasters from the dump mode are not compared
+		if propertyIdx != -1 && !matching.IsProduction(record[propertyIdx]) {
+			continue
+		}
+
+		tmdbID, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if record[3] != "movie" && record[3] != "tv" {
+			continue
+		}
+		work := ""
+		if qidIdx != -1 {
+			work = record[qidIdx]
+		}
+		if media.Add(record[3], tmdbID, work) && record[4] != "" {
+			media.Titles = append(media.Titles, record[4])
+		}
+	}
+
+	return names, results, nil
+}
+
+// tmdbIDFromQuery finds a TMDB company id given as a property or as the query itself
+func tmdbIDFromQuery(query *Query) string {
+	for _, prop := range query.Properties {
+		if prop.PID != TMDB_COMPANY_ID_PROPERTY && prop.PID != "tmdb_id" {
+			continue
+		}
+		switch v := prop.Value.(type) {
+		case string:
+			return strings.TrimSpace(v)
+		case float64:
+			return strconv.FormatInt(int64(v), 10)
+		case []interface{}:
+			if len(v) > 0 {
+				if s, ok := v[0].(string); ok {
+					return strings.TrimSpace(s)
+				}
+			}
+		}
+	}
+	q := strings.TrimSpace(query.Query)
+	if _, err := strconv.ParseInt(q, 10, 64); err == nil {
+		return q
+	}
+	return ""
+}
+
+func (s *Service) Reconcile(query *Query) []*Candidate {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DEFAULT_LIMIT
+	}
+	if limit > MAX_LIMIT {
+		limit = MAX_LIMIT
+	}
+
+	name := query.Query
+	tmdb := s.TmdbCompanies[tmdbIDFromQuery(query)]
+	if tmdb != nil && (name == "" || name == tmdb.ID) {
+		name = tmdb.Name
+	}
+	normalizedName := matching.NormalizeName(name)
+
+	var candidates []*Candidate
+	for _, company := range s.WikidataCompanies {
+		nameScore := matching.CompareNames(normalizedName, company.NormalizedName)
+
+		score := nameScore
+		if tmdb != nil {
+			if company.Media != nil && fileio.FindInSlice(company.Media.LinkedTmdbIDs, tmdb.ID) != -1 {
+				score = 1 // already linked on wikidata
+			} else if company.Media != nil && tmdb.Media != nil {
+				mappingScore, _ := matching.OverlapCoeff(&tmdb.Media.MediaSet, &company.Media.MediaSet)
+				// media in common outweighs a weak name match
+				score = (nameScore + mappingScore) / 2
+				if mappingScore > 0 && nameScore < 0.5 {
+					score = mappingScore / 2
+				}
+			} else {
+				score = nameScore / 2
+			}
+		}
+
+		if score < 0.25 {
+			continue
+		}
+
+		candidates = append(candidates, &Candidate{
+			ID:        company.ID,
+			Name:      company.Name,
+			Score:     score * 100,
+			Type:      []TypeRef{DEFAULT_TYPE},
+			nameScore: nameScore,
+		})
+	}
+
+	sort.Slice(candidates, func(i int, j int) bool {
+		c1 := candidates[i]
+		c2 := candidates[j]
+		if c1.Score != c2.Score {
+			return c1.Score > c2.Score
+		}
+		return c1.nameScore > c2.nameScore
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	if len(candidates) > 0 && candidates[0].Score >= MATCH_SCORE {
+		candidates[0].Match = len(candidates) == 1 || candidates[0].Score-candidates[1].Score >= MATCH_MARGIN
+	}
+
+	return candidates
+}
+
+func (s *Service) Manifest() map[string]interface{} {
+	return map[string]interface{}{
+		"versions":        []string{"0.1", "0.2"},
+		"name":            "TMDB / Wikidata company matching",
+		"identifierSpace": "http://www.wikidata.org/entity/",
+		"schemaSpace":     "http://www.wikidata.org/prop/direct/",
+		"defaultTypes":    []TypeRef{DEFAULT_TYPE},
+		"view": map[string]string{
+			"url": "https://www.wikidata.org/wiki/{{id}}",
+		},
+		"preview": map[string]interface{}{
+			"url":    s.BaseURL + "/preview?id={{id}}",
+			"width":  400,
+			"height": 100,
+		},
+		"suggest": map[string]interface{}{
+			"property": map[string]string{
+				"service_url":  s.BaseURL,
+				"service_path": "/suggest/property",
+			},
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	// JSONP is still used by older OpenRefine versions
+	callback := r.FormValue("callback")
+	if callback != "" && !JSONP_CALLBACK.MatchString(callback) {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if callback != "" {
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprintf(w, "%s(%s)", callback, data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Service) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	queriesJSON := r.FormValue("queries")
+	if queriesJSON == "" {
+		if single := r.FormValue("query"); single != "" {
+			var query Query
+			if err := json.Unmarshal([]byte(single), &query); err != nil {
+				query = Query{Query: single}
+			}
+			writeJSON(w, r, map[string][]*Candidate{"result": s.Reconcile(&query)})
+			return
+		}
+		writeJSON(w, r, s.Manifest())
+		return
+	}
+
+	var queries map[string]*Query
+	if err := json.Unmarshal([]byte(queriesJSON), &queries); err != nil {
+		http.Error(w, "invalid queries: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var results = make(map[string]map[string][]*Candidate)
+	for key, query := range queries {
+		results[key] = map[string][]*Candidate{"result": s.Reconcile(query)}
+	}
+	writeJSON(w, r, results)
+}
+
+func (s *Service) handleSuggestProperty(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, r, map[string]interface{}{
+		"result": []map[string]string{
+			{"id": TMDB_COMPANY_ID_PROPERTY, "name": "TMDB company ID"},
+		},
+	})
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<html><body style="margin:0;font-family:sans-serif;font-size:12px">
+{{if .Logo}}<img src="{{.Logo}}" style="float:right;max-width:100px;max-height:90px">{{end}}
+<a href="https://www.wikidata.org/wiki/{{.ID}}" target="_blank"><b>{{.Name}}</b></a> ({{.ID}})<br>
+{{with .Media}}{{.Count}} works with TMDB ids{{if .LinkedTmdbIDs}}, TMDB company {{range .LinkedTmdbIDs}}{{.}} {{end}}{{end}}<br>
+{{range $idx, $title := .Titles}}{{if lt $idx 5}}{{$title}}; {{end}}{{end}}{{end}}
+</body></html>`))
+
+func (s *Service) handlePreview(w http.ResponseWriter, r *http.Request) {
+	company := s.WikidataByID[r.FormValue("id")]
+	if company == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := previewTemplate.Execute(w, company)
+	if err != nil {
+		log.Printf("error while rendering preview: %s", err)
+	}
+}
+
+func main() {
+	var listen string
+	var baseURL string
+	flag.StringVar(&listen, "listen", "localhost:8000", "address to listen on")
+	flag.StringVar(&baseURL, "base-url", "", "public url of the service (default http://<listen>)")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <wikidata data> <tmdb media mapping> <wikidata media mapping>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if baseURL == "" {
+		baseURL = "http://" + listen
+	}
+
+	wikidataCompanies, err := loadWikidataCompanies(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("error while loading wikidata: %s", err)
+	}
+
+	tmdbNames, tmdbMediaSet, err := loadMediaMappingCSV(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("error while loading tmdb media set csv: %s", err)
+	}
+
+	_, wikidataMediaSet, err := loadMediaMappingCSV(flag.Arg(2))
+	if err != nil {
+		log.Fatalf("error while loading wikidata media set csv: %s", err)
+	}
+
+	service := &Service{
+		BaseURL:           strings.TrimRight(baseURL, "/"),
+		WikidataCompanies: wikidataCompanies,
+		WikidataByID:      make(map[string]*WikidataCompany),
+		TmdbCompanies:     make(map[string]*TMDBCompany),
+	}
+	for _, company := range wikidataCompanies {
+		company.Media = wikidataMediaSet[company.ID]
+		service.WikidataByID[company.ID] = company
+	}
+	for tmdbID, name := range tmdbNames {
+		service.TmdbCompanies[tmdbID] = &TMDBCompany{
+			ID:    tmdbID,
+			Name:  name,
+			Media: tmdbMediaSet[tmdbID],
+		}
+	}
+
+	http.HandleFunc("/reconcile", service.handleReconcile)
+	http.HandleFunc("/suggest/property", service.handleSuggestProperty)
+	http.HandleFunc("/preview", service.handlePreview)
+
+	fmt.Printf("Reconciliation service at %s/reconcile (%d wikidata companies, %d tmdb companies)\n",
+		service.BaseURL, len(wikidataCompanies), len(service.TmdbCompanies))
+	log.Fatal(http.ListenAndServe(listen, nil))
+}
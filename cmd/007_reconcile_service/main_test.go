@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWriteJSONCallback(t *testing.T) {
+	cases := []struct {
+		callback string
+		status   int
+		body     string
+	}{
+		{"", http.StatusOK, `{"ok":true}`},
+		{"jQuery123_456.cb$", http.StatusOK, `jQuery123_456.cb$({"ok":true})`},
+		{"alert(1)//", http.StatusBadRequest, "invalid callback\n"},
+		{"<script>", http.StatusBadRequest, "invalid callback\n"},
+		{"cb\n", http.StatusBadRequest, "invalid callback\n"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/reconcile?callback="+url.QueryEscape(c.callback), nil)
+		w := httptest.NewRecorder()
+		writeJSON(w, r, map[string]bool{"ok": true})
+		if w.Code != c.status || w.Body.String() != c.body {
+			t.Errorf("callback %q: got %d %q, expected %d %q", c.callback, w.Code, w.Body.String(), c.status, c.body)
+		}
+	}
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/classifier"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
+)
+
+const TMDB_IMAGE_URL = "https://image.tmdb.org/t/p/w154"
+const COMMONS_IMAGE_WIDTH = "154"
+const MAX_MEDIA_SHOWN = 24
+
+type Match struct {
+	Label               string
+	TmdbID              string
+	TmdbCompanyName     string
+	WikidataID          string
+	WikidataCompanyName string
+	TotalScore          string
+	NameScore           string
+	MappingScore        string
+	TmdbMapCount        string
+	WikidataMapCount    string
+	MapMatchCount       string
+	LinkStatus          string
+}
+
+type Media struct {
+	ID         string
+	MediaType  string
+	TmdbID     string
+	Title      string
+	Year       string
+	Poster     string
+	Popularity float64
+}
+
+func (m *Media) Key() string {
+	return m.MediaType + ":" + m.TmdbID
+}
+
+type Company struct {
+	ID    string
+	Name  string
+	Logo  string
+	Media []*Media
+}
+
+type Review struct {
+	Matches           []*Match
+	TmdbCompanies     map[string]*Company
+	WikidataCompanies map[string]*Company
+	Reviewer          string
+
+	decisions *decisions.Store
+	// nil unless reviewing in queue mode
+	queue *Queue
+	lock  sync.Mutex
+}
+
+func loadMatchesCSV(path string) ([]*Match, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*Match
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		matches = append(matches, newMatch(func(name string) string {
+			idx := fileio.FindInSlice(headers, name)
+			if idx == -1 {
+				return ""
+			}
+			return record[idx]
+		}))
+	}
+
+	return matches, nil
+}
+
+// loadMatchesStore loads the scores 004 wrote to the pipeline store
+func loadMatchesStore(path string) ([]*Match, error) {
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	_, scores, err := db.Scores()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Match
+	for _, score := range scores {
+		matches = append(matches, newMatch(func(name string) string {
+			return score.Values[name]
+		}))
+	}
+	return matches, nil
+}
+
+// loadMatches loads a 004 result from a .db store or a result csv
+func loadMatches(path string) ([]*Match, error) {
+	if store.IsStorePath(path) {
+		return loadMatchesStore(path)
+	}
+	return loadMatchesCSV(path)
+}
+
+func newMatch(column func(name string) string) *Match {
+	return &Match{
+		Label:               column("match"),
+		TmdbID:              column("tmdb_id"),
+		TmdbCompanyName:     column("tmdb_company_name"),
+		WikidataID:          column("wikidata_id"),
+		WikidataCompanyName: column("wikidata_company_name"),
+		TotalScore:          column("total_score"),
+		NameScore:           column("name_match_subscore"),
+		MappingScore:        column("common_media_subscore"),
+		TmdbMapCount:        column("tmdb_media_count"),
+		WikidataMapCount:    column("wikidata_media_count"),
+		MapMatchCount:       column("common_media_count"),
+		LinkStatus:          column("link_status"),
+	}
+}
+
+// loadMediaMappingCSV loads the companies in companyIDs from a 002 or 003 media mapping
+func loadMediaMappingCSV(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	// only in the tmdb media mapping
+	logoPathIdx := fileio.FindInSlice(headers, "logo_path")
+	// only in the wikidata media mapping, from version 2
+	qidIdx := fileio.FindInSlice(headers, "qid")
+
+	var companies = make(map[string]*Company)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		companyID := record[0]
+		if !companyIDs[companyID] {
+			continue
+		}
+		company, exists := companies[companyID]
+		if !exists {
+			company = &Company{
+				ID:   companyID,
+				Name: record[1],
+			}
+			if logoPathIdx != -1 && record[logoPathIdx] != "" {
+				company.Logo = TMDB_IMAGE_URL + record[logoPathIdx]
+			}
+			companies[companyID] = company
+		}
+
+		if record[2] == "" {
+			continue
+		}
+
+		// popularity is only in the tmdb media mapping, sitelinks are in the same column
+		popularity := 0.0
+		if headers[6] == "popularity" {
+			popularity, _ = strconv.ParseFloat(record[6], 64)
+		}
+
+		media := &Media{
+			TmdbID:     record[2],
+			MediaType:  record[3],
+			Title:      record[4],
+			Year:       record[5],
+			Poster:     record[7],
+			Popularity: popularity,
+		}
+		if qidIdx != -1 {
+			media.ID = record[qidIdx]
+		}
+		company.Media = append(company.Media, media)
+	}
+
+	return companies, nil
+}
+
+// loadMediaMappingStore loads the companies of source in companyIDs from a pipeline store
+func loadMediaMappingStore(path string, source string, companyIDs map[string]bool) (map[string]*Company, error) {
+	// opening creates the store, which would read as an empty mapping
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var companies = make(map[string]*Company)
+	for companyID := range companyIDs {
+		stored, err := db.Company(source, companyID)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			continue
+		}
+		company := &Company{
+			ID:   stored.ID,
+			Name: stored.Name,
+		}
+		if logoPath := stored.Details["logo_path"]; logoPath != "" {
+			company.Logo = TMDB_IMAGE_URL + logoPath
+		}
+		for _, stored := range stored.Media {
+			popularity, _ := strconv.ParseFloat(stored.Popularity, 64)
+			company.Media = append(company.Media, &Media{
+				ID:         stored.QID,
+				TmdbID:     stored.ID,
+				MediaType:  stored.Type,
+				Title:      stored.Title,
+				Year:       stored.Year,
+				Poster:     stored.Poster,
+				Popularity: popularity,
+			})
+		}
+		companies[company.ID] = company
+	}
+	return companies, nil
+}
+
+// loadMediaMapping loads the companies in companyIDs from a .db store or a csv
+func loadMediaMapping(path string, source string, companyIDs map[string]bool) (map[string]*Company, error) {
+	if store.IsStorePath(path) {
+		return loadMediaMappingStore(path, source, companyIDs)
+	}
+	return loadMediaMappingCSV(path, companyIDs)
+}
+
+// reviewCompanyIDs returns the companies of the matches under review and of
+// the decisions the queue trains on, so only those are loaded from the mappings
+func reviewCompanyIDs(matches []*Match, decisionList []*decisions.Decision) (map[string]bool, map[string]bool) {
+	var tmdbIDs = make(map[string]bool)
+	var qids = make(map[string]bool)
+	for _, match := range matches {
+		tmdbIDs[match.TmdbID] = true
+		qids[match.WikidataID] = true
+	}
+	for _, decision := range decisionList {
+		tmdbIDs[decision.TmdbID] = true
+		qids[decision.QID] = true
+	}
+	return tmdbIDs, qids
+}
+
+// loadWikidataLogos loads the company logos (P154) from the wikidata data used by 001
+func loadWikidataLogos(path string, companies map[string]*Company) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	csvReader.FieldsPerRecord = -1
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 || record[2] == "" {
+			continue
+		}
+		if company := companies[filepath.Base(record[0])]; company != nil {
+			company.Logo = commonsThumbnail(record[2])
+		}
+	}
+	return nil
+}
+
+func commonsThumbnail(fileURL string) string {
+	if fileURL == "" {
+		return ""
+	}
+	return fileURL + "?width=" + COMMONS_IMAGE_WIDTH
+}
+
+func tmdbPoster(posterPath string) string {
+	if posterPath == "" {
+		return ""
+	}
+	return TMDB_IMAGE_URL + posterPath
+}
+
+// nextUndecided finds the first match from idx that has no decision
+func (rv *Review) nextUndecided(idx int) int {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	if rv.queue != nil {
+		return rv.queue.Next(rv)
+	}
+	for ; idx < len(rv.Matches); idx++ {
+		match := rv.Matches[idx]
+		if rv.decisions.Get(match.TmdbID, match.WikidataID) == nil {
+			return idx
+		}
+	}
+	return -1
+}
+
+type MediaView struct {
+	Title  string
+	Year   string
+	Poster string
+	Link   string
+}
+
+type PairView struct {
+	Index         int
+	Total         int
+	Remaining     int
+	Match         *Match
+	TmdbLogo      string
+	WikidataLogo  string
+	CommonMedia   []*MediaView
+	TmdbOnly      []*MediaView
+	WikidataOnly  []*MediaView
+	TmdbOnlyCount int
+	WikidataCount int
+}
+
+func limitMedia(medias []*MediaView) []*MediaView {
+	if len(medias) > MAX_MEDIA_SHOWN {
+		return medias[:MAX_MEDIA_SHOWN]
+	}
+	return medias
+}
+
+func (rv *Review) pairView(idx int) *PairView {
+	match := rv.Matches[idx]
+	view := &PairView{
+		Index: idx,
+		Total: len(rv.Matches),
+		Match: match,
+	}
+
+	var wikidataKeys = make(map[string]bool)
+	if company := rv.WikidataCompanies[match.WikidataID]; company != nil {
+		view.WikidataLogo = company.Logo
+		for _, media := range company.Media {
+			wikidataKeys[media.Key()] = true
+		}
+	}
+
+	var tmdbKeys = make(map[string]bool)
+	if company := rv.TmdbCompanies[match.TmdbID]; company != nil {
+		view.TmdbLogo = company.Logo
+		for _, media := range company.Media {
+			tmdbKeys[media.Key()] = true
+			mediaView := &MediaView{
+				Title:  media.Title,
+				Year:   media.Year,
+				Poster: tmdbPoster(media.Poster),
+				Link:   "https://www.themoviedb.org/" + media.MediaType + "/" + media.TmdbID,
+			}
+			if wikidataKeys[media.Key()] {
+				view.CommonMedia = append(view.CommonMedia, mediaView)
+			} else {
+				view.TmdbOnly = append(view.TmdbOnly, mediaView)
+			}
+		}
+	}
+
+	if company := rv.WikidataCompanies[match.WikidataID]; company != nil {
+		// a work with several TMDB ids is common if any of them is, and shown once
+		var shownWorks = make(map[string]bool)
+		for _, media := range company.Media {
+			if tmdbKeys[media.Key()] && media.ID != "" {
+				shownWorks[media.ID] = true
+			}
+		}
+		for _, media := range company.Media {
+			if tmdbKeys[media.Key()] || (media.ID != "" && shownWorks[media.ID]) {
+				continue
+			}
+			if media.ID != "" {
+				shownWorks[media.ID] = true
+			}
+			mediaView := &MediaView{
+				Title:  media.Title,
+				Year:   media.Year,
+				Poster: commonsThumbnail(media.Poster),
+				Link:   "https://www.themoviedb.org/" + media.MediaType + "/" + media.TmdbID,
+			}
+			if media.ID != "" {
+				mediaView.Link = "https://www.wikidata.org/wiki/" + media.ID
+			}
+			view.WikidataOnly = append(view.WikidataOnly, mediaView)
+		}
+	}
+
+	view.TmdbOnlyCount = len(view.TmdbOnly)
+	view.WikidataCount = len(view.WikidataOnly)
+	view.CommonMedia = limitMedia(view.CommonMedia)
+	view.TmdbOnly = limitMedia(view.TmdbOnly)
+	view.WikidataOnly = limitMedia(view.WikidataOnly)
+
+	rv.lock.Lock()
+	for _, m := range rv.Matches {
+		if rv.decisions.Get(m.TmdbID, m.WikidataID) == nil {
+			view.Remaining += 1
+		}
+	}
+	rv.lock.Unlock()
+
+	return view
+}
+
+var pageTemplate = template.Must(template.New("pair").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Match.TmdbCompanyName}} - review</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+.companies { display: flex; gap: 2em; }
+.company { flex: 1; border: 1px solid #ccc; padding: 0.5em 1em; }
+.company img.logo { max-height: 80px; max-width: 200px; }
+.media { display: flex; flex-wrap: wrap; gap: 6px; }
+.media a { width: 92px; font-size: 11px; text-decoration: none; color: #333; }
+.media img { width: 92px; height: 138px; object-fit: cover; background: #eee; }
+.label { font-weight: bold; }
+button { font-size: 1.2em; margin-right: 1em; }
+</style></head>
+<body>
+<p>{{.Index}} / {{.Total}} ({{.Remaining}} undecided) - <span class="label">{{.Match.Label}}</span> {{.Match.LinkStatus}}</p>
+<div class="companies">
+<div class="company">
+<h2><a href="https://www.themoviedb.org/company/{{.Match.TmdbID}}" target="_blank">{{.Match.TmdbCompanyName}}</a> ({{.Match.TmdbID}})</h2>
+{{if .TmdbLogo}}<img class="logo" src="{{.TmdbLogo}}">{{end}}
+<p>media: {{.Match.TmdbMapCount}}</p>
+</div>
+<div class="company">
+<h2><a href="https://www.wikidata.org/wiki/{{.Match.WikidataID}}" target="_blank">{{.Match.WikidataCompanyName}}</a> ({{.Match.WikidataID}})</h2>
+{{if .WikidataLogo}}<img class="logo" src="{{.WikidataLogo}}">{{end}}
+<p>media: {{.Match.WikidataMapCount}}</p>
+</div>
+</div>
+<p>total: {{.Match.TotalScore}} name: {{.Match.NameScore}} common media: {{.Match.MappingScore}} ({{.Match.MapMatchCount}} in common)</p>
+<form method="post" action="decide">
+<input type="hidden" name="idx" value="{{.Index}}">
+<input type="text" name="note" id="note" placeholder="note" size="40">
+<button name="verdict" value="accept">(a)ccept</button>
+<button name="verdict" value="reject">(r)eject</button>
+<button name="verdict" value="skip">(s)kip</button>
+</form>
+<h3>Common media</h3>
+<div class="media">{{range .CommonMedia}}<a href="{{.Link}}" target="_blank"><img src="{{.Poster}}" loading="lazy"><br>{{.Title}} {{.Year}}</a>{{end}}</div>
+<h3>Only on TMDB ({{.TmdbOnlyCount}})</h3>
+<div class="media">{{range .TmdbOnly}}<a href="{{.Link}}" target="_blank"><img src="{{.Poster}}" loading="lazy"><br>{{.Title}} {{.Year}}</a>{{end}}</div>
+<h3>Only on Wikidata ({{.WikidataCount}})</h3>
+<div class="media">{{range .WikidataOnly}}<a href="{{.Link}}" target="_blank"><img src="{{.Poster}}" loading="lazy"><br>{{.Title}} {{.Year}}</a>{{end}}</div>
+<script>
+const verdicts = {a: "accept", r: "reject", s: "skip"};
+document.addEventListener("keydown", (e) => {
+	if (e.target.id === "note" || e.ctrlKey || e.metaKey || e.altKey) { return; }
+	const verdict = verdicts[e.key];
+	if (verdict) {
+		document.querySelector('button[value="' + verdict + '"]').click();
+	}
+});
+</script>
+</body></html>`))
+
+func (rv *Review) handleIndex(w http.ResponseWriter, r *http.Request) {
+	start, _ := strconv.Atoi(r.FormValue("from"))
+	idx := rv.nextUndecided(start)
+	if idx == -1 {
+		fmt.Fprintln(w, "All matches have been reviewed")
+		return
+	}
+	http.Redirect(w, r, "pair?idx="+strconv.Itoa(idx), http.StatusSeeOther)
+}
+
+func (rv *Review) handlePair(w http.ResponseWriter, r *http.Request) {
+	idx, err := strconv.Atoi(r.FormValue("idx"))
+	if err != nil || idx < 0 || idx >= len(rv.Matches) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = pageTemplate.Execute(w, rv.pairView(idx))
+	if err != nil {
+		log.Printf("error while rendering pair: %s", err)
+	}
+}
+
+func (rv *Review) handleDecide(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	idx, err := strconv.Atoi(r.FormValue("idx"))
+	if err != nil || idx < 0 || idx >= len(rv.Matches) {
+		http.NotFound(w, r)
+		return
+	}
+
+	verdict := r.FormValue("verdict")
+	if verdict == decisions.VERDICT_ACCEPT || verdict == decisions.VERDICT_REJECT {
+		match := rv.Matches[idx]
+		decision := &decisions.Decision{
+			TmdbID:    match.TmdbID,
+			QID:       match.WikidataID,
+			Verdict:   verdict,
+			Reviewer:  rv.Reviewer,
+			Timestamp: time.Now().UTC(),
+			Note:      r.FormValue("note"),
+		}
+
+		rv.lock.Lock()
+		err = rv.decisions.Append(decision)
+		if err == nil && rv.queue != nil {
+			rv.queue.Decided(rv)
+		}
+		rv.lock.Unlock()
+		if err != nil {
+			http.Error(w, "error while saving decision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if rv.queue != nil && verdict != decisions.VERDICT_ACCEPT && verdict != decisions.VERDICT_REJECT {
+		rv.lock.Lock()
+		rv.queue.skipped[idx] = true
+		rv.lock.Unlock()
+	}
+
+	http.Redirect(w, r, "./?from="+url.QueryEscape(strconv.Itoa(idx+1)), http.StatusSeeOther)
+}
+
+// runHTTP serves the review pages. In queue mode the undecided pairs are ordered
+// by model uncertainty and impact, and re-ranked after each batch of decisions.
+func runHTTP(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8001", "address to listen on")
+	reviewer := flags.String("reviewer", os.Getenv("USER"), "name recorded with each decision")
+	labels := flags.String("labels", "PROBABLY,MAYBE,UNLIKELY", "comma separated match labels to review")
+	wikidataDataPath := flags.String("wikidata-data", "", "wikidata companies csv used for logos (optional)")
+	var modelPath *string
+	var batchSize *int
+	if command == "queue" {
+		modelPath = flags.String("model", "", "initial classifier model json (optional, trained from decisions otherwise)")
+		batchSize = flags.Int("batch", 20, "decisions between re-ranking the queue")
+	}
+	flags.Usage = func() {
+		fmt.Printf("Usage: go run main.go %s [options] <result csv> <tmdb media mapping> <wikidata media mapping> <decisions csv>\n", command)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 4 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	matches, err := loadMatches(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("error while loading result csv: %s", err)
+	}
+
+	decisionStore, err := store.LoadDecisions(flags.Arg(3))
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	labelList := strings.Split(*labels, ",")
+	var selected []*Match
+	for _, match := range matches {
+		if fileio.FindInSlice(labelList, match.Label) != -1 {
+			selected = append(selected, match)
+		}
+	}
+	// keep the result order but show labels in the order given
+	sort.SliceStable(selected, func(i int, j int) bool {
+		return fileio.FindInSlice(labelList, selected[i].Label) < fileio.FindInSlice(labelList, selected[j].Label)
+	})
+
+	tmdbIDs, qids := reviewCompanyIDs(selected, decisionStore.All())
+	tmdbCompanies, err := loadMediaMapping(flags.Arg(1), store.SOURCE_TMDB, tmdbIDs)
+	if err != nil {
+		log.Fatalf("error while loading tmdb media set csv: %s", err)
+	}
+
+	wikidataCompanies, err := loadMediaMapping(flags.Arg(2), store.SOURCE_WIKIDATA, qids)
+	if err != nil {
+		log.Fatalf("error while loading wikidata media set csv: %s", err)
+	}
+
+	if *wikidataDataPath != "" {
+		err = loadWikidataLogos(*wikidataDataPath, wikidataCompanies)
+		if err != nil {
+			log.Fatalf("error while loading wikidata data: %s", err)
+		}
+	}
+
+	review := &Review{
+		Matches:           selected,
+		TmdbCompanies:     tmdbCompanies,
+		WikidataCompanies: wikidataCompanies,
+		Reviewer:          *reviewer,
+		decisions:         decisionStore,
+	}
+
+	if command == "queue" {
+		review.queue, err = newReviewQueue(review, *modelPath, *batchSize, flags.Arg(1), flags.Arg(2), tmdbIDs, qids)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	http.HandleFunc("/", review.handleIndex)
+	http.HandleFunc("/pair", review.handlePair)
+	http.HandleFunc("/decide", review.handleDecide)
+
+	fmt.Printf("Reviewing %d matches (%d decisions so far) at http://%s/\n", len(selected), decisionStore.Len(), *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+func newReviewQueue(review *Review, modelPath string, batchSize int, tmdbMediaCSVPath string, wikidataMediaCSVPath string, tmdbIDs map[string]bool, qids map[string]bool) (*Queue, error) {
+	tmdbCompanies, err := matching.LoadTmdbMediaMapping(tmdbMediaCSVPath, tmdbIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading tmdb media set csv: %w", err)
+	}
+
+	wikidataCompanies, err := matching.LoadWikidataMediaMapping(wikidataMediaCSVPath, qids)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading wikidata media set csv: %w", err)
+	}
+
+	queue := NewQueue(nil, batchSize, tmdbCompanies, wikidataCompanies)
+	if modelPath != "" {
+		queue.Model, err = classifier.LoadModel(modelPath)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading model: %w", err)
+		}
+	} else {
+		queue.Retrain(review.decisions)
+	}
+	queue.Rank(review)
+	return queue, nil
+}
+
+// runImport merges decisions csv files shared by other reviewers into the store
+func runImport(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: go run main.go import <decisions csv> <other decisions csv>...")
+		os.Exit(1)
+	}
+
+	decisionStore, err := store.LoadDecisions(args[0])
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	updated := 0
+	for _, path := range args[1:] {
+		others, err := decisions.ReadCSV(path)
+		if err != nil {
+			log.Fatalf("error while reading %s: %s", path, err)
+		}
+		updated += decisionStore.Merge(others)
+	}
+
+	err = decisionStore.Save()
+	if err != nil {
+		log.Fatalf("error while saving decisions: %s", err)
+	}
+	fmt.Printf("Imported %d decisions (%d total)\n", updated, decisionStore.Len())
+}
+
+// runExport writes the current decision for each pair, optionally only for one reviewer
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	reviewer := flags.String("reviewer", "", "only export decisions by this reviewer")
+	flags.Usage = func() {
+		fmt.Println("Usage: go run main.go export [options] <decisions csv> <output csv>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	decisionStore, err := store.LoadDecisions(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	var selected []*decisions.Decision
+	for _, decision := range decisionStore.All() {
+		if *reviewer == "" || decision.Reviewer == *reviewer {
+			selected = append(selected, decision)
+		}
+	}
+
+	err = decisions.WriteCSV(flags.Arg(1), selected)
+	if err != nil {
+		log.Fatalf("error while saving decisions: %s", err)
+	}
+	fmt.Printf("Exported %d decisions\n", len(selected))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run main.go <http|queue|import|export> [options] ...")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "http", "queue":
+		runHTTP(os.Args[1], os.Args[2:])
+	case "import":
+		runImport(os.Args[2:])
+	case "export":
+		runExport(os.Args[2:])
+	default:
+		fmt.Printf("Unknown command %s\n", os.Args[1])
+		os.Exit(1)
+	}
+}
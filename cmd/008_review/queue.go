@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/classifier"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+// Queue orders undecided matches so the pairs the model is least sure about,
+// and that matter most, are reviewed first
+type Queue struct {
+	Model     *classifier.Model
+	BatchSize int
+
+	tmdbCompanies     map[string]*matching.Company
+	wikidataCompanies map[string]*matching.Company
+	order             []int
+	priority          []float64
+	skipped           map[int]bool
+	sinceRanked       int
+	// a model is being trained in the background
+	training bool
+}
+
+func NewQueue(model *classifier.Model, batchSize int, tmdbCompanies map[string]*matching.Company, wikidataCompanies map[string]*matching.Company) *Queue {
+	return &Queue{
+		Model:             model,
+		BatchSize:         batchSize,
+		tmdbCompanies:     tmdbCompanies,
+		wikidataCompanies: wikidataCompanies,
+		skipped:           make(map[int]bool),
+	}
+}
+
+// probability of a match, falling back to the subscores when there is no model yet
+func (q *Queue) probability(match *Match) float64 {
+	tmdb := q.tmdbCompanies[match.TmdbID]
+	wikidata := q.wikidataCompanies[match.WikidataID]
+	if q.Model != nil && tmdb != nil && wikidata != nil {
+		return q.Model.Predict(classifier.Features(tmdb, wikidata))
+	}
+	nameScore, _ := strconv.ParseFloat(match.NameScore, 64)
+	mappingScore, _ := strconv.ParseFloat(match.MappingScore, 64)
+	return (nameScore + mappingScore) / 2
+}
+
+// impact favours companies with many and popular media
+func impact(match *Match, tmdb *Company) float64 {
+	tmdbCount, _ := strconv.Atoi(match.TmdbMapCount)
+	wikidataCount, _ := strconv.Atoi(match.WikidataMapCount)
+	popularity := 0.0
+	if tmdb != nil {
+		for _, media := range tmdb.Media {
+			popularity += media.Popularity
+		}
+	}
+	return 1 + math.Log1p(float64(tmdbCount+wikidataCount)) + math.Log1p(popularity)/2
+}
+
+// Rank orders the undecided matches by uncertainty times impact. Skipped
+// matches are offered again
+func (q *Queue) Rank(rv *Review) {
+	q.skipped = make(map[int]bool)
+	q.priority = make([]float64, len(rv.Matches))
+	q.order = q.order[:0]
+	for idx, match := range rv.Matches {
+		if rv.decisions.Get(match.TmdbID, match.WikidataID) != nil {
+			continue
+		}
+		p := q.probability(match)
+		uncertainty := 1 - math.Abs(2*p-1)
+		q.priority[idx] = uncertainty * impact(match, rv.TmdbCompanies[match.TmdbID])
+		q.order = append(q.order, idx)
+	}
+	sort.SliceStable(q.order, func(i int, j int) bool {
+		return q.priority[q.order[i]] > q.priority[q.order[j]]
+	})
+	q.sinceRanked = 0
+}
+
+// train fits a model on the decisions, or returns nil if training fails.
+// It only reads the mappings, so it runs without holding the review lock
+func (q *Queue) train(decisionList []*decisions.Decision) *classifier.Model {
+	var examples []*classifier.Example
+	for _, decision := range decisionList {
+		tmdb := q.tmdbCompanies[decision.TmdbID]
+		wikidata := q.wikidataCompanies[decision.QID]
+		if tmdb == nil || wikidata == nil {
+			continue
+		}
+		examples = append(examples, &classifier.Example{
+			TmdbID:   decision.TmdbID,
+			QID:      decision.QID,
+			Features: classifier.Features(tmdb, wikidata),
+			Label:    decision.Verdict == decisions.VERDICT_ACCEPT,
+		})
+	}
+
+	model, err := classifier.Train(examples, classifier.DEFAULT_TRAIN_OPTIONS)
+	if err != nil {
+		log.Printf("keeping previous model: %s", err)
+		return nil
+	}
+	return model
+}
+
+// Retrain fits a new model on all decisions, keeping the old model if training fails
+func (q *Queue) Retrain(store *decisions.Store) {
+	if model := q.train(store.All()); model != nil {
+		q.Model = model
+	}
+}
+
+// Decided is called with the review lock held after each decision. Once a
+// batch is complete a model is trained on a snapshot of the decisions in the
+// background, then swapped in and the queue re-ranked under the lock
+func (q *Queue) Decided(rv *Review) {
+	q.sinceRanked += 1
+	if q.sinceRanked < q.BatchSize || q.training {
+		return
+	}
+	q.training = true
+	snapshot := rv.decisions.All()
+	go func() {
+		model := q.train(snapshot)
+		rv.lock.Lock()
+		defer rv.lock.Unlock()
+		if model != nil {
+			q.Model = model
+		}
+		q.training = false
+		q.Rank(rv)
+	}()
+}
+
+// Next returns the highest priority undecided match that was not skipped
+func (q *Queue) Next(rv *Review) int {
+	for _, idx := range q.order {
+		match := rv.Matches[idx]
+		if q.skipped[idx] || rv.decisions.Get(match.TmdbID, match.WikidataID) != nil {
+			continue
+		}
+		return idx
+	}
+	return -1
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/classifier"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+// loadExamples builds a labelled example for each reviewed pair found in the
+// media mappings. Only the companies of the reviewed pairs are loaded
+func loadExamples(tmdbMediaCSVPath string, wikidataMediaCSVPath string, decisionsPath string) ([]*classifier.Example, error) {
+	store, err := decisions.Load(decisionsPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading decisions: %w", err)
+	}
+
+	var tmdbIDs = make(map[string]bool)
+	var qids = make(map[string]bool)
+	for _, decision := range store.All() {
+		tmdbIDs[decision.TmdbID] = true
+		qids[decision.QID] = true
+	}
+
+	tmdbCompanies, err := matching.LoadTmdbMediaMapping(tmdbMediaCSVPath, tmdbIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading tmdb media set csv: %w", err)
+	}
+
+	wikidataCompanies, err := matching.LoadWikidataMediaMapping(wikidataMediaCSVPath, qids)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading wikidata media set csv: %w", err)
+	}
+
+	var examples []*classifier.Example
+	missing := 0
+	for _, decision := range store.All() {
+		tmdb := tmdbCompanies[decision.TmdbID]
+		wikidata := wikidataCompanies[decision.QID]
+		if tmdb == nil || wikidata == nil {
+			missing += 1
+			continue
+		}
+		examples = append(examples, &classifier.Example{
+			TmdbID:   decision.TmdbID,
+			QID:      decision.QID,
+			Features: classifier.Features(tmdb, wikidata),
+			Label:    decision.Verdict == decisions.VERDICT_ACCEPT,
+		})
+	}
+
+	if missing > 0 {
+		log.Printf("%d reviewed pairs are missing from the media mappings and were skipped", missing)
+	}
+
+	return examples, nil
+}
+
+func printThresholdMetrics(metrics []*classifier.ThresholdMetrics) {
+	fmt.Println("threshold  precision  recall  f1      tp    fp    fn    tn")
+	for _, m := range metrics {
+		fmt.Printf("%0.2f       %0.4f     %0.4f  %0.4f  %-5d %-5d %-5d %-5d\n",
+			m.Threshold, m.Precision, m.Recall, m.F1, m.TP, m.FP, m.FN, m.TN)
+	}
+}
+
+func runTrain(args []string) {
+	options := classifier.DEFAULT_TRAIN_OPTIONS
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	folds := flags.Int("folds", 5, "number of cross validation folds (0 to skip)")
+	seed := flags.Int64("seed", 1, "seed for cross validation folds")
+	flags.IntVar(&options.Epochs, "epochs", options.Epochs, "training epochs")
+	flags.Float64Var(&options.LearningRate, "learning-rate", options.LearningRate, "gradient descent learning rate")
+	flags.Float64Var(&options.L2, "l2", options.L2, "l2 regularization")
+	flags.Usage = func() {
+		fmt.Println("Usage: go run main.go train [options] <tmdb media mapping> <wikidata media mapping> <decisions csv> <output model json>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 4 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	examples, err := loadExamples(flags.Arg(0), flags.Arg(1), flags.Arg(2))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Training on %d reviewed pairs\n", len(examples))
+
+	if *folds > 0 {
+		predictions, err := classifier.CrossValidate(examples, *folds, options, *seed)
+		if err != nil {
+			log.Fatalf("error while cross validating: %s", err)
+		}
+		fmt.Printf("%d-fold cross validation:\n", *folds)
+		printThresholdMetrics(classifier.EvaluateThresholds(predictions, examples, classifier.DEFAULT_THRESHOLDS))
+	}
+
+	model, err := classifier.Train(examples, options)
+	if err != nil {
+		log.Fatalf("error while training: %s", err)
+	}
+
+	fmt.Println("weights:")
+	for idx, name := range model.FeatureNames {
+		fmt.Printf("  %-20s %+0.4f\n", name, model.Weights[idx])
+	}
+
+	err = model.Save(flags.Arg(3))
+	if err != nil {
+		log.Fatalf("error while saving model: %s", err)
+	}
+}
+
+func runEvaluate(args []string) {
+	if len(args) < 4 {
+		fmt.Println("Usage: go run main.go evaluate <model json> <tmdb media mapping> <wikidata media mapping> <decisions csv>")
+		os.Exit(1)
+	}
+
+	model, err := classifier.LoadModel(args[0])
+	if err != nil {
+		log.Fatalf("error while loading model: %s", err)
+	}
+
+	examples, err := loadExamples(args[1], args[2], args[3])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	predictions := make([]float64, len(examples))
+	for idx, example := range examples {
+		predictions[idx] = model.Predict(example.Features)
+	}
+
+	fmt.Printf("Evaluating on %d reviewed pairs\n", len(examples))
+	printThresholdMetrics(classifier.EvaluateThresholds(predictions, examples, classifier.DEFAULT_THRESHOLDS))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run main.go <train|evaluate> [options] ...")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "train":
+		runTrain(os.Args[2:])
+	case "evaluate":
+		runEvaluate(os.Args[2:])
+	default:
+		fmt.Printf("Unknown command %s\n", os.Args[1])
+		os.Exit(1)
+	}
+}
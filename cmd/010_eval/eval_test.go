@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The checked in fixture, relative to this package
+const EVAL_DIR = "../../testdata/eval"
+
+// run runs a pipeline stage with go run from the module root
+func run(t *testing.T, stage string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("go", append([]string{"run", "./cmd/" + stage}, args...)...)
+	cmd.Dir = "../.."
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=readonly")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %s\n%s", stage, err, output)
+	}
+}
+
+// TestBaseline runs 001 and 004 on the fixture and fails when any metric
+// dropped below the baseline. To accept an improvement, run 001 and 004 on the
+// fixture as in the README and write the new baseline from the repo root
+//
+//	go run ./cmd/010_eval -baseline testdata/eval/baseline.json -write-baseline testdata/eval/gold.csv /tmp/title_compare.csv /tmp/result.csv
+func TestBaseline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the pipeline")
+	}
+	fixture, err := filepath.Abs(EVAL_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	titleCompareCSVPath := filepath.Join(dir, "title_compare.csv")
+	resultCSVPath := filepath.Join(dir, "result.csv")
+
+	run(t, "001_titlecompare",
+		filepath.Join(fixture, "tmdb_companies.json"),
+		filepath.Join(fixture, "wikidata_companies.csv"),
+		titleCompareCSVPath)
+	run(t, "004_mediaidscompare",
+		titleCompareCSVPath,
+		filepath.Join(fixture, "tmdb_media_mapping.csv"),
+		filepath.Join(fixture, "wikidata_media_mapping.csv"),
+		resultCSVPath)
+
+	gold, err := loadGold(filepath.Join(fixture, "gold.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics Metrics
+	if err := evaluateTitleCompare(titleCompareCSVPath, gold, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := evaluateResult(resultCSVPath, gold, []string{"DECIDED", "PROBABLY"}, &metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	baseline, err := loadBaseline(filepath.Join(fixture, "baseline.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failure := range compareBaseline(&metrics, baseline, 0.0001) {
+		t.Error(failure)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+type Gold struct {
+	// TMDB company id => wikidata ids
+	Pairs map[string][]string
+	Count int
+}
+
+func (g *Gold) Has(tmdbID string, qid string) bool {
+	return fileio.FindInSlice(g.Pairs[tmdbID], qid) != -1
+}
+
+func (g *Gold) Knows(tmdbID string) bool {
+	return len(g.Pairs[tmdbID]) > 0
+}
+
+type Metrics struct {
+	TitleCompareRecallAt1    float64 `json:"title_compare_recall_at_1"`
+	TitleCompareRecallAtN    float64 `json:"title_compare_recall_at_n"`
+	TitleComparePrecisionAt1 float64 `json:"title_compare_precision_at_1"`
+	ResultPrecision          float64 `json:"result_precision"`
+	ResultRecall             float64 `json:"result_recall"`
+	ResultF1                 float64 `json:"result_f1"`
+}
+
+type LabelCounts struct {
+	Correct int
+	Wrong   int
+	Unknown int
+}
+
+// loadGold loads known TMDB <=> wikidata pairs from a csv with tmdb_id and qid
+// columns, or from the tmdb_company_ids column of a 003 wikidata media mapping
+func loadGold(path string) (*Gold, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	qidIdx := fileio.FindInSlice(headers, "qid")
+	fromMapping := false
+	if tmdbIDIdx == -1 || qidIdx == -1 {
+		tmdbIDIdx = fileio.FindInSlice(headers, "tmdb_company_ids")
+		qidIdx = fileio.FindInSlice(headers, "company_id")
+		fromMapping = true
+	}
+	if tmdbIDIdx == -1 || qidIdx == -1 {
+		return nil, fmt.Errorf("invalid gold CSV given: must have fields tmdb_id, qid or be a wikidata media mapping")
+	}
+
+	gold := &Gold{Pairs: make(map[string][]string)}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		qid := record[qidIdx]
+		tmdbIDs := []string{record[tmdbIDIdx]}
+		if fromMapping {
+			tmdbIDs = strings.Split(record[tmdbIDIdx], ";")
+		}
+		for _, tmdbID := range tmdbIDs {
+			if tmdbID == "" || qid == "" || gold.Has(tmdbID, qid) {
+				continue
+			}
+			gold.Pairs[tmdbID] = append(gold.Pairs[tmdbID], qid)
+			gold.Count += 1
+		}
+	}
+
+	return gold, nil
+}
+
+// evaluateTitleCompare checks where the gold wikidata ids appear in the 001 candidates
+func evaluateTitleCompare(path string, gold *Gold, metrics *Metrics) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return err
+	}
+
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdbID")
+	if tmdbIDIdx == -1 {
+		return fmt.Errorf("invalid title compare CSV given: must have field tmdbID")
+	}
+	var candidateIdxs []int
+	for i := 1; fileio.FindInSlice(headers, fmt.Sprintf("result%dID", i)) != -1; i++ {
+		candidateIdxs = append(candidateIdxs, fileio.FindInSlice(headers, fmt.Sprintf("result%dID", i)))
+	}
+
+	found1 := 0
+	foundN := 0
+	known := 0
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		tmdbID := record[tmdbIDIdx]
+		if !gold.Knows(tmdbID) {
+			continue
+		}
+		known += 1
+		for rank, idx := range candidateIdxs {
+			if gold.Has(tmdbID, record[idx]) {
+				if rank == 0 {
+					found1 += 1
+				}
+				foundN += 1
+				break
+			}
+		}
+	}
+
+	if gold.Count > 0 {
+		metrics.TitleCompareRecallAt1 = float64(found1) / float64(gold.Count)
+		metrics.TitleCompareRecallAtN = float64(foundN) / float64(gold.Count)
+	}
+	if known > 0 {
+		metrics.TitleComparePrecisionAt1 = float64(found1) / float64(known)
+	}
+
+	fmt.Printf("001 title compare: %d of %d gold companies have candidates, top 1: %d, any: %d\n", known, gold.Count, found1, foundN)
+	return nil
+}
+
+// evaluateResult checks the 004 labels against the gold pairs
+func evaluateResult(path string, gold *Gold, positive []string, metrics *Metrics) (map[string]*LabelCounts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	labelIdx := fileio.FindInSlice(headers, "match")
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	wikidataIDIdx := fileio.FindInSlice(headers, "wikidata_id")
+	if labelIdx == -1 || tmdbIDIdx == -1 || wikidataIDIdx == -1 {
+		return nil, fmt.Errorf("invalid result CSV given: must have fields match, tmdb_id, wikidata_id")
+	}
+
+	counts := make(map[string]*LabelCounts)
+	truePositives := 0
+	falsePositives := 0
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		label := record[labelIdx]
+		if counts[label] == nil {
+			counts[label] = &LabelCounts{}
+		}
+
+		tmdbID := record[tmdbIDIdx]
+		isPositive := fileio.FindInSlice(positive, label) != -1
+		switch {
+		case !gold.Knows(tmdbID):
+			counts[label].Unknown += 1
+		case gold.Has(tmdbID, record[wikidataIDIdx]):
+			counts[label].Correct += 1
+			if isPositive {
+				truePositives += 1
+			}
+		default:
+			counts[label].Wrong += 1
+			if isPositive {
+				falsePositives += 1
+			}
+		}
+	}
+
+	if truePositives+falsePositives > 0 {
+		metrics.ResultPrecision = float64(truePositives) / float64(truePositives+falsePositives)
+	}
+	if gold.Count > 0 {
+		metrics.ResultRecall = float64(truePositives) / float64(gold.Count)
+	}
+	if metrics.ResultPrecision+metrics.ResultRecall > 0 {
+		metrics.ResultF1 = 2 * metrics.ResultPrecision * metrics.ResultRecall / (metrics.ResultPrecision + metrics.ResultRecall)
+	}
+
+	return counts, nil
+}
+
+// compareBaseline returns the metrics that dropped below the baseline
+func compareBaseline(metrics *Metrics, baseline *Metrics, tolerance float64) []string {
+	var failures []string
+	check := func(name string, value float64, base float64) {
+		if value < base-tolerance {
+			failures = append(failures, fmt.Sprintf("%s dropped from %0.4f to %0.4f", name, base, value))
+		}
+	}
+	check("title_compare_recall_at_1", metrics.TitleCompareRecallAt1, baseline.TitleCompareRecallAt1)
+	check("title_compare_recall_at_n", metrics.TitleCompareRecallAtN, baseline.TitleCompareRecallAtN)
+	check("title_compare_precision_at_1", metrics.TitleComparePrecisionAt1, baseline.TitleComparePrecisionAt1)
+	check("result_precision", metrics.ResultPrecision, baseline.ResultPrecision)
+	check("result_recall", metrics.ResultRecall, baseline.ResultRecall)
+	check("result_f1", metrics.ResultF1, baseline.ResultF1)
+	return failures
+}
+
+func loadBaseline(path string) (*Metrics, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var baseline Metrics
+	err = json.Unmarshal(data, &baseline)
+	if err != nil {
+		return nil, err
+	}
+	return &baseline, nil
+}
+
+func main() {
+	positiveLabels := flag.String("positive", "DECIDED,PROBABLY", "comma separated labels counted as a predicted match")
+	baselinePath := flag.String("baseline", "", "baseline metrics json, exits with an error if quality drops below it")
+	writeBaseline := flag.Bool("write-baseline", false, "write the metrics to the baseline instead of comparing")
+	tolerance := flag.Float64("tolerance", 0.0001, "allowed drop below the baseline")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <gold csv> <title compare csv> <result csv>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	gold, err := loadGold(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("error while loading gold csv: %s", err)
+	}
+	fmt.Printf("%d gold pairs\n", gold.Count)
+
+	var metrics Metrics
+	err = evaluateTitleCompare(flag.Arg(1), gold, &metrics)
+	if err != nil {
+		log.Fatalf("error while evaluating title compare csv: %s", err)
+	}
+
+	counts, err := evaluateResult(flag.Arg(2), gold, strings.Split(*positiveLabels, ","), &metrics)
+	if err != nil {
+		log.Fatalf("error while evaluating result csv: %s", err)
+	}
+
+	var labels []string
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Println("004 result:")
+	fmt.Println("  label      correct  wrong    unknown")
+	for _, label := range labels {
+		c := counts[label]
+		fmt.Printf("  %-10s %-8d %-8d %-8d\n", label, c.Correct, c.Wrong, c.Unknown)
+	}
+
+	data, _ := json.MarshalIndent(&metrics, "", "  ")
+	fmt.Println(string(data))
+
+	if *baselinePath == "" {
+		return
+	}
+
+	if *writeBaseline {
+		err = os.WriteFile(*baselinePath, append(data, '\n'), 0644)
+		if err != nil {
+			log.Fatalf("error while writing baseline: %s", err)
+		}
+		return
+	}
+
+	baseline, err := loadBaseline(*baselinePath)
+	if err != nil {
+		log.Fatalf("error while reading baseline: %s", err)
+	}
+
+	if failures := compareBaseline(&metrics, baseline, *tolerance); len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Println("FAIL:", failure)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("OK: no metric dropped below the baseline")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
+)
+
+// Same as 001
+const MAX_RESULTS = 5
+
+const USAGE = `Usage: go run main.go <import|export> <store db> <kind> <csv>
+
+kinds:
+  tmdb-media       media mapping from 002
+  wikidata-media   media mapping from 003
+  compare          title compare csv from 001
+  result           result csv from 004
+  decisions        decisions csv from 008`
+
+var MEDIA_SOURCES = map[string]string{
+	"tmdb-media":     store.SOURCE_TMDB,
+	"wikidata-media": store.SOURCE_WIKIDATA,
+}
+
+func runImport(db *store.Store, kind string, path string) (int, error) {
+	switch kind {
+	case "tmdb-media", "wikidata-media":
+		source, count, err := db.ImportMediaMappingCSV(path)
+		if err == nil && source != MEDIA_SOURCES[kind] {
+			// already written, but the caller should know they mixed them up
+			return count, fmt.Errorf("%s looks like a %s media mapping, not %s", path, source, kind)
+		}
+		return count, err
+	case "compare":
+		return db.ImportTitleCompareCSV(path)
+	case "result":
+		return db.ImportResultCSV(path)
+	case "decisions":
+		decisionList, err := decisions.ReadCSV(path)
+		if err != nil {
+			return 0, err
+		}
+		return len(decisionList), db.PutDecisions(decisionList)
+	}
+	return 0, fmt.Errorf("unknown kind %s", kind)
+}
+
+func runExport(db *store.Store, kind string, path string) error {
+	switch kind {
+	case "tmdb-media", "wikidata-media":
+		return db.ExportMediaMappingCSV(MEDIA_SOURCES[kind], path)
+	case "compare":
+		return db.ExportTitleCompareCSV(path, MAX_RESULTS)
+	case "result":
+		return db.ExportResultCSV(path)
+	case "decisions":
+		decisionList, err := db.Decisions()
+		if err != nil {
+			return err
+		}
+		return decisions.WriteCSV(path, decisionList)
+	}
+	return fmt.Errorf("unknown kind %s", kind)
+}
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Println(USAGE)
+		os.Exit(1)
+	}
+
+	command := os.Args[1]
+	storePath := os.Args[2]
+	kind := os.Args[3]
+	csvPath := os.Args[4]
+
+	db, err := store.Open(storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch command {
+	case "import":
+		count, err := runImport(db, kind, csvPath)
+		if err != nil {
+			log.Fatalf("error while importing %s: %s", csvPath, err)
+		}
+		fmt.Printf("Imported %d %s records\n", count, kind)
+	case "export":
+		err := runExport(db, kind, csvPath)
+		if err != nil {
+			log.Fatalf("error while exporting %s: %s", csvPath, err)
+		}
+		fmt.Printf("Exported %s to %s\n", kind, csvPath)
+	default:
+		fmt.Println(USAGE)
+		os.Exit(1)
+	}
+}
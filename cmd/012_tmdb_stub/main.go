@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/tmdbstub"
+)
+
+// Serves recorded TMDB responses from a directory so 002 can be run offline,
+// see internal/tmdbstub for the layout
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8099", "address to listen on")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <recorded responses dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	root := flag.Arg(0)
+
+	log.Printf("Replaying %s on http://%s", root, *listen)
+	log.Fatal(http.ListenAndServe(*listen, tmdbstub.Handler(root, log.Default())))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+const MAX_CANDIDATES = 5
+
+// A TMDB company of the works of an unmatched wikidata company
+type Candidate struct {
+	TmdbID string
+	Name   string
+	// works of the wikidata company the TMDB company is on
+	CommonCount int
+}
+
+type Unmatched struct {
+	Company *matching.Company
+	// works with a TMDB id that is on any TMDB company
+	FoundCount int
+	Candidates []*Candidate
+}
+
+func mediaKey(mediaType string, tmdbID int64) string {
+	return mediaType + ":" + strconv.FormatInt(tmdbID, 10)
+}
+
+// loadMatchedQIDs returns the wikidata companies of a 004 result with one of labels
+func loadMatchedQIDs(path string, labels []string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	labelIdx := fileio.FindInSlice(headers, "match")
+	wikidataIDIdx := fileio.FindInSlice(headers, "wikidata_id")
+	if labelIdx == -1 || wikidataIDIdx == -1 {
+		return nil, fmt.Errorf("invalid CSV given: must have fields match, wikidata_id")
+	}
+
+	var matched = make(map[string]bool)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(labels) == 0 || fileio.FindInSlice(labels, record[labelIdx]) != -1 {
+			matched[record[wikidataIDIdx]] = true
+		}
+	}
+	return matched, nil
+}
+
+// companiesByMedia inverts the TMDB media mapping, which is the
+// production_companies of each title
+func companiesByMedia(tmdbCompanies map[string]*matching.Company) map[string][]string {
+	var byMedia = make(map[string][]string)
+	for companyID, company := range tmdbCompanies {
+		for _, tmdbID := range company.Media.Movies {
+			byMedia[mediaKey("movie", tmdbID)] = append(byMedia[mediaKey("movie", tmdbID)], companyID)
+		}
+		for _, tmdbID := range company.Media.TV {
+			byMedia[mediaKey("tv", tmdbID)] = append(byMedia[mediaKey("tv", tmdbID)], companyID)
+		}
+	}
+	return byMedia
+}
+
+// findCandidates counts the TMDB companies of the works of a wikidata company,
+// a work with several TMDB ids counts once for each TMDB company
+func findCandidates(company *matching.Company, byMedia map[string][]string, tmdbCompanies map[string]*matching.Company, store *decisions.Store) *Unmatched {
+	var worksOf = make(map[string]map[string]bool)
+	var found = make(map[string]bool)
+	addWork := func(idx int, works []string, mediaType string, tmdbID int64) {
+		work := works[idx]
+		if work == "" {
+			work = mediaKey(mediaType, tmdbID)
+		}
+		for _, tmdbCompanyID := range byMedia[mediaKey(mediaType, tmdbID)] {
+			found[work] = true
+			if store.IsRejected(tmdbCompanyID, company.ID) {
+				continue
+			}
+			if worksOf[tmdbCompanyID] == nil {
+				worksOf[tmdbCompanyID] = make(map[string]bool)
+			}
+			worksOf[tmdbCompanyID][work] = true
+		}
+	}
+	for idx, tmdbID := range company.Media.Movies {
+		addWork(idx, company.Media.MovieWorks, "movie", tmdbID)
+	}
+	for idx, tmdbID := range company.Media.TV {
+		addWork(idx, company.Media.TVWorks, "tv", tmdbID)
+	}
+
+	unmatched := &Unmatched{
+		Company:    company,
+		FoundCount: len(found),
+	}
+	for tmdbCompanyID, works := range worksOf {
+		unmatched.Candidates = append(unmatched.Candidates, &Candidate{
+			TmdbID:      tmdbCompanyID,
+			Name:        tmdbCompanies[tmdbCompanyID].Name,
+			CommonCount: len(works),
+		})
+	}
+	sort.Slice(unmatched.Candidates, func(i int, j int) bool {
+		c1 := unmatched.Candidates[i]
+		c2 := unmatched.Candidates[j]
+		if c1.CommonCount != c2.CommonCount {
+			return c1.CommonCount > c2.CommonCount
+		}
+		return c1.TmdbID < c2.TmdbID
+	})
+	if len(unmatched.Candidates) > MAX_CANDIDATES {
+		unmatched.Candidates = unmatched.Candidates[:MAX_CANDIDATES]
+	}
+	return unmatched
+}
+
+func saveUnmatched(unmatched []*Unmatched, path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := []string{"wikidata_id", "wikidata_company_name", "wikidata_media_count", "tmdb_found_media_count"}
+	for i := 1; i <= MAX_CANDIDATES; i++ {
+		prefix := fmt.Sprintf("candidate%d", i)
+		header = append(header, prefix+"ID", prefix+"Name", prefix+"CommonCount")
+	}
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range unmatched {
+		row := []string{
+			item.Company.ID,
+			item.Company.Name,
+			strconv.Itoa(item.Company.Media.Count),
+			strconv.Itoa(item.FoundCount),
+		}
+		for _, candidate := range item.Candidates {
+			row = append(row, candidate.TmdbID, candidate.Name, strconv.Itoa(candidate.CommonCount))
+		}
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		err = csvWriter.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func main() {
+	var labels string
+	var minWorks int
+	flag.StringVar(&labels, "labels", "DECIDED,PROBABLY", "comma separated result labels that count as matched (empty for all)")
+	flag.IntVar(&minWorks, "min-works", 5, "minimum works with a TMDB id for a wikidata company to be reported")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <wikidata media mapping> <tmdb media mapping> <result csv> <output> [decisions csv]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	wikidataMediaCSVPath := flag.Arg(0)
+	tmdbMediaCSVPath := flag.Arg(1)
+	resultCSVPath := flag.Arg(2)
+	outputCSVPath := flag.Arg(3)
+	decisionsPath := flag.Arg(4)
+
+	var labelList []string
+	if labels != "" {
+		labelList = strings.Split(labels, ",")
+	}
+
+	store, err := decisions.Load(decisionsPath)
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	wikidataCompanies, err := matching.LoadWikidataMediaMapping(wikidataMediaCSVPath, nil)
+	if err != nil {
+		log.Fatalf("error while loading wikidata media mapping: %s", err)
+	}
+
+	tmdbCompanies, err := matching.LoadTmdbMediaMapping(tmdbMediaCSVPath, nil)
+	if err != nil {
+		log.Fatalf("error while loading tmdb media mapping: %s", err)
+	}
+
+	matched, err := loadMatchedQIDs(resultCSVPath, labelList)
+	if err != nil {
+		log.Fatalf("error while loading result csv: %s", err)
+	}
+	for _, decision := range store.All() {
+		if decision.Verdict == decisions.VERDICT_ACCEPT {
+			matched[decision.QID] = true
+		}
+	}
+
+	byMedia := companiesByMedia(tmdbCompanies)
+
+	var unmatched []*Unmatched
+	linked := 0
+	for _, company := range wikidataCompanies {
+		if company.Media.Count < minWorks {
+			continue
+		}
+		if len(company.LinkedTmdbIDs) > 0 {
+			linked += 1
+			continue
+		}
+		if matched[company.ID] {
+			continue
+		}
+		unmatched = append(unmatched, findCandidates(company, byMedia, tmdbCompanies, store))
+	}
+
+	// the companies with the most works are the most notable gaps
+	sort.Slice(unmatched, func(i int, j int) bool {
+		c1 := unmatched[i].Company
+		c2 := unmatched[j].Company
+		if c1.Media.Count != c2.Media.Count {
+			return c1.Media.Count > c2.Media.Count
+		}
+		return c1.ID < c2.ID
+	})
+
+	err = saveUnmatched(unmatched, outputCSVPath)
+	if err != nil {
+		log.Fatalf("error while saving unmatched companies: %s", err)
+	}
+
+	fmt.Printf("%d wikidata companies with at least %d works have no TMDB match (already linked: %d)\n", len(unmatched), minWorks, linked)
+}
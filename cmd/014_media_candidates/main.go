@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+// Media candidates added to each TMDB company, as many as 001 finds by name
+const MAX_RESULTS = 5
+
+type Result struct {
+	Score float64
+	QID   string
+	Name  string
+}
+
+// Row is a TMDB company of the title compare csv with its candidates
+type Row struct {
+	TmdbID   string
+	TmdbName string
+	Results  []*Result
+}
+
+func (r *Row) Has(qid string) bool {
+	for _, result := range r.Results {
+		if result.QID == qid {
+			return true
+		}
+	}
+	return false
+}
+
+type Cooccurrence struct {
+	QID         string
+	CommonCount int
+}
+
+func mediaKey(mediaType string, tmdbID int64) string {
+	return mediaType + ":" + strconv.FormatInt(tmdbID, 10)
+}
+
+// loadTitleCompareCSV reads the candidates 001 found by name, in file order
+func loadTitleCompareCSV(path string) ([]*Row, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	if _, err := csvReader.Read(); err != nil {
+		return nil, err
+	}
+
+	var rows []*Row
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := &Row{
+			TmdbID:   record[0],
+			TmdbName: record[1],
+		}
+		for idx := 2; idx+2 < len(record); idx += 3 {
+			if record[idx] == "" {
+				break
+			}
+			score, err := strconv.ParseFloat(record[idx], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid score %s for %s", record[idx], record[0])
+			}
+			row.Results = append(row.Results, &Result{
+				Score: score,
+				QID:   record[idx+1],
+				Name:  record[idx+2],
+			})
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// worksByMedia indexes the works of each wikidata company by their TMDB ids
+func worksByMedia(wikidataCompanies map[string]*matching.Company) map[string]map[string]string {
+	// media key => company QID => work
+	var byMedia = make(map[string]map[string]string)
+	add := func(companyID string, works []string, idx int, mediaType string, tmdbID int64) {
+		key := mediaKey(mediaType, tmdbID)
+		work := key
+		if idx < len(works) && works[idx] != "" {
+			work = works[idx]
+		}
+		if byMedia[key] == nil {
+			byMedia[key] = make(map[string]string)
+		}
+		byMedia[key][companyID] = work
+	}
+	for companyID, company := range wikidataCompanies {
+		for idx, tmdbID := range company.Media.Movies {
+			add(companyID, company.Media.MovieWorks, idx, "movie", tmdbID)
+		}
+		for idx, tmdbID := range company.Media.TV {
+			add(companyID, company.Media.TVWorks, idx, "tv", tmdbID)
+		}
+	}
+	return byMedia
+}
+
+// cooccurrences returns the wikidata companies sharing at least minCommon
+// works with a TMDB company, the most shared first
+func cooccurrences(company *matching.Company, byMedia map[string]map[string]string, minCommon int) []*Cooccurrence {
+	var common = make(map[string]map[string]bool)
+	count := func(mediaType string, tmdbID int64) {
+		for qid, work := range byMedia[mediaKey(mediaType, tmdbID)] {
+			if common[qid] == nil {
+				common[qid] = make(map[string]bool)
+			}
+			common[qid][work] = true
+		}
+	}
+	for _, tmdbID := range company.Media.Movies {
+		count("movie", tmdbID)
+	}
+	for _, tmdbID := range company.Media.TV {
+		count("tv", tmdbID)
+	}
+
+	var results []*Cooccurrence
+	for qid, works := range common {
+		if len(works) >= minCommon {
+			results = append(results, &Cooccurrence{QID: qid, CommonCount: len(works)})
+		}
+	}
+	sort.Slice(results, func(i int, j int) bool {
+		if results[i].CommonCount != results[j].CommonCount {
+			return results[i].CommonCount > results[j].CommonCount
+		}
+		return results[i].QID < results[j].QID
+	})
+	return results
+}
+
+// mergeCandidates appends the media candidates of each TMDB company after its
+// name candidates, adding rows for companies 001 found nothing for, and adds
+// them to mediaCandidates. Returns the number of candidates added.
+func mergeCandidates(rows []*Row, mediaCandidates matching.MediaCandidates, tmdbCompanies map[string]*matching.Company, wikidataCompanies map[string]*matching.Company, store *decisions.Store, minCommon int) ([]*Row, int) {
+	var rowsByID = make(map[string]*Row, len(rows))
+	for _, row := range rows {
+		rowsByID[row.TmdbID] = row
+	}
+
+	var tmdbIDs []string
+	for tmdbID := range tmdbCompanies {
+		tmdbIDs = append(tmdbIDs, tmdbID)
+	}
+	sort.Strings(tmdbIDs)
+
+	byMedia := worksByMedia(wikidataCompanies)
+
+	added := 0
+	for _, tmdbID := range tmdbIDs {
+		company := tmdbCompanies[tmdbID]
+		normalizedName := matching.NormalizeName(company.Name)
+		row := rowsByID[tmdbID]
+		mediaResults := 0
+		for _, cooccurrence := range cooccurrences(company, byMedia, minCommon) {
+			if mediaResults >= MAX_RESULTS {
+				break
+			}
+			if store.IsRejected(tmdbID, cooccurrence.QID) || row != nil && row.Has(cooccurrence.QID) {
+				continue
+			}
+			if row == nil {
+				row = &Row{TmdbID: tmdbID, TmdbName: company.Name}
+				rowsByID[tmdbID] = row
+				rows = append(rows, row)
+			}
+			// the name score as 001 would give it, 004 weighs the candidates
+			// listed in mediaCandidates by their media instead
+			wikidataCompany := wikidataCompanies[cooccurrence.QID]
+			row.Results = append(row.Results, &Result{
+				Score: matching.CompareNames(normalizedName, matching.NormalizeName(wikidataCompany.Name)),
+				QID:   cooccurrence.QID,
+				Name:  wikidataCompany.Name,
+			})
+			mediaCandidates.Add(tmdbID, cooccurrence.QID, cooccurrence.CommonCount)
+			mediaResults += 1
+			added += 1
+		}
+	}
+	return rows, added
+}
+
+func saveTitleCompareCSV(rows []*Row, path string) error {
+	maxResults := MAX_RESULTS
+	for _, row := range rows {
+		if len(row.Results) > maxResults {
+			maxResults = len(row.Results)
+		}
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := []string{"tmdbID", "tmdbName"}
+	for i := 1; i <= maxResults; i++ {
+		prefix := fmt.Sprintf("result%d", i)
+		header = append(header, prefix+"Score", prefix+"ID", prefix+"Name")
+	}
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := []string{row.TmdbID, row.TmdbName}
+		for _, result := range row.Results {
+			record = append(record, fmt.Sprintf("%0.6f", result.Score), result.QID, result.Name)
+		}
+		for len(record) < len(header) {
+			record = append(record, "")
+		}
+		err = csvWriter.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func main() {
+	var minCommon int
+	flag.IntVar(&minCommon, "min-common", 2, "minimum works a TMDB and a wikidata company share to be candidates")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <title compare csv> <tmdb media mapping> <wikidata media mapping> <output> [decisions csv]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	titleCompareCSVPath := flag.Arg(0)
+	tmdbMediaCSVPath := flag.Arg(1)
+	wikidataMediaCSVPath := flag.Arg(2)
+	outputCSVPath := flag.Arg(3)
+	decisionsPath := flag.Arg(4)
+
+	store, err := decisions.Load(decisionsPath)
+	if err != nil {
+		log.Fatalf("error while loading decisions: %s", err)
+	}
+
+	rows, err := loadTitleCompareCSV(titleCompareCSVPath)
+	if err != nil {
+		log.Fatalf("error while loading title compare csv: %s", err)
+	}
+
+	tmdbCompanies, err := matching.LoadTmdbMediaMapping(tmdbMediaCSVPath, nil)
+	if err != nil {
+		log.Fatalf("error while loading tmdb media mapping: %s", err)
+	}
+
+	wikidataCompanies, err := matching.LoadWikidataMediaMapping(wikidataMediaCSVPath, nil)
+	if err != nil {
+		log.Fatalf("error while loading wikidata media mapping: %s", err)
+	}
+
+	// keep the media candidates of a title compare csv merged before
+	mediaCandidates, err := matching.LoadMediaCandidates(titleCompareCSVPath)
+	if err != nil {
+		log.Fatalf("error while loading media candidates: %s", err)
+	}
+
+	nameRows := len(rows)
+	rows, added := mergeCandidates(rows, mediaCandidates, tmdbCompanies, wikidataCompanies, store, minCommon)
+
+	err = saveTitleCompareCSV(rows, outputCSVPath)
+	if err != nil {
+		log.Fatalf("error while saving title compare csv: %s", err)
+	}
+
+	err = matching.SaveMediaCandidates(mediaCandidates, outputCSVPath)
+	if err != nil {
+		log.Fatalf("error while saving media candidates: %s", err)
+	}
+
+	fmt.Printf("Added %d media candidates, %d TMDB companies had no name candidates\n", added, len(rows)-nameRows)
+}
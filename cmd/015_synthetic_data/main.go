@@ -0,0 +1,246 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Words company names and titles are made of
+var WORDS = []string{
+	"harbour", "ridge", "night", "owl", "silver", "north", "river", "studio", "pictures", "films",
+	"lights", "tide", "stone", "crest", "valley", "echo", "iron", "lantern", "meadow", "summit",
+	"copper", "falcon", "willow", "ember", "atlas", "orbit", "pine", "raven", "quartz", "delta",
+}
+
+type Generator struct {
+	rng *rand.Rand
+}
+
+func (g *Generator) name(words int) string {
+	var parts []string
+	for i := 0; i < words; i++ {
+		word := WORDS[g.rng.Intn(len(WORDS))]
+		parts = append(parts, strings.ToUpper(word[:1])+word[1:])
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeCSV writes rows from next until it returns nil
+func writeCSV(path string, header []string, next func() []string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	if err := csvWriter.Write(header); err != nil {
+		return err
+	}
+	for row := next(); row != nil; row = next() {
+		if err := csvWriter.Write(row); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// writeExport writes the companies as the gzipped TMDB daily export read by 001
+func writeExport(path string, names []string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for idx, name := range names {
+		err := encoder.Encode(map[string]interface{}{"id": idx + 1, "name": name})
+		if err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// mediaRows returns a row generator spreading count media over the companies.
+// The ids of company N start at N * stride on both sides, so the same
+// companies have common media.
+func (g *Generator) mediaRows(companyIDs []string, names []string, count int, stride int, extra func(mediaID int) []string) func() []string {
+	perCompany := count / len(companyIDs)
+	if perCompany == 0 {
+		perCompany = 1
+	}
+	company := 0
+	media := 0
+	written := 0
+	return func() []string {
+		if company >= len(companyIDs) || written >= count {
+			return nil
+		}
+		written += 1
+		mediaID := company*stride + media + 1
+		mediaType := "movie"
+		if mediaID%4 == 0 {
+			mediaType = "tv"
+		}
+		row := []string{
+			companyIDs[company],
+			names[company],
+			strconv.Itoa(mediaID),
+			mediaType,
+			g.name(2),
+			strconv.Itoa(1950 + g.rng.Intn(75)),
+			strconv.Itoa(g.rng.Intn(50)),
+			"",
+		}
+		row = append(row, extra(mediaID)...)
+		media += 1
+		if media >= perCompany {
+			media = 0
+			company += 1
+		}
+		return row
+	}
+}
+
+func main() {
+	tmdbCount := flag.Int("companies", 150000, "TMDB companies in the export")
+	wikidataCount := flag.Int("wikidata-companies", 20000, "wikidata companies")
+	mediaRows := flag.Int("media-rows", 3000000, "rows of the TMDB media mapping")
+	wikidataMediaRows := flag.Int("wikidata-media-rows", 1500000, "rows of the wikidata media mapping")
+	seed := flag.Int64("seed", 1, "random seed")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [options] <output dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	dir := flag.Arg(0)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	g := &Generator{rng: rand.New(rand.NewSource(*seed))}
+
+	var tmdbIDs, tmdbNames []string
+	for idx := 0; idx < *tmdbCount; idx++ {
+		tmdbIDs = append(tmdbIDs, strconv.Itoa(idx+1))
+		tmdbNames = append(tmdbNames, g.name(2))
+	}
+	// the first wikidata companies are the same companies as the first TMDB ones
+	var qids, wikidataNames []string
+	for idx := 0; idx < *wikidataCount; idx++ {
+		qids = append(qids, "Q"+strconv.Itoa(1000000+idx))
+		name := g.name(2)
+		if idx < *tmdbCount {
+			name = tmdbNames[idx]
+		}
+		wikidataNames = append(wikidataNames, name)
+	}
+
+	err := writeExport(filepath.Join(dir, "production_company_ids.json.gz"), tmdbNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	idx := 0
+	err = writeCSV(filepath.Join(dir, "wikidata-companies.csv"), []string{"pcomp", "pcompLabel", "logo"}, func() []string {
+		if idx >= len(qids) {
+			return nil
+		}
+		idx += 1
+		return []string{"http://www.wikidata.org/entity/" + qids[idx-1], wikidataNames[idx-1], ""}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// five candidates for each TMDB company, the right one first when there is one
+	idx = 0
+	err = writeCSV(filepath.Join(dir, "title_compare.csv"), []string{
+		"tmdbID", "tmdbName",
+		"result1Score", "result1ID", "result1Name",
+		"result2Score", "result2ID", "result2Name",
+		"result3Score", "result3ID", "result3Name",
+		"result4Score", "result4ID", "result4Name",
+		"result5Score", "result5ID", "result5Name",
+	}, func() []string {
+		if idx >= len(tmdbIDs) {
+			return nil
+		}
+		row := []string{tmdbIDs[idx], tmdbNames[idx]}
+		for i := 0; i < 5; i++ {
+			candidate := g.rng.Intn(len(qids))
+			if i == 0 && idx < len(qids) {
+				candidate = idx
+			}
+			row = append(row, fmt.Sprintf("%0.6f", 0.65+0.35*g.rng.Float64()), qids[candidate], wikidataNames[candidate])
+		}
+		idx += 1
+		return row
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stride := *mediaRows / *tmdbCount
+	if stride == 0 {
+		stride = 1
+	}
+	err = writeCSV(filepath.Join(dir, "tmdb_media_mapping.csv"), []string{
+		"company_id", "company_name", "id", "type", "title", "year", "popularity", "poster",
+		"origin_country", "logo_path", "homepage",
+	}, g.mediaRows(tmdbIDs, tmdbNames, *mediaRows, stride, func(mediaID int) []string {
+		return []string{"US", "", ""}
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = writeCSV(filepath.Join(dir, "wikidata_media_mapping.csv"), []string{
+		"company_id", "company_name", "id", "type", "title", "year", "sitelinks", "poster",
+		"qid", "class", "tmdb_company_ids", "country", "website", "mapping_version",
+	}, g.mediaRows(qids, wikidataNames, *wikidataMediaRows, stride, func(mediaID int) []string {
+		return []string{"Q" + strconv.Itoa(50000000+mediaID), "film", "", "US", "", "2"}
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Wrote %d TMDB and %d wikidata companies with %d and %d media rows to %s\n", *tmdbCount, *wikidataCount, *mediaRows, *wikidataMediaRows, dir)
+}
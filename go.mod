@@ -3,16 +3,19 @@ module github.com/rohfle/wikidata-contrib/tmdb-companies
 go 1.20
 
 require (
-	github.com/adrg/strutil v0.3.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
-	github.com/schollz/progressbar/v3 v3.13.1 // indirect
 	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/term v0.7.0 // indirect
 	golang.org/x/time v0.3.0 // indirect
 )
 
-require github.com/rohfle/quickiedata v0.0.0-00010101000000-000000000000
+require (
+	github.com/adrg/strutil v0.3.0
+	github.com/rohfle/quickiedata v0.0.0-00010101000000-000000000000
+	github.com/schollz/progressbar/v3 v3.13.1
+	go.etcd.io/bbolt v1.3.9
+)
 
 replace github.com/rohfle/quickiedata => ../../quickiedata
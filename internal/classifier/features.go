@@ -0,0 +1,116 @@
+// Package classifier scores TMDB <=> wikidata company pairs with a model
+// trained on reviewed pairs instead of hand tuned thresholds
+package classifier
+
+import (
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/adrg/strutil"
+	"github.com/adrg/strutil/metrics"
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/matching"
+)
+
+// FEATURE_NAMES must match the order of values returned by Features
+var FEATURE_NAMES = []string{
+	"name_levenshtein",
+	"name_jaro_winkler",
+	"name_bigram_jaccard",
+	"name_token_jaccard",
+	"media_overlap",
+	"media_jaccard",
+	"log_common_media",
+	"log_tmdb_media",
+	"log_wikidata_media",
+	"country_agreement",
+	"year_agreement",
+	"website_agreement",
+}
+
+var jaroWinkler = metrics.NewJaroWinkler()
+var bigramJaccard = &metrics.Jaccard{CaseSensitive: false, NgramSize: 2}
+
+// Features returns the feature vector for a pair of companies
+func Features(tmdb *matching.Company, wikidata *matching.Company) []float64 {
+	tmdbName := matching.NormalizeName(tmdb.Name)
+	wikidataName := matching.NormalizeName(wikidata.Name)
+
+	overlap, common := matching.OverlapCoeff(&tmdb.Media, &wikidata.Media)
+	jaccard := 0.0
+	if union := tmdb.Media.Count + wikidata.Media.Count - common; union > 0 {
+		jaccard = float64(common) / float64(union)
+	}
+
+	return []float64{
+		math.Max(matching.CompareNames(tmdbName, wikidataName), 0),
+		strutil.Similarity(tmdbName, wikidataName, jaroWinkler),
+		strutil.Similarity(tmdbName, wikidataName, bigramJaccard),
+		tokenJaccard(tmdbName, wikidataName),
+		overlap,
+		jaccard,
+		math.Log1p(float64(common)),
+		math.Log1p(float64(tmdb.Media.Count)),
+		math.Log1p(float64(wikidata.Media.Count)),
+		agreement(tmdb.Countries, wikidata.Countries, strings.ToUpper),
+		yearAgreement(tmdb.MinYear(), wikidata.MinYear()),
+		agreement(tmdb.Websites, wikidata.Websites, websiteHost),
+	}
+}
+
+func tokenJaccard(a string, b string) float64 {
+	tokensA := make(map[string]bool)
+	for _, token := range strings.Fields(a) {
+		tokensA[token] = true
+	}
+	tokensB := make(map[string]bool)
+	for _, token := range strings.Fields(b) {
+		tokensB[token] = true
+	}
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0
+	}
+	intersection := 0
+	for token := range tokensB {
+		if tokensA[token] {
+			intersection += 1
+		}
+	}
+	return float64(intersection) / float64(len(tokensA)+len(tokensB)-intersection)
+}
+
+// agreement is 1 when any normalized values are equal, -1 when they all
+// differ and 0 when either side is unknown
+func agreement(a []string, b []string, normalize func(string) string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	for _, va := range a {
+		for _, vb := range b {
+			if na := normalize(va); na != "" && na == normalize(vb) {
+				return 1
+			}
+		}
+	}
+	return -1
+}
+
+// yearAgreement compares the earliest media years, allowing for release date differences
+func yearAgreement(a int, b int) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	diff := a - b
+	if diff >= -1 && diff <= 1 {
+		return 1
+	}
+	return -1
+}
+
+func websiteHost(website string) string {
+	u, err := url.Parse(strings.TrimSpace(website))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+}
@@ -0,0 +1,258 @@
+package classifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+)
+
+// Model is a logistic regression over standardized features
+type Model struct {
+	FeatureNames []string  `json:"feature_names"`
+	Mean         []float64 `json:"mean"`
+	Std          []float64 `json:"std"`
+	Weights      []float64 `json:"weights"`
+	Bias         float64   `json:"bias"`
+}
+
+type TrainOptions struct {
+	Epochs       int
+	LearningRate float64
+	L2           float64
+}
+
+var DEFAULT_TRAIN_OPTIONS = TrainOptions{
+	Epochs:       2000,
+	LearningRate: 0.1,
+	L2:           0.01,
+}
+
+type Example struct {
+	TmdbID   string
+	QID      string
+	Features []float64
+	Label    bool
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// Train fits a model with full batch gradient descent on the log loss. The
+// examples are not weighted by class, so Predict stays a probability at the
+// rate of accepts in the reviewed set.
+func Train(examples []*Example, options TrainOptions) (*Model, error) {
+	if len(examples) == 0 {
+		return nil, fmt.Errorf("no examples to train on")
+	}
+	featureCount := len(examples[0].Features)
+
+	model := &Model{
+		FeatureNames: FEATURE_NAMES,
+		Mean:         make([]float64, featureCount),
+		Std:          make([]float64, featureCount),
+		Weights:      make([]float64, featureCount),
+	}
+
+	positives := 0
+	for _, example := range examples {
+		if example.Label {
+			positives += 1
+		}
+		for idx, value := range example.Features {
+			model.Mean[idx] += value
+		}
+	}
+	if positives == 0 || positives == len(examples) {
+		return nil, fmt.Errorf("need both accepted and rejected examples to train (accepted %d of %d)", positives, len(examples))
+	}
+
+	n := float64(len(examples))
+	for idx := range model.Mean {
+		model.Mean[idx] /= n
+	}
+	for _, example := range examples {
+		for idx, value := range example.Features {
+			diff := value - model.Mean[idx]
+			model.Std[idx] += diff * diff
+		}
+	}
+	for idx := range model.Std {
+		model.Std[idx] = math.Sqrt(model.Std[idx] / n)
+		if model.Std[idx] == 0 {
+			model.Std[idx] = 1 // constant feature
+		}
+	}
+
+	scaled := make([][]float64, len(examples))
+	for idx, example := range examples {
+		scaled[idx] = model.scale(example.Features)
+	}
+
+	gradient := make([]float64, featureCount)
+	for epoch := 0; epoch < options.Epochs; epoch++ {
+		for idx := range gradient {
+			gradient[idx] = 0
+		}
+		biasGradient := 0.0
+
+		for idx, example := range examples {
+			target := 0.0
+			if example.Label {
+				target = 1
+			}
+			diff := model.probability(scaled[idx]) - target
+			for fidx, value := range scaled[idx] {
+				gradient[fidx] += diff * value
+			}
+			biasGradient += diff
+		}
+
+		for idx := range model.Weights {
+			model.Weights[idx] -= options.LearningRate * (gradient[idx]/n + options.L2*model.Weights[idx])
+		}
+		model.Bias -= options.LearningRate * biasGradient / n
+	}
+
+	return model, nil
+}
+
+func (m *Model) scale(features []float64) []float64 {
+	scaled := make([]float64, len(features))
+	for idx, value := range features {
+		scaled[idx] = (value - m.Mean[idx]) / m.Std[idx]
+	}
+	return scaled
+}
+
+func (m *Model) probability(scaled []float64) float64 {
+	z := m.Bias
+	for idx, value := range scaled {
+		z += m.Weights[idx] * value
+	}
+	return sigmoid(z)
+}
+
+// Predict returns the probability that the pair is a match
+func (m *Model) Predict(features []float64) float64 {
+	return m.probability(m.scale(features))
+}
+
+func (m *Model) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func LoadModel(path string) (*Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var model Model
+	err = json.Unmarshal(data, &model)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(model.FeatureNames) != len(FEATURE_NAMES) {
+		return nil, fmt.Errorf("%s: model has %d features, expected %d", path, len(model.FeatureNames), len(FEATURE_NAMES))
+	}
+	for idx, name := range model.FeatureNames {
+		if name != FEATURE_NAMES[idx] {
+			return nil, fmt.Errorf("%s: model feature %d is %s, expected %s", path, idx, name, FEATURE_NAMES[idx])
+		}
+	}
+	return &model, nil
+}
+
+// CrossValidate returns out of fold predictions for each example using k folds
+func CrossValidate(examples []*Example, folds int, options TrainOptions, seed int64) ([]float64, error) {
+	if folds < 2 || folds > len(examples) {
+		return nil, fmt.Errorf("invalid fold count %d for %d examples", folds, len(examples))
+	}
+
+	order := rand.New(rand.NewSource(seed)).Perm(len(examples))
+	predictions := make([]float64, len(examples))
+
+	for fold := 0; fold < folds; fold++ {
+		var train []*Example
+		var test []int
+		for pos, idx := range order {
+			if pos%folds == fold {
+				test = append(test, idx)
+			} else {
+				train = append(train, examples[idx])
+			}
+		}
+
+		model, err := Train(train, options)
+		if err != nil {
+			return nil, fmt.Errorf("fold %d: %w", fold+1, err)
+		}
+		for _, idx := range test {
+			predictions[idx] = model.Predict(examples[idx].Features)
+		}
+	}
+
+	return predictions, nil
+}
+
+type ThresholdMetrics struct {
+	Threshold float64
+	TP        int
+	FP        int
+	FN        int
+	TN        int
+	Precision float64
+	Recall    float64
+	F1        float64
+}
+
+// EvaluateThresholds computes precision and recall for each threshold
+func EvaluateThresholds(predictions []float64, examples []*Example, thresholds []float64) []*ThresholdMetrics {
+	var results []*ThresholdMetrics
+	for _, threshold := range thresholds {
+		metrics := &ThresholdMetrics{Threshold: threshold}
+		for idx, example := range examples {
+			predicted := predictions[idx] >= threshold
+			switch {
+			case predicted && example.Label:
+				metrics.TP += 1
+			case predicted && !example.Label:
+				metrics.FP += 1
+			case !predicted && example.Label:
+				metrics.FN += 1
+			default:
+				metrics.TN += 1
+			}
+		}
+		if metrics.TP+metrics.FP > 0 {
+			metrics.Precision = float64(metrics.TP) / float64(metrics.TP+metrics.FP)
+		}
+		if metrics.TP+metrics.FN > 0 {
+			metrics.Recall = float64(metrics.TP) / float64(metrics.TP+metrics.FN)
+		}
+		if metrics.Precision+metrics.Recall > 0 {
+			metrics.F1 = 2 * metrics.Precision * metrics.Recall / (metrics.Precision + metrics.Recall)
+		}
+		results = append(results, metrics)
+	}
+	return results
+}
+
+// DEFAULT_THRESHOLDS are 0.05 to 0.95 in steps of 0.05
+var DEFAULT_THRESHOLDS = func() []float64 {
+	var thresholds []float64
+	for step := 1; step < 20; step++ {
+		thresholds = append(thresholds, float64(step)*0.05)
+	}
+	return thresholds
+}()
@@ -0,0 +1,122 @@
+package classifier
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// separableExamples returns count accepts with a high first feature and count
+// rejects with a low one. The second feature is noise
+func separableExamples(count int) []*Example {
+	var examples []*Example
+	for idx := 0; idx < count; idx++ {
+		noise := float64(idx%3) / 3
+		examples = append(examples,
+			&Example{TmdbID: "a" + strconv.Itoa(idx), Features: []float64{0.8 + 0.01*float64(idx), noise}, Label: true},
+			&Example{TmdbID: "r" + strconv.Itoa(idx), Features: []float64{0.2 - 0.01*float64(idx), noise}, Label: false},
+		)
+	}
+	return examples
+}
+
+func TestTrainPredict(t *testing.T) {
+	examples := separableExamples(10)
+	model, err := Train(examples, DEFAULT_TRAIN_OPTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, example := range examples {
+		probability := model.Predict(example.Features)
+		if example.Label && probability < 0.9 || !example.Label && probability > 0.1 {
+			t.Errorf("%s (accepted %v) predicted %0.4f", example.TmdbID, example.Label, probability)
+		}
+	}
+	if model.Predict([]float64{0.5, 0}) < 0.1 || model.Predict([]float64{0.5, 0}) > 0.9 {
+		t.Errorf("midpoint predicted %0.4f, expected it to be uncertain", model.Predict([]float64{0.5, 0}))
+	}
+}
+
+// With nothing to tell the examples apart, the prediction is the rate of
+// accepts rather than 0.5
+func TestTrainCalibrated(t *testing.T) {
+	var examples []*Example
+	for idx := 0; idx < 50; idx++ {
+		examples = append(examples, &Example{Features: []float64{1, 1}, Label: idx%5 == 0})
+	}
+	model, err := Train(examples, DEFAULT_TRAIN_OPTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probability := model.Predict([]float64{1, 1}); math.Abs(probability-0.2) > 0.01 {
+		t.Errorf("predicted %0.4f, expected the accept rate 0.2", probability)
+	}
+}
+
+func TestTrainErrors(t *testing.T) {
+	if _, err := Train(nil, DEFAULT_TRAIN_OPTIONS); err == nil {
+		t.Error("expected an error without examples")
+	}
+	var accepted []*Example
+	for _, example := range separableExamples(3) {
+		if example.Label {
+			accepted = append(accepted, example)
+		}
+	}
+	if _, err := Train(accepted, DEFAULT_TRAIN_OPTIONS); err == nil {
+		t.Error("expected an error with only accepted examples")
+	}
+}
+
+func TestCrossValidate(t *testing.T) {
+	examples := separableExamples(10)
+	predictions, err := CrossValidate(examples, 4, DEFAULT_TRAIN_OPTIONS, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(predictions) != len(examples) {
+		t.Fatalf("got %d predictions for %d examples", len(predictions), len(examples))
+	}
+	for idx, example := range examples {
+		if example.Label != (predictions[idx] >= 0.5) {
+			t.Errorf("%s (accepted %v) predicted %0.4f out of fold", example.TmdbID, example.Label, predictions[idx])
+		}
+	}
+
+	again, err := CrossValidate(examples, 4, DEFAULT_TRAIN_OPTIONS, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := range predictions {
+		if predictions[idx] != again[idx] {
+			t.Fatalf("prediction %d is %f then %f with the same seed", idx, predictions[idx], again[idx])
+		}
+	}
+
+	if _, err := CrossValidate(examples, 1, DEFAULT_TRAIN_OPTIONS, 1); err == nil {
+		t.Error("expected an error for 1 fold")
+	}
+	if _, err := CrossValidate(examples, len(examples)+1, DEFAULT_TRAIN_OPTIONS, 1); err == nil {
+		t.Error("expected an error for more folds than examples")
+	}
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	examples := []*Example{{Label: true}, {Label: true}, {Label: false}, {Label: false}}
+	predictions := []float64{0.9, 0.4, 0.6, 0.1}
+	results := EvaluateThresholds(predictions, examples, []float64{0.5, 0.95})
+
+	expected := []ThresholdMetrics{
+		{Threshold: 0.5, TP: 1, FP: 1, FN: 1, TN: 1, Precision: 0.5, Recall: 0.5, F1: 0.5},
+		// nothing predicted, so no precision rather than a division by zero
+		{Threshold: 0.95, TP: 0, FP: 0, FN: 2, TN: 2},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d", len(results), len(expected))
+	}
+	for idx, result := range results {
+		if *result != expected[idx] {
+			t.Errorf("threshold %0.2f: got %+v, expected %+v", result.Threshold, *result, expected[idx])
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package decisions stores reviewer verdicts on TMDB <=> wikidata company pairs.
+//
+// Decisions are kept in a plain csv file so they can be shared and merged
+// between reviewers. Later decisions for the same pair replace earlier ones.
+package decisions
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	VERDICT_ACCEPT = "accept"
+	VERDICT_REJECT = "reject"
+)
+
+var HEADER = []string{"tmdb_id", "qid", "verdict", "reviewer", "timestamp", "note"}
+
+type Decision struct {
+	TmdbID    string
+	QID       string
+	Verdict   string
+	Reviewer  string
+	Timestamp time.Time
+	Note      string
+}
+
+// Backend keeps decisions somewhere other than a csv file, such as the
+// pipeline store
+type Backend interface {
+	Decisions() ([]*Decision, error)
+	PutDecisions(decisions []*Decision) error
+}
+
+type Store struct {
+	Path     string
+	byPair   map[string]*Decision
+	accepted map[string]*Decision // keyed by tmdb id
+	backend  Backend
+}
+
+func pairKey(tmdbID string, qid string) string {
+	return tmdbID + "|" + qid
+}
+
+func NewStore(path string) *Store {
+	return &Store{
+		Path:     path,
+		byPair:   make(map[string]*Decision),
+		accepted: make(map[string]*Decision),
+	}
+}
+
+// Load reads the decisions csv at path. A missing file gives an empty store.
+// An empty path gives an empty store that cannot be saved to.
+func Load(path string) (*Store, error) {
+	store := NewStore(path)
+	if path == "" {
+		return store, nil
+	}
+	decisions, err := ReadCSV(path)
+	if err != nil {
+		if errCast, ok := err.(*fs.PathError); ok && errCast.Err == syscall.ENOENT {
+			return store, nil // no decisions made yet
+		}
+		return nil, err
+	}
+	for _, decision := range decisions {
+		store.set(decision)
+	}
+	return store, nil
+}
+
+// LoadFrom reads the decisions of a backend, which Append then writes to
+func LoadFrom(path string, backend Backend) (*Store, error) {
+	store := NewStore(path)
+	store.backend = backend
+	decisions, err := backend.Decisions()
+	if err != nil {
+		return nil, err
+	}
+	for _, decision := range decisions {
+		store.set(decision)
+	}
+	return store, nil
+}
+
+// Save writes the current decision for every pair, to the backend or over
+// the store file
+func (s *Store) Save() error {
+	if s.backend != nil {
+		return s.backend.PutDecisions(s.All())
+	}
+	return WriteCSV(s.Path, s.All())
+}
+
+// ReadCSV reads decisions from a csv file in file order
+func ReadCSV(path string) ([]*Decision, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) < len(HEADER) || headers[0] != HEADER[0] || headers[1] != HEADER[1] {
+		return nil, fmt.Errorf("%s: invalid decisions csv header %v", path, headers)
+	}
+
+	var decisions []*Decision
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, record[4])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid timestamp for %s <=> %s: %w", path, record[0], record[1], err)
+		}
+		if record[2] != VERDICT_ACCEPT && record[2] != VERDICT_REJECT {
+			return nil, fmt.Errorf("%s: invalid verdict for %s <=> %s: %s", path, record[0], record[1], record[2])
+		}
+
+		decisions = append(decisions, &Decision{
+			TmdbID:    record[0],
+			QID:       record[1],
+			Verdict:   record[2],
+			Reviewer:  record[3],
+			Timestamp: timestamp,
+			Note:      record[5],
+		})
+	}
+
+	return decisions, nil
+}
+
+// set keeps the decision if it is newer than the existing decision for the pair
+func (s *Store) set(decision *Decision) bool {
+	key := pairKey(decision.TmdbID, decision.QID)
+	if existing, exists := s.byPair[key]; exists && existing.Timestamp.After(decision.Timestamp) {
+		return false
+	}
+	s.byPair[key] = decision
+
+	if decision.Verdict == VERDICT_ACCEPT {
+		s.accepted[decision.TmdbID] = decision
+	} else if accepted := s.accepted[decision.TmdbID]; accepted != nil && accepted.QID == decision.QID {
+		delete(s.accepted, decision.TmdbID)
+	}
+	return true
+}
+
+func (s *Store) Get(tmdbID string, qid string) *Decision {
+	return s.byPair[pairKey(tmdbID, qid)]
+}
+
+func (s *Store) IsRejected(tmdbID string, qid string) bool {
+	decision := s.Get(tmdbID, qid)
+	return decision != nil && decision.Verdict == VERDICT_REJECT
+}
+
+func (s *Store) IsAccepted(tmdbID string, qid string) bool {
+	decision := s.Get(tmdbID, qid)
+	return decision != nil && decision.Verdict == VERDICT_ACCEPT
+}
+
+// Accepted returns the accepted decision for a TMDB company, or nil
+func (s *Store) Accepted(tmdbID string) *Decision {
+	return s.accepted[tmdbID]
+}
+
+func (s *Store) Len() int {
+	return len(s.byPair)
+}
+
+// All returns the current decision for every pair ordered by timestamp
+func (s *Store) All() []*Decision {
+	decisions := make([]*Decision, 0, len(s.byPair))
+	for _, decision := range s.byPair {
+		decisions = append(decisions, decision)
+	}
+	sort.Slice(decisions, func(i int, j int) bool {
+		d1 := decisions[i]
+		d2 := decisions[j]
+		if !d1.Timestamp.Equal(d2.Timestamp) {
+			return d1.Timestamp.Before(d2.Timestamp)
+		}
+		return pairKey(d1.TmdbID, d1.QID) < pairKey(d2.TmdbID, d2.QID)
+	})
+	return decisions
+}
+
+// Append records a decision and appends it to the store file
+func (s *Store) Append(decision *Decision) error {
+	if s.backend != nil {
+		if err := s.backend.PutDecisions([]*Decision{decision}); err != nil {
+			return err
+		}
+		s.set(decision)
+		return nil
+	}
+	if s.Path == "" {
+		return fmt.Errorf("decisions store has no path")
+	}
+
+	_, err := os.Stat(s.Path)
+	writeHeader := os.IsNotExist(err)
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	if writeHeader {
+		err = csvWriter.Write(HEADER)
+		if err != nil {
+			return err
+		}
+	}
+	err = csvWriter.Write(decision.record())
+	if err != nil {
+		return err
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	s.set(decision)
+	return nil
+}
+
+// Merge adds decisions from another reviewer, returning how many were newer
+func (s *Store) Merge(decisions []*Decision) int {
+	updated := 0
+	for _, decision := range decisions {
+		if existing := s.Get(decision.TmdbID, decision.QID); existing != nil && existing.Equal(decision) {
+			continue
+		}
+		if s.set(decision) {
+			updated += 1
+		}
+	}
+	return updated
+}
+
+// Equal reports whether two decisions are the same, with the timestamps
+// compared as instants
+func (d *Decision) Equal(other *Decision) bool {
+	return d.TmdbID == other.TmdbID &&
+		d.QID == other.QID &&
+		d.Verdict == other.Verdict &&
+		d.Reviewer == other.Reviewer &&
+		d.Timestamp.Equal(other.Timestamp) &&
+		d.Note == other.Note
+}
+
+func (d *Decision) record() []string {
+	return []string{
+		d.TmdbID,
+		d.QID,
+		d.Verdict,
+		d.Reviewer,
+		d.Timestamp.UTC().Format(time.RFC3339),
+		d.Note,
+	}
+}
+
+// WriteCSV writes decisions to path, replacing the file
+func WriteCSV(path string, decisions []*Decision) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write(HEADER)
+	if err != nil {
+		return err
+	}
+
+	for _, decision := range decisions {
+		err = csvWriter.Write(decision.record())
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
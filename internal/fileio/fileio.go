@@ -0,0 +1,94 @@
+// Package fileio has the helpers the steps share for reading their csv and
+// json lines files
+package fileio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// JSONLines reads a file of one json object per line, gzipped when the path
+// ends in .gz, like the TMDB and wikidata company lists
+type JSONLines struct {
+	toClose []io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+func (jl *JSONLines) Load(path string) error {
+	if len(jl.toClose) > 0 {
+		jl.Close()
+	}
+
+	var reader io.ReadCloser
+	reader, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	jl.toClose = append(jl.toClose, reader)
+
+	if strings.HasSuffix(path, ".gz") {
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		jl.toClose = append(jl.toClose, reader)
+	}
+	jl.scanner = bufio.NewScanner(reader)
+
+	return nil
+}
+
+func (jl *JSONLines) Close() {
+	for idx := len(jl.toClose) - 1; idx >= 0; idx-- {
+		jl.toClose[idx].Close()
+	}
+	jl.toClose = nil
+	jl.scanner = nil
+}
+
+func (jl *JSONLines) Next(item interface{}) error {
+	if !jl.scanner.Scan() {
+		err := jl.scanner.Err()
+		jl.Close()
+		if err == nil {
+			return io.EOF
+		}
+		return fmt.Errorf("scanner: %w", err)
+	}
+
+	line := jl.scanner.Bytes()
+
+	err := json.Unmarshal(line, item)
+	if err != nil {
+		jl.Close()
+		return fmt.Errorf("json: %w", err)
+	}
+	return nil
+}
+
+// FindInSlice returns the index of needle in haystack, or -1. Used to find
+// csv columns by their header
+func FindInSlice(haystack []string, needle string) int {
+	for idx, hay := range haystack {
+		if hay == needle {
+			return idx
+		}
+	}
+	return -1
+}
+
+// FindAnyInSlice returns the index of the first of haystack that is any of
+// needles, or -1. Used to find csv columns that have had several names
+func FindAnyInSlice(haystack []string, needles ...string) int {
+	for idx, hay := range haystack {
+		if FindInSlice(needles, hay) != -1 {
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,120 @@
+package matching
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+// 014 lists the candidates it found by their media next to the title compare
+// csv it writes, so 004 can tell them from the ones found by name
+const MEDIA_CANDIDATES_SUFFIX = ".media_candidates.csv"
+
+// MediaCandidates holds the common works of each candidate found by its
+// media, by TMDB company ID then QID
+type MediaCandidates map[string]map[string]int
+
+func (m MediaCandidates) Add(tmdbID string, qid string, commonCount int) {
+	if m[tmdbID] == nil {
+		m[tmdbID] = make(map[string]int)
+	}
+	m[tmdbID][qid] = commonCount
+}
+
+func (m MediaCandidates) Has(tmdbID string, qid string) bool {
+	_, exists := m[tmdbID][qid]
+	return exists
+}
+
+// LoadMediaCandidates reads the media candidates listed next to a title
+// compare csv. There are none when 014 did not write the title compare csv
+func LoadMediaCandidates(titleComparePath string) (MediaCandidates, error) {
+	var candidates = make(MediaCandidates)
+	f, err := os.Open(titleComparePath + MEDIA_CANDIDATES_SUFFIX)
+	if os.IsNotExist(err) {
+		return candidates, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	qidIdx := fileio.FindInSlice(headers, "qid")
+	countIdx := fileio.FindInSlice(headers, "common_media_count")
+	if tmdbIDIdx == -1 || qidIdx == -1 || countIdx == -1 {
+		return nil, fmt.Errorf("%s is missing a column", titleComparePath+MEDIA_CANDIDATES_SUFFIX)
+	}
+
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		commonCount, err := strconv.Atoi(record[countIdx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid common media count %s for %s", record[countIdx], record[tmdbIDIdx])
+		}
+		candidates.Add(record[tmdbIDIdx], record[qidIdx], commonCount)
+	}
+	return candidates, nil
+}
+
+// SaveMediaCandidates writes the media candidates next to a title compare csv
+func SaveMediaCandidates(candidates MediaCandidates, titleComparePath string) error {
+	path := titleComparePath + MEDIA_CANDIDATES_SUFFIX
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{"tmdb_id", "qid", "common_media_count"})
+	if err != nil {
+		return err
+	}
+
+	var tmdbIDs []string
+	for tmdbID := range candidates {
+		tmdbIDs = append(tmdbIDs, tmdbID)
+	}
+	sort.Strings(tmdbIDs)
+	for _, tmdbID := range tmdbIDs {
+		var qids []string
+		for qid := range candidates[tmdbID] {
+			qids = append(qids, qid)
+		}
+		sort.Strings(qids)
+		for _, qid := range qids {
+			err = csvWriter.Write([]string{tmdbID, qid, strconv.Itoa(candidates[tmdbID][qid])})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
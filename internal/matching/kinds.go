@@ -0,0 +1,100 @@
+package matching
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+type WorkKind struct {
+	Name string
+	QID  string
+	// TMDB media type expected for the kind, empty when there is none
+	MediaType string
+}
+
+// Classes the instance of (P31) of a work is matched against, including
+// subclasses. A work can match several, the most specific are first.
+var WORK_KINDS = []WorkKind{
+	{Name: "tv_episode", QID: "Q21191270", MediaType: "tv"},
+	{Name: "tv_season", QID: "Q3464665", MediaType: "tv"},
+	{Name: "tv_series", QID: "Q5398426", MediaType: "tv"},
+	{Name: "tv_film", QID: "Q506240", MediaType: "movie"},
+	{Name: "short_film", QID: "Q24862", MediaType: "movie"},
+	{Name: "film", QID: "Q11424", MediaType: "movie"},
+	{Name: "video_game", QID: "Q7889"},
+	{Name: "audiovisual_work", QID: "Q2431196"},
+}
+
+func KindByQID(qid string) *WorkKind {
+	for idx := range WORK_KINDS {
+		if WORK_KINDS[idx].QID == qid {
+			return &WORK_KINDS[idx]
+		}
+	}
+	return nil
+}
+
+func KindByName(name string) *WorkKind {
+	for idx := range WORK_KINDS {
+		if WORK_KINDS[idx].Name == name {
+			return &WORK_KINDS[idx]
+		}
+	}
+	return nil
+}
+
+// TypeFinding checks a TMDB media type for a work against the WORK_KINDS names
+// of its class, returning an empty string when they agree or the class is not
+// known
+func TypeFinding(kinds []string, mediaType string) string {
+	if len(kinds) == 0 || mediaType == "" {
+		return ""
+	}
+	var expected []string
+	for _, name := range kinds {
+		if kind := KindByName(name); kind != nil && kind.MediaType != "" && fileio.FindInSlice(expected, kind.MediaType) == -1 {
+			expected = append(expected, kind.MediaType)
+		}
+	}
+	switch {
+	case fileio.FindInSlice(expected, mediaType) != -1:
+		return ""
+	case fileio.FindInSlice(kinds, "video_game") != -1 && len(expected) == 0:
+		return "video_game_with_tmdb_id"
+	case mediaType == "movie" && fileio.FindInSlice(expected, "tv") != -1:
+		return "tv_work_with_movie_id"
+	case mediaType == "tv" && fileio.FindInSlice(expected, "movie") != -1:
+		return "film_with_tv_id"
+	}
+	return ""
+}
+
+// Kinds returns the WORK_KINDS names of the class of a wikidata work
+func (t MediaTitle) Kinds() []string {
+	if t.Class == "" {
+		return nil
+	}
+	return strings.Split(t.Class, ";")
+}
+
+// only a few combinations of kinds occur, so works share their class strings
+var classes = struct {
+	sync.Mutex
+	seen map[string]string
+}{seen: map[string]string{}}
+
+func internClass(class string) string {
+	if class == "" {
+		return ""
+	}
+	classes.Lock()
+	defer classes.Unlock()
+	if interned, ok := classes.seen[class]; ok {
+		return interned
+	}
+	interned := strings.Clone(class)
+	classes.seen[interned] = interned
+	return interned
+}
@@ -0,0 +1,223 @@
+package matching
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+// Company is a company from a 002 (TMDB) or 003 (wikidata) media mapping
+type Company struct {
+	ID    string
+	Name  string
+	Media MediaSet
+	// Release years of the media
+	Years []int
+	// ISO 3166-1 alpha-2 country codes
+	Countries []string
+	Websites  []string
+	// TMDB company IDs (P11806) already on the wikidata company
+	LinkedTmdbIDs []string
+	// Titles of the media with a TMDB id, one for each id of a wikidata work
+	Titles []MediaTitle
+	// Wikidata works without any TMDB id, matched by title instead
+	UnlinkedWorks []MediaTitle
+	unlinked      map[string]bool
+}
+
+// MinYear returns the earliest media release year or 0 if none are known
+func (c *Company) MinYear() int {
+	minYear := 0
+	for _, year := range c.Years {
+		if minYear == 0 || year < minYear {
+			minYear = year
+		}
+	}
+	return minYear
+}
+
+// Wikidata production company property
+const PRODUCTION_COMPANY = "P272"
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.Clone(s), ";")
+}
+
+// LoadMediaMappingCSV loads a 002 or 003 media mapping keyed by company id.
+// Companies without media are included so their details can be compared.
+func LoadMediaMappingCSV(path string) (map[string]*Company, error) {
+	return LoadMediaMappingCSVFor(path, nil)
+}
+
+// LoadMediaMappingCSVFor loads only the companies in companyIDs, or all of them
+// when it is nil. The rows are streamed, so memory grows with the companies
+// kept rather than with the size of the mapping.
+func LoadMediaMappingCSVFor(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	// the fields of a record share one string, so the fields that are kept
+	// are cloned to not hold on to the whole row
+	csvReader.ReuseRecord = true
+	headers, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) < 6 {
+		return nil, fmt.Errorf("%s: invalid media mapping header %v", path, headers)
+	}
+
+	// tmdb and wikidata mappings name their details differently, older files do not have them
+	countryIdx := fileio.FindAnyInSlice(headers, "origin_country", "country")
+	websiteIdx := fileio.FindAnyInSlice(headers, "homepage", "website")
+	linkedIdx := fileio.FindInSlice(headers, "tmdb_company_ids")
+	// the wikidata mapping has a row for each TMDB id of a work since version 2
+	qidIdx := fileio.FindInSlice(headers, "qid")
+	// the wikidata mapping records what links each work to the company since
+	// the dump mode also keeps distributors and broadcasters
+	propertyIdx := fileio.FindInSlice(headers, "property")
+	classIdx := fileio.FindInSlice(headers, "class")
+
+	var companies = make(map[string]*Company)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		companyID := record[0]
+		if companyID == "" || companyIDs != nil && !companyIDs[companyID] {
+			continue
+		}
+
+		company, exists := companies[companyID]
+		if !exists {
+			company = &Company{
+				ID:   strings.Clone(companyID),
+				Name: strings.Clone(record[1]),
+			}
+			if countryIdx != -1 {
+				company.Countries = splitList(record[countryIdx])
+			}
+			if websiteIdx != -1 {
+				company.Websites = splitList(record[websiteIdx])
+			}
+			if linkedIdx != -1 {
+				company.LinkedTmdbIDs = splitList(record[linkedIdx])
+			}
+			companies[companyID] = company
+		}
+
+		if propertyIdx != -1 && !IsProduction(record[propertyIdx]) {
+			continue
+		}
+		work := ""
+		if qidIdx != -1 {
+			work = record[qidIdx]
+		}
+		class := ""
+		if classIdx != -1 {
+			class = record[classIdx]
+		}
+		company.addMedia(record[2], record[3], record[4], record[5], work, class)
+	}
+
+	for _, company := range companies {
+		company.compact()
+	}
+	return companies, nil
+}
+
+// IsProduction reports whether the properties of a wikidata mapping row link
+// the work to the company as production company (P272), the only one the
+// query service mode follows and the one TMDB production_companies compares
+// to. Rows without properties come from the query service.
+func IsProduction(properties string) bool {
+	if properties == "" {
+		return true
+	}
+	for _, property := range strings.Split(properties, ";") {
+		if property == PRODUCTION_COMPANY {
+			return true
+		}
+	}
+	return false
+}
+
+// addMedia adds a row of a media mapping. Rows without a TMDB id are works
+// that are matched by title instead.
+func (c *Company) addMedia(id string, mediaType string, name string, yearValue string, work string, class string) {
+	work = strings.Clone(work)
+	year, _ := strconv.Atoi(yearValue)
+	title := MediaTitle{
+		Title: NormalizeTitle(name),
+		Year:  year,
+		Name:  strings.Clone(name),
+		Work:  work,
+		Class: internClass(class),
+	}
+
+	if id == "" {
+		// works without a TMDB id have a row since 003 fetches them too
+		if work != "" && !c.unlinked[work] {
+			if c.unlinked == nil {
+				c.unlinked = make(map[string]bool)
+			}
+			c.unlinked[work] = true
+			c.UnlinkedWorks = append(c.UnlinkedWorks, title)
+		}
+		return
+	}
+
+	tmdbID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+
+	switch mediaType {
+	case "movie":
+		title.MediaType = "movie"
+	case "tv":
+		title.MediaType = "tv"
+	default:
+		return
+	}
+	title.TmdbID = tmdbID
+	c.Titles = append(c.Titles, title)
+	if !c.Media.Add(title.MediaType, tmdbID, work) {
+		return
+	}
+
+	if year > 0 {
+		c.Years = append(c.Years, year)
+	}
+}
+
+// compact drops the spare capacity append left on the slices, which is up to
+// half of them for the companies with the most media, and the sets only
+// needed to dedup works while loading
+func (c *Company) compact() {
+	c.unlinked = nil
+	c.Media.works = nil
+	c.Titles = append([]MediaTitle(nil), c.Titles...)
+	c.Years = append([]int(nil), c.Years...)
+	c.Media.Movies = append([]int64(nil), c.Media.Movies...)
+	c.Media.TV = append([]int64(nil), c.Media.TV...)
+	c.Media.MovieWorks = append([]string(nil), c.Media.MovieWorks...)
+	c.Media.TVWorks = append([]string(nil), c.Media.TVWorks...)
+}
@@ -0,0 +1,82 @@
+package matching
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/testutil"
+)
+
+// Size of the full TMDB media mapping, see large inputs in the README
+const BENCH_COMPANIES = 150000
+const BENCH_ROWS_PER_COMPANY = 20
+
+// Every nth company is a candidate, as for a part of 004
+const BENCH_CANDIDATE_EVERY = 10
+
+// Live heap allowed for each row kept and for the rest, checked after a
+// collection so the rows read and dropped do not count. A kept row holds
+// about 200 bytes. Memory grows with the candidates, not the mapping
+const MAPPING_HEAP_PER_ROW = 250
+const MAPPING_HEAP_BASE = 4 << 20
+
+func writeBenchMapping(b *testing.B) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "tmdb_media_mapping.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	csvWriter := csv.NewWriter(f)
+	err = csvWriter.Write([]string{"company_id", "company_name", "id", "type", "title", "year", "popularity", "poster", "origin_country", "logo_path", "homepage"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for company := 1; company <= BENCH_COMPANIES; company++ {
+		companyID := strconv.Itoa(company)
+		for media := 0; media < BENCH_ROWS_PER_COMPANY; media++ {
+			mediaID := strconv.Itoa(company*BENCH_ROWS_PER_COMPANY + media)
+			err := csvWriter.Write([]string{companyID, "Company " + companyID, mediaID, "movie", "Title " + mediaID, "2001", "10", "", "US", "", ""})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func BenchmarkLoadMediaMappingCSVFor(b *testing.B) {
+	path := writeBenchMapping(b)
+	var companyIDs = make(map[string]bool)
+	for company := BENCH_CANDIDATE_EVERY; company <= BENCH_COMPANIES; company += BENCH_CANDIDATE_EVERY {
+		companyIDs[strconv.Itoa(company)] = true
+	}
+	keptRows := uint64(len(companyIDs) * BENCH_ROWS_PER_COMPANY)
+
+	heap := &testutil.HeapLimit{Limit: MAPPING_HEAP_BASE + keptRows*MAPPING_HEAP_PER_ROW}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		companies, err := LoadMediaMappingCSVFor(path, companyIDs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		heap.Checkpoint(b)
+		// the companies are measured while they are still in use
+		runtime.KeepAlive(companies)
+		if len(companies) != len(companyIDs) {
+			b.Fatalf("loaded %d companies, expected %d", len(companies), len(companyIDs))
+		}
+	}
+	b.StopTimer()
+	heap.Check(b)
+}
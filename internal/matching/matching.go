@@ -0,0 +1,251 @@
+// Package matching has the name and media comparisons shared by the pipeline stages
+package matching
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/adrg/strutil"
+	"github.com/adrg/strutil/metrics"
+)
+
+var COMPARE_METRIC = metrics.Levenshtein{
+	CaseSensitive: true,
+	InsertCost:    1,
+	ReplaceCost:   2,
+	DeleteCost:    1,
+}
+
+func NormalizeName(s string) string {
+	s = strings.ToLower(s)
+	s = strings.ReplaceAll(s, ".", "")
+	s = strings.ReplaceAll(s, " ltd", " ")
+	s = strings.ReplaceAll(s, " limited", " ")
+	s = strings.ReplaceAll(s, " gmbh", " ")
+	s = strings.ReplaceAll(s, " productions", " PROD")
+	s = strings.ReplaceAll(s, " production", " PROD")
+	s = strings.ReplaceAll(s, " international", " INT")
+	s = strings.ReplaceAll(s, " corporation", " CORP")
+	s = strings.ReplaceAll(s, " entertainment", " ENM")
+	return s
+}
+
+// CompareNames scores the similarity of two normalized names between 0 and 1
+func CompareNames(a string, b string) float64 {
+	lena := len(a)
+	lenb := len(b)
+	if lena > (lenb+10) || lena < (lenb-10) {
+		return 0 // Hard fail
+	}
+	score := strutil.Similarity(a, b, &COMPARE_METRIC)
+	return score
+}
+
+// Years a release can differ by between TMDB and wikidata, eg festival and general release
+const FUZZY_YEAR_TOLERANCE = 1
+
+// NormalizeTitle lowercases a title and keeps only its letters and digits,
+// separated by single spaces
+func NormalizeTitle(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// MediaTitle is the normalized title and release year of a media or work
+type MediaTitle struct {
+	Title string
+	Year  int
+	// title as written in the mapping
+	Name string
+	// wikidata work, empty for TMDB media
+	Work string
+	// WORK_KINDS names of the class of the work separated by ;, as in the
+	// class column of the wikidata mapping
+	Class string
+	// TMDB id of the media, empty for a work without one
+	MediaType string
+	TmdbID    int64
+}
+
+// sameRelease reports whether two titles match and their years are close enough
+func sameRelease(a MediaTitle, b MediaTitle) bool {
+	if a.Title == "" || a.Title != b.Title || a.Year == 0 || b.Year == 0 {
+		return false
+	}
+	return a.Year >= b.Year-FUZZY_YEAR_TOLERANCE && a.Year <= b.Year+FUZZY_YEAR_TOLERANCE
+}
+
+// TitleMatch is a TMDB media paired with a wikidata work by title and year
+type TitleMatch struct {
+	Tmdb MediaTitle
+	Work MediaTitle
+}
+
+// indexTitles gives the positions of each normalized title, so pairing by
+// title does not compare every title with every other
+func indexTitles(titles []MediaTitle) map[string][]int {
+	var index = make(map[string][]int)
+	for idx, title := range titles {
+		if title.Title != "" {
+			index[title.Title] = append(index[title.Title], idx)
+		}
+	}
+	return index
+}
+
+// FuzzyMatches pairs the wikidata works that have no TMDB id with the TMDB
+// media by title and year. Each TMDB media is paired with one work at most.
+func FuzzyMatches(tmdb *Company, wikidata *Company) []TitleMatch {
+	if len(wikidata.UnlinkedWorks) == 0 || len(tmdb.Titles) == 0 {
+		return nil
+	}
+	byTitle := indexTitles(tmdb.Titles)
+
+	var matches []TitleMatch
+	var used = make(map[int]bool)
+	for _, work := range wikidata.UnlinkedWorks {
+		for _, idx := range byTitle[work.Title] {
+			if used[idx] || !sameRelease(tmdb.Titles[idx], work) {
+				continue
+			}
+			used[idx] = true
+			matches = append(matches, TitleMatch{Tmdb: tmdb.Titles[idx], Work: work})
+			break
+		}
+	}
+	return matches
+}
+
+// FuzzyCommon scores the FuzzyMatches, as weaker evidence than common ids. It
+// returns the matches over the smaller of the two counts and the number of matches.
+func FuzzyCommon(tmdb *Company, wikidata *Company) (float64, int) {
+	smaller := len(tmdb.Titles)
+	if len(wikidata.UnlinkedWorks) < smaller {
+		smaller = len(wikidata.UnlinkedWorks)
+	}
+	if smaller == 0 {
+		return 0, 0
+	}
+	matches := len(FuzzyMatches(tmdb, wikidata))
+	return float64(matches) / float64(smaller), matches
+}
+
+// FuzzyConflicts pairs the TMDB media that are not on any wikidata work with
+// the works of the same title and year that already have a different TMDB id
+// of the same type, one pair for each work
+func FuzzyConflicts(tmdb *Company, wikidata *Company) []TitleMatch {
+	var linked = make(map[string]bool)
+	for _, title := range wikidata.Titles {
+		linked[title.MediaType+":"+strconv.FormatInt(title.TmdbID, 10)] = true
+	}
+
+	byTitle := indexTitles(wikidata.Titles)
+	var conflicts []TitleMatch
+	var seen = make(map[string]bool)
+	for _, title := range tmdb.Titles {
+		key := title.MediaType + ":" + strconv.FormatInt(title.TmdbID, 10)
+		if linked[key] {
+			continue
+		}
+		for _, idx := range byTitle[title.Title] {
+			work := wikidata.Titles[idx]
+			if work.MediaType != title.MediaType || seen[key+"/"+work.Work] || !sameRelease(title, work) {
+				continue
+			}
+			seen[key+"/"+work.Work] = true
+			conflicts = append(conflicts, TitleMatch{Tmdb: title, Work: work})
+		}
+	}
+	return conflicts
+}
+
+// MediaSet is the TMDB movie and tv ids linked to a company
+type MediaSet struct {
+	Movies []int64
+	TV     []int64
+	// Number of works, a wikidata work can have several TMDB ids
+	Count int
+	// Wikidata work of each of Movies and TV, empty for the tmdb mapping
+	MovieWorks []string
+	TVWorks    []string
+	works      map[string]bool
+}
+
+// Add adds a TMDB id of a work, or of a TMDB title when work is empty, and
+// reports whether it is the first id of the work
+func (m *MediaSet) Add(mediaType string, tmdbID int64, work string) bool {
+	if mediaType == "movie" {
+		m.Movies = append(m.Movies, tmdbID)
+		m.MovieWorks = append(m.MovieWorks, work)
+	} else {
+		m.TV = append(m.TV, tmdbID)
+		m.TVWorks = append(m.TVWorks, work)
+	}
+	if work != "" {
+		if m.works[work] {
+			return false
+		}
+		if m.works == nil {
+			m.works = make(map[string]bool)
+		}
+		m.works[work] = true
+	}
+	m.Count += 1
+	return true
+}
+
+// workOf returns the work an id belongs to, or the id itself when it has none
+func workOf(works []string, idx int, mediaType string, tmdbID int64) string {
+	if idx < len(works) && works[idx] != "" {
+		return works[idx]
+	}
+	return mediaType + ":" + strconv.FormatInt(tmdbID, 10)
+}
+
+// OverlapCoeff returns the overlap coefficient of two media sets and the
+// number of media in common. A work is common if any of its ids match.
+func OverlapCoeff(tmdbMapping *MediaSet, wikidataMapping *MediaSet) (float64, int) {
+	var union int
+	if tmdbMapping.Count > wikidataMapping.Count {
+		union = wikidataMapping.Count
+	} else {
+		union = tmdbMapping.Count
+	}
+	if union == 0 {
+		return 0, 0 // avoid a divide by zero error
+	}
+
+	var tmdbCommon = make(map[string]bool)
+	var wikidataCommon = make(map[string]bool)
+	for i, tmdbID := range tmdbMapping.Movies {
+		for j, wdTmdbID := range wikidataMapping.Movies {
+			if tmdbID == wdTmdbID {
+				tmdbCommon[workOf(tmdbMapping.MovieWorks, i, "movie", tmdbID)] = true
+				wikidataCommon[workOf(wikidataMapping.MovieWorks, j, "movie", wdTmdbID)] = true
+			}
+		}
+	}
+	for i, tmdbID := range tmdbMapping.TV {
+		for j, wdTmdbID := range wikidataMapping.TV {
+			if tmdbID == wdTmdbID {
+				tmdbCommon[workOf(tmdbMapping.TVWorks, i, "tv", tmdbID)] = true
+				wikidataCommon[workOf(wikidataMapping.TVWorks, j, "tv", wdTmdbID)] = true
+			}
+		}
+	}
+	// two works with the same id, or one work matching two titles, count once
+	intersection := len(tmdbCommon)
+	if len(wikidataCommon) < intersection {
+		intersection = len(wikidataCommon)
+	}
+
+	// union = wikidataMapping.Count + tmdbMapping.Count - intersection
+	// if union == 0 {
+	// 	return 0, 0 // avoid a divide by zero error
+	// }
+	// return float64(intersection) / float64(union), intersection
+	return float64(intersection) / float64(union), intersection
+}
@@ -0,0 +1,85 @@
+package matching
+
+import (
+	"testing"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	cases := map[string]string{
+		"Star Wars: Episode IV – A New Hope": "star wars episode iv a new hope",
+		"  WALL·E ":                          "wall e",
+		"Amélie":                             "amélie",
+		"2001: A Space Odyssey":              "2001 a space odyssey",
+		"...":                                "",
+	}
+	for title, expected := range cases {
+		if normalized := NormalizeTitle(title); normalized != expected {
+			t.Errorf("NormalizeTitle(%q) = %q, expected %q", title, normalized, expected)
+		}
+	}
+}
+
+// fuzzyCompanies returns a TMDB company and a wikidata company with works
+// that have no TMDB id, as loaded from the mappings
+func fuzzyCompanies() (*Company, *Company) {
+	tmdb := &Company{ID: "1"}
+	tmdb.addMedia("11", "movie", "The Matrix", "1999", "", "")
+	tmdb.addMedia("12", "movie", "Alien", "1979", "", "")
+	tmdb.addMedia("13", "movie", "Heat", "1995", "", "")
+	tmdb.addMedia("14", "tv", "Twin Peaks", "1990", "", "")
+	tmdb.addMedia("15", "movie", "Undated", "", "", "")
+	tmdb.compact()
+
+	wikidata := &Company{ID: "Q1"}
+	// punctuation and case differ, a year apart
+	wikidata.addMedia("", "", "the matrix!", "2000", "Q11", "film")
+	// two years apart
+	wikidata.addMedia("", "", "Alien", "1981", "Q12", "film")
+	// two works for one TMDB media, the first is paired
+	wikidata.addMedia("", "", "Heat", "1995", "Q13", "film")
+	wikidata.addMedia("", "", "Heat", "1996", "Q130", "film")
+	wikidata.addMedia("", "", "Twin Peaks", "1990", "Q14", "tv_series")
+	wikidata.addMedia("", "", "Undated", "", "Q15", "film")
+	// already has a TMDB id, so it is not matched by title
+	wikidata.addMedia("99", "movie", "The Matrix", "1999", "Q16", "film")
+	wikidata.compact()
+	return tmdb, wikidata
+}
+
+func TestFuzzyMatches(t *testing.T) {
+	tmdb, wikidata := fuzzyCompanies()
+	var paired = make(map[string]int64)
+	for _, match := range FuzzyMatches(tmdb, wikidata) {
+		if _, exists := paired[match.Work.Work]; exists {
+			t.Errorf("%s paired twice", match.Work.Work)
+		}
+		paired[match.Work.Work] = match.Tmdb.TmdbID
+	}
+
+	expected := map[string]int64{"Q11": 11, "Q13": 13, "Q14": 14}
+	if len(paired) != len(expected) {
+		t.Errorf("paired %v, expected %v", paired, expected)
+	}
+	for work, tmdbID := range expected {
+		if paired[work] != tmdbID {
+			t.Errorf("%s paired with %d, expected %d", work, paired[work], tmdbID)
+		}
+	}
+
+	score, count := FuzzyCommon(tmdb, wikidata)
+	// 3 of the 5 TMDB media, the smaller count
+	if count != 3 || score != 0.6 {
+		t.Errorf("FuzzyCommon = %0.4f, %d, expected 0.6000, 3", score, count)
+	}
+}
+
+func TestFuzzyConflicts(t *testing.T) {
+	tmdb, wikidata := fuzzyCompanies()
+	conflicts := FuzzyConflicts(tmdb, wikidata)
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts, expected 1: %+v", len(conflicts), conflicts)
+	}
+	if conflicts[0].Tmdb.TmdbID != 11 || conflicts[0].Work.Work != "Q16" || conflicts[0].Work.TmdbID != 99 {
+		t.Errorf("got %+v, expected TMDB 11 against Q16 with 99", conflicts[0])
+	}
+}
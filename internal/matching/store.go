@@ -0,0 +1,89 @@
+package matching
+
+import (
+	"os"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/store"
+)
+
+// detail returns the first of the columns the company has a value for, the
+// store keeps the details under their csv column names
+func detail(company *store.Company, columns ...string) string {
+	for _, column := range columns {
+		if value := company.Details[column]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func fromStore(stored *store.Company) *Company {
+	company := &Company{
+		ID:            stored.ID,
+		Name:          stored.Name,
+		Countries:     splitList(detail(stored, "origin_country", "country")),
+		Websites:      splitList(detail(stored, "homepage", "website")),
+		LinkedTmdbIDs: splitList(detail(stored, "tmdb_company_ids")),
+	}
+	for _, media := range stored.Media {
+		if !IsProduction(media.Property) {
+			continue
+		}
+		company.addMedia(media.ID, media.Type, media.Title, media.Year, media.QID, media.Class)
+	}
+	company.compact()
+	return company
+}
+
+// LoadMediaMappingStore loads the companies of source in companyIDs from a
+// store, or all of them when it is nil. Only the companies asked for are read.
+func LoadMediaMappingStore(db *store.Store, source string, companyIDs map[string]bool) (map[string]*Company, error) {
+	var companies = make(map[string]*Company)
+	if companyIDs == nil {
+		err := db.ForEachCompany(source, func(stored *store.Company) error {
+			companies[stored.ID] = fromStore(stored)
+			return nil
+		})
+		return companies, err
+	}
+
+	for companyID := range companyIDs {
+		stored, err := db.Company(source, companyID)
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			companies[companyID] = fromStore(stored)
+		}
+	}
+	return companies, nil
+}
+
+// loadMediaMapping loads from a csv, or from a store for a path ending in .db
+func loadMediaMapping(path string, source string, companyIDs map[string]bool) (map[string]*Company, error) {
+	if !store.IsStorePath(path) {
+		return LoadMediaMappingCSVFor(path, companyIDs)
+	}
+	// opening creates the store, which would read as an empty mapping
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return LoadMediaMappingStore(db, source, companyIDs)
+}
+
+// LoadTmdbMediaMapping loads a 002 media mapping csv or store, see
+// LoadMediaMappingCSVFor
+func LoadTmdbMediaMapping(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	return loadMediaMapping(path, store.SOURCE_TMDB, companyIDs)
+}
+
+// LoadWikidataMediaMapping loads a 003 media mapping csv or store, see
+// LoadMediaMappingCSVFor
+func LoadWikidataMediaMapping(path string, companyIDs map[string]bool) (map[string]*Company, error) {
+	return loadMediaMapping(path, store.SOURCE_WIKIDATA, companyIDs)
+}
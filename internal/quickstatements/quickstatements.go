@@ -0,0 +1,14 @@
+// Package quickstatements holds the reference values 004 and 005 add to the
+// statements in their QuickStatements batches
+package quickstatements
+
+import "time"
+
+// Reference values added to every statement
+const STATED_IN_TMDB = "Q20828898"    // The Movie Database
+const DEFAULT_HEURISTIC = "Q69652283" // inferred from name / title matching
+
+// FormatRetrievedDate formats a date as a wikidata time value with day precision
+func FormatRetrievedDate(t time.Time) string {
+	return "+" + t.Format("2006-01-02") + "T00:00:00Z/11"
+}
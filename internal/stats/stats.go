@@ -0,0 +1,114 @@
+// Package stats measures the run time and memory of a step for -stats, to
+// check a step stays within the memory of a small VM
+package stats
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// How often the heap is sampled for its peak, between garbage collections
+const SAMPLE_INTERVAL = 50 * time.Millisecond
+
+// Bytes of heap objects, reachable or not yet swept
+const METRIC_HEAP_OBJECTS = "/memory/classes/heap/objects:bytes"
+
+type Run struct {
+	Name     string
+	start    time.Time
+	done     chan bool
+	wg       sync.WaitGroup
+	lock     sync.Mutex
+	stopped  bool
+	peakHeap uint64
+}
+
+// gcSentinel is collected in every garbage collection, its finalizer samples
+// the heap and sets up the next one. It is bigger than the tiny allocator
+// size, as finalizers of tiny objects may never run
+type gcSentinel struct {
+	run *Run
+	_   [16]byte
+}
+
+func (r *Run) watchGC() {
+	runtime.SetFinalizer(&gcSentinel{run: r}, func(sentinel *gcSentinel) {
+		if !sentinel.run.sample() {
+			sentinel.run.watchGC()
+		}
+	})
+}
+
+// Start samples the heap after every garbage collection, when it has just
+// peaked, and in between until Report is called
+func Start(name string) *Run {
+	run := &Run{
+		Name:  name,
+		start: time.Now(),
+		done:  make(chan bool),
+	}
+	run.watchGC()
+	run.wg.Add(1)
+	go func() {
+		defer run.wg.Done()
+		ticker := time.NewTicker(SAMPLE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			run.sample()
+			select {
+			case <-run.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return run
+}
+
+// sample records the heap and reports whether the run has stopped
+func (r *Run) sample() bool {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if mem.HeapAlloc > r.peakHeap {
+		r.peakHeap = mem.HeapAlloc
+	}
+	return r.stopped
+}
+
+func (r *Run) stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.sample()
+	r.lock.Lock()
+	r.stopped = true
+	r.lock.Unlock()
+}
+
+// Report stops sampling and prints the run time, the peak heap and the memory
+// taken from the OS, which is what the VM has to have
+func (r *Run) Report() {
+	r.stop()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Printf("STATS %s: %s, peak heap %d MB, from OS %d MB\n",
+		r.Name,
+		time.Since(r.start).Round(time.Millisecond),
+		r.peakHeap/1024/1024,
+		mem.Sys/1024/1024)
+}
+
+// LiveHeap collects garbage and returns the bytes of the heap objects still
+// reachable. Unlike the sampled peak it does not depend on when the collector
+// last ran, so benchmarks check it against their limits
+func LiveHeap() uint64 {
+	// runtime.GC returns once every span is swept, so only live objects remain
+	runtime.GC()
+	sample := []metrics.Sample{{Name: METRIC_HEAP_OBJECTS}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+// Company level columns written after the media columns of each mapping layout
+var DETAIL_COLUMNS = map[string][]string{
+	SOURCE_TMDB:     {"origin_country", "logo_path", "homepage", "truncated", "fetched_at", "pages_complete", "total_results", "details_checked"},
+	SOURCE_WIKIDATA: {"tmdb_company_ids", "country", "website", "fetched_at", "details_checked", "mapping_version"},
+}
+
+// Columns that show a company's details were retrieved
+var DETAILS_CHECKED_COLUMNS = map[string][]string{
+	SOURCE_TMDB:     {"origin_country", "logo_path", "homepage"},
+	SOURCE_WIKIDATA: {"tmdb_company_ids", "country", "website"},
+}
+
+// Media columns after the poster, the wikidata mapping has the qid (version 2)
+// and class of each work
+var EXTRA_MEDIA_COLUMNS = map[string][]string{
+	SOURCE_WIKIDATA: {"qid", "class", "property"},
+}
+
+// Column 6 of the media mapping differs between the two sources
+var SOURCE_COLUMN = map[string]string{
+	SOURCE_TMDB:     "popularity",
+	SOURCE_WIKIDATA: "sitelinks",
+}
+
+func writeFile(path string, fn func(w *csv.Writer) error) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	if err := fn(csvWriter); err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// ImportMediaMappingCSV loads a media mapping written by 002 or 003, returning
+// the source detected from the header and the number of companies imported
+func (s *Store) ImportMediaMappingCSV(path string) (string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return "", 0, err
+	}
+	if len(headers) < 8 {
+		return "", 0, fmt.Errorf("%s: not a media mapping csv", path)
+	}
+
+	var source string
+	for candidate, column := range SOURCE_COLUMN {
+		if headers[6] == column {
+			source = candidate
+		}
+	}
+	if source == "" {
+		return "", 0, fmt.Errorf("%s: unknown media mapping column %s", path, headers[6])
+	}
+
+	// older files have fewer of the extra media columns
+	extraColumns := 0
+	for _, column := range EXTRA_MEDIA_COLUMNS[source] {
+		if len(headers) <= 8+extraColumns || headers[8+extraColumns] != column {
+			break
+		}
+		extraColumns += 1
+	}
+	detailsStart := 8 + extraColumns
+
+	detailsChecked := true
+	for _, column := range DETAILS_CHECKED_COLUMNS[source] {
+		if fileio.FindInSlice(headers, column) == -1 {
+			detailsChecked = false
+		}
+	}
+
+	var companies []*Company
+	var lut = make(map[string]*Company)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		if record[0] == "" {
+			continue
+		}
+
+		company, exists := lut[record[0]]
+		if !exists {
+			company = &Company{
+				Source:         source,
+				ID:             record[0],
+				Name:           record[1],
+				Details:        make(map[string]string),
+				DetailsChecked: detailsChecked,
+			}
+			for idx := detailsStart; idx < len(headers) && idx < len(record); idx++ {
+				company.Details[headers[idx]] = record[idx]
+			}
+			if value := company.Details["details_checked"]; value != "" {
+				company.DetailsChecked = value == "true"
+			}
+			lut[company.ID] = company
+			companies = append(companies, company)
+		}
+
+		// works without a TMDB id still have a qid
+		if record[2] == "" && (extraColumns == 0 || record[8] == "") {
+			continue
+		}
+		media := &Media{
+			ID:     record[2],
+			Type:   record[3],
+			Title:  record[4],
+			Year:   record[5],
+			Poster: record[7],
+		}
+		if extraColumns > 0 {
+			media.QID = record[8]
+		}
+		if extraColumns > 1 {
+			media.Class = record[9]
+		}
+		if extraColumns > 2 {
+			media.Property = record[10]
+		}
+		if source == SOURCE_TMDB {
+			media.Popularity = record[6]
+		} else {
+			media.Sitelinks = record[6]
+		}
+		company.Media = append(company.Media, media)
+	}
+
+	return source, len(companies), s.PutCompanies(companies)
+}
+
+// ExportMediaMappingCSV writes the companies of source in the layout used by 002 or 003
+func (s *Store) ExportMediaMappingCSV(source string, path string) error {
+	detailColumns, exists := DETAIL_COLUMNS[source]
+	if !exists {
+		return fmt.Errorf("unknown source %s", source)
+	}
+
+	return writeFile(path, func(w *csv.Writer) error {
+		headers := []string{"company_id", "company_name", "id", "type", "title", "year", SOURCE_COLUMN[source], "poster"}
+		headers = append(headers, EXTRA_MEDIA_COLUMNS[source]...)
+		if err := w.Write(append(headers, detailColumns...)); err != nil {
+			return err
+		}
+
+		return s.ForEachCompany(source, func(company *Company) error {
+			var details []string
+			for _, column := range detailColumns {
+				details = append(details, company.Details[column])
+			}
+			if len(company.Media) == 0 {
+				row := []string{company.ID, company.Name, "", "", "", "", "", ""}
+				row = append(row, make([]string, len(EXTRA_MEDIA_COLUMNS[source]))...)
+				return w.Write(append(row, details...))
+			}
+			for _, media := range company.Media {
+				column6 := media.Popularity
+				if source == SOURCE_WIKIDATA {
+					column6 = media.Sitelinks
+				}
+				row := []string{company.ID, company.Name, media.ID, media.Type, media.Title, media.Year, column6, media.Poster}
+				if source == SOURCE_WIKIDATA {
+					row = append(row, media.QID, media.Class, media.Property)
+				}
+				if err := w.Write(append(row, details...)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// ImportTitleCompareCSV replaces the candidates with those written by 001
+func (s *Store) ImportTitleCompareCSV(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	if _, err := csvReader.Read(); err != nil {
+		return 0, err
+	}
+
+	var pairs []*Pair
+	for row := 0; ; row++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		for idx := 2; idx+2 < len(record); idx += 3 {
+			if record[idx] == "" {
+				break
+			}
+			score, err := strconv.ParseFloat(record[idx], 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid score %s for %s", record[idx], record[0])
+			}
+			pairs = append(pairs, &Pair{
+				TmdbID:       record[0],
+				TmdbName:     record[1],
+				QID:          record[idx+1],
+				WikidataName: record[idx+2],
+				NameScore:    score,
+				Rank:         (idx - 2) / 3,
+				Row:          row,
+			})
+		}
+	}
+	return len(pairs), s.ReplacePairs(pairs)
+}
+
+// ExportTitleCompareCSV writes candidates in the layout used by 001
+func (s *Store) ExportTitleCompareCSV(path string, maxResults int) error {
+	pairs, err := s.Pairs()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, func(w *csv.Writer) error {
+		header := []string{"tmdbID", "tmdbName"}
+		for i := 1; i <= maxResults; i++ {
+			prefix := fmt.Sprintf("result%d", i)
+			header = append(header, prefix+"Score", prefix+"ID", prefix+"Name")
+		}
+		if err := w.Write(header); err != nil {
+			return err
+		}
+
+		var row []string
+		flush := func() error {
+			if row == nil {
+				return nil
+			}
+			for len(row) < len(header) {
+				row = append(row, "")
+			}
+			return w.Write(row)
+		}
+		for _, pair := range pairs {
+			if row == nil || row[0] != pair.TmdbID {
+				if err := flush(); err != nil {
+					return err
+				}
+				row = []string{pair.TmdbID, pair.TmdbName}
+			}
+			if len(row) >= len(header) {
+				continue
+			}
+			row = append(row, fmt.Sprintf("%0.6f", pair.NameScore), pair.QID, pair.WikidataName)
+		}
+		return flush()
+	})
+}
+
+// ImportResultCSV replaces the scores with a result csv written by 004
+func (s *Store) ImportResultCSV(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return 0, err
+	}
+	tmdbIDIdx := fileio.FindInSlice(headers, "tmdb_id")
+	wikidataIDIdx := fileio.FindInSlice(headers, "wikidata_id")
+	if tmdbIDIdx == -1 || wikidataIDIdx == -1 {
+		return 0, fmt.Errorf("%s: must have fields tmdb_id, wikidata_id", path)
+	}
+
+	var scores []*Score
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		score := &Score{
+			TmdbID: record[tmdbIDIdx],
+			QID:    record[wikidataIDIdx],
+			Values: make(map[string]string, len(headers)),
+		}
+		for idx, column := range headers {
+			score.Values[column] = record[idx]
+		}
+		scores = append(scores, score)
+	}
+	return len(scores), s.PutScores(headers, scores)
+}
+
+// ExportResultCSV writes the scores with the columns they were imported with
+func (s *Store) ExportResultCSV(path string) error {
+	headers, scores, err := s.Scores()
+	if err != nil {
+		return err
+	}
+	if headers == nil {
+		return fmt.Errorf("no scores in store")
+	}
+
+	return writeFile(path, func(w *csv.Writer) error {
+		if err := w.Write(headers); err != nil {
+			return err
+		}
+		for _, score := range scores {
+			row := make([]string, len(headers))
+			for idx, column := range headers {
+				row[idx] = score.Values[column]
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
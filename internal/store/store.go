@@ -0,0 +1,436 @@
+// Package store keeps pipeline state in an embedded bbolt database.
+//
+// Companies are written one at a time in their own transaction together with
+// their media, so an interrupted download never leaves a half written company
+// and saving does not slow down as the mapping grows.
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/decisions"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	SOURCE_TMDB     = "tmdb"
+	SOURCE_WIKIDATA = "wikidata"
+)
+
+// File extension that selects the store instead of a csv file
+const EXTENSION = ".db"
+
+var (
+	BUCKET_COMPANIES = []byte("companies")
+	BUCKET_MEDIA     = []byte("media")
+	BUCKET_PAIRS     = []byte("pairs")
+	BUCKET_SCORES    = []byte("scores")
+	BUCKET_DECISIONS = []byte("decisions")
+	BUCKET_META      = []byte("meta")
+)
+
+var KEY_SCORES_HEADER = []byte("scores_header")
+
+type Media struct {
+	ID         string `json:"id"`
+	QID        string `json:"qid,omitempty"` // wikidata work, only in the wikidata mapping
+	Class      string `json:"class,omitempty"`
+	Property   string `json:"property,omitempty"` // properties linking the work to the company
+	Type       string `json:"type"`
+	Title      string `json:"title,omitempty"`
+	Year       string `json:"year,omitempty"`
+	Popularity string `json:"popularity,omitempty"`
+	Sitelinks  string `json:"sitelinks,omitempty"`
+	Poster     string `json:"poster,omitempty"`
+}
+
+type Company struct {
+	Source string `json:"source"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	// Company level csv columns, eg origin_country or tmdb_company_ids
+	Details        map[string]string `json:"details,omitempty"`
+	DetailsChecked bool              `json:"details_checked"`
+	Media          []*Media          `json:"-"`
+}
+
+// Pair is a candidate from the title compare stage
+type Pair struct {
+	TmdbID       string  `json:"tmdb_id"`
+	TmdbName     string  `json:"tmdb_name"`
+	QID          string  `json:"qid"`
+	WikidataName string  `json:"wikidata_name"`
+	NameScore    float64 `json:"name_score"`
+	Rank         int     `json:"rank"`
+	// row of the TMDB company in the title compare csv, which is ranked
+	Row int `json:"row"`
+}
+
+// Score is a row from the media ids compare stage, keyed by column name
+type Score struct {
+	TmdbID string            `json:"tmdb_id"`
+	QID    string            `json:"qid"`
+	Values map[string]string `json:"values"`
+}
+
+type decisionRecord struct {
+	TmdbID    string    `json:"tmdb_id"`
+	QID       string    `json:"qid"`
+	Verdict   string    `json:"verdict"`
+	Reviewer  string    `json:"reviewer,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Note      string    `json:"note,omitempty"`
+}
+
+type Store struct {
+	db *bolt.DB
+}
+
+// IsStorePath reports whether path should be opened as a store
+func IsStorePath(path string) bool {
+	return strings.HasSuffix(path, EXTENSION)
+}
+
+// Open opens or creates the store at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BUCKET_COMPANIES, BUCKET_MEDIA, BUCKET_PAIRS, BUCKET_SCORES, BUCKET_DECISIONS, BUCKET_META} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func companyKey(source string, companyID string) []byte {
+	return []byte(source + "/" + companyID)
+}
+
+func mediaPrefix(source string, companyID string) []byte {
+	return []byte(source + "/" + companyID + "/")
+}
+
+func pairKey(tmdbID string, qid string) []byte {
+	return []byte(tmdbID + "/" + qid)
+}
+
+// PutCompany replaces a company and all of its media in a single transaction
+func (s *Store) PutCompany(company *Company) error {
+	return s.PutCompanies([]*Company{company})
+}
+
+// PutCompanies upserts several companies in a single transaction
+func (s *Store) PutCompanies(companies []*Company) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, company := range companies {
+			if err := putCompany(tx, company); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putCompany(tx *bolt.Tx, company *Company) error {
+	if company.Source == "" || company.ID == "" {
+		return fmt.Errorf("company is missing source or id: %+v", company)
+	}
+	data, err := json.Marshal(company)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(BUCKET_COMPANIES).Put(companyKey(company.Source, company.ID), data)
+	if err != nil {
+		return err
+	}
+
+	// media is replaced wholesale so removed media does not linger
+	mediaBucket := tx.Bucket(BUCKET_MEDIA)
+	prefix := mediaPrefix(company.Source, company.ID)
+	cursor := mediaBucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+		if err := mediaBucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	for idx, media := range company.Media {
+		data, err := json.Marshal(media)
+		if err != nil {
+			return err
+		}
+		// index keeps the original order and allows duplicate media ids
+		key := append(append([]byte{}, prefix...), []byte(fmt.Sprintf("%08d", idx))...)
+		if err := mediaBucket.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Company returns a company with its media, or nil if it is not stored
+func (s *Store) Company(source string, companyID string) (*Company, error) {
+	var company *Company
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BUCKET_COMPANIES).Get(companyKey(source, companyID))
+		if data == nil {
+			return nil
+		}
+		company = &Company{}
+		if err := json.Unmarshal(data, company); err != nil {
+			return err
+		}
+		return loadMedia(tx, company)
+	})
+	return company, err
+}
+
+// ForEachCompany calls fn for every company from source in id order
+func (s *Store) ForEachCompany(source string, fn func(company *Company) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(source + "/")
+		cursor := tx.Bucket(BUCKET_COMPANIES).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var company Company
+			if err := json.Unmarshal(v, &company); err != nil {
+				return fmt.Errorf("company %s: %w", k, err)
+			}
+			if err := loadMedia(tx, &company); err != nil {
+				return err
+			}
+			if err := fn(&company); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func loadMedia(tx *bolt.Tx, company *Company) error {
+	prefix := mediaPrefix(company.Source, company.ID)
+	cursor := tx.Bucket(BUCKET_MEDIA).Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		var media Media
+		if err := json.Unmarshal(v, &media); err != nil {
+			return fmt.Errorf("media %s: %w", k, err)
+		}
+		company.Media = append(company.Media, &media)
+	}
+	return nil
+}
+
+// PutPairs upserts candidate pairs in a single transaction
+func (s *Store) PutPairs(pairs []*Pair) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BUCKET_PAIRS)
+		for _, pair := range pairs {
+			data, err := json.Marshal(pair)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(pairKey(pair.TmdbID, pair.QID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReplacePairs replaces all candidate pairs with those of a new title compare
+// run in a single transaction
+func (s *Store) ReplacePairs(pairs []*Pair) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(BUCKET_PAIRS); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(BUCKET_PAIRS)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			data, err := json.Marshal(pair)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(pairKey(pair.TmdbID, pair.QID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Pairs returns all candidate pairs in title compare order, then by rank
+func (s *Store) Pairs() ([]*Pair, error) {
+	var pairs []*Pair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BUCKET_PAIRS).ForEach(func(k, v []byte) error {
+			var pair Pair
+			if err := json.Unmarshal(v, &pair); err != nil {
+				return fmt.Errorf("pair %s: %w", k, err)
+			}
+			pairs = append(pairs, &pair)
+			return nil
+		})
+	})
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].Row != pairs[j].Row {
+			return pairs[i].Row < pairs[j].Row
+		}
+		if pairs[i].TmdbID != pairs[j].TmdbID {
+			return pairs[i].TmdbID < pairs[j].TmdbID
+		}
+		return pairs[i].Rank < pairs[j].Rank
+	})
+	return pairs, err
+}
+
+// PutScores replaces all scores, keeping header as the column order for export
+func (s *Store) PutScores(header []string, scores []*Score) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(BUCKET_SCORES); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(BUCKET_SCORES)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(BUCKET_META).Put(KEY_SCORES_HEADER, data); err != nil {
+			return err
+		}
+		for idx, score := range scores {
+			data, err := json.Marshal(score)
+			if err != nil {
+				return err
+			}
+			// scores are kept in the order they were ranked
+			if err := bucket.Put([]byte(fmt.Sprintf("%08d", idx)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Scores returns the score column order and rows
+func (s *Store) Scores() ([]string, []*Score, error) {
+	var header []string
+	var scores []*Score
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(BUCKET_META).Get(KEY_SCORES_HEADER); data != nil {
+			if err := json.Unmarshal(data, &header); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(BUCKET_SCORES).ForEach(func(k, v []byte) error {
+			var score Score
+			if err := json.Unmarshal(v, &score); err != nil {
+				return fmt.Errorf("score %s: %w", k, err)
+			}
+			scores = append(scores, &score)
+			return nil
+		})
+	})
+	return header, scores, err
+}
+
+// PutDecisions upserts decisions, keeping the newest decision for each pair
+func (s *Store) PutDecisions(decisionList []*decisions.Decision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BUCKET_DECISIONS)
+		for _, decision := range decisionList {
+			key := pairKey(decision.TmdbID, decision.QID)
+			if data := bucket.Get(key); data != nil {
+				var existing decisionRecord
+				if err := json.Unmarshal(data, &existing); err != nil {
+					return err
+				}
+				if existing.Timestamp.After(decision.Timestamp) {
+					continue
+				}
+			}
+			data, err := json.Marshal(decisionRecord(*decision))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Decisions returns all decisions ordered by timestamp
+func (s *Store) Decisions() ([]*decisions.Decision, error) {
+	var decisionList []*decisions.Decision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BUCKET_DECISIONS).ForEach(func(k, v []byte) error {
+			var record decisionRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("decision %s: %w", k, err)
+			}
+			decision := decisions.Decision(record)
+			decisionList = append(decisionList, &decision)
+			return nil
+		})
+	})
+	sort.SliceStable(decisionList, func(i, j int) bool {
+		return decisionList[i].Timestamp.Before(decisionList[j].Timestamp)
+	})
+	return decisionList, err
+}
+
+// decisionsBackend keeps the decisions of a decisions.Store in the store at
+// path, opening it for each read or write so other steps can use it between
+type decisionsBackend struct {
+	path string
+}
+
+func (b *decisionsBackend) Decisions() ([]*decisions.Decision, error) {
+	db, err := Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Decisions()
+}
+
+func (b *decisionsBackend) PutDecisions(decisionList []*decisions.Decision) error {
+	db, err := Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.PutDecisions(decisionList)
+}
+
+// LoadDecisions loads the decisions from a .db store or a decisions csv
+func LoadDecisions(path string) (*decisions.Store, error) {
+	if IsStorePath(path) {
+		return decisions.LoadFrom(path, &decisionsBackend{path: path})
+	}
+	return decisions.Load(path)
+}
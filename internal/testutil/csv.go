@@ -0,0 +1,67 @@
+package testutil
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/fileio"
+)
+
+// ReadCSV reads a csv without the skipped columns, which differ from run to run
+func ReadCSV(t *testing.T, path string, skip ...string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 {
+		return records
+	}
+
+	var keep []int
+	for idx, header := range records[0] {
+		if fileio.FindInSlice(skip, header) == -1 {
+			keep = append(keep, idx)
+		}
+	}
+	var result [][]string
+	for _, record := range records {
+		var row []string
+		for _, idx := range keep {
+			row = append(row, record[idx])
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// CompareCSV reports each row of got that differs from expected, leaving out
+// the skipped columns
+func CompareCSV(t *testing.T, got string, expected string, skip ...string) {
+	t.Helper()
+	gotRecords := ReadCSV(t, got, skip...)
+	expectedRecords := ReadCSV(t, expected, skip...)
+	if reflect.DeepEqual(gotRecords, expectedRecords) {
+		return
+	}
+	for idx := 0; idx < len(gotRecords) || idx < len(expectedRecords); idx++ {
+		var gotRow, expectedRow []string
+		if idx < len(gotRecords) {
+			gotRow = gotRecords[idx]
+		}
+		if idx < len(expectedRecords) {
+			expectedRow = expectedRecords[idx]
+		}
+		if !reflect.DeepEqual(gotRow, expectedRow) {
+			t.Errorf("%s row %d:\n got      %v\n expected %v", filepath.Base(expected), idx, gotRow, expectedRow)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Package testutil holds helpers shared by the tests and benchmarks of the
+// stages
+package testutil
+
+import (
+	"testing"
+
+	"github.com/rohfle/wikidata-contrib/tmdb-companies/internal/stats"
+)
+
+// HeapLimit records the most heap live at the checkpoints of a benchmark
+type HeapLimit struct {
+	Limit uint64
+	peak  uint64
+}
+
+// Checkpoint records the heap live now, with the benchmark timer stopped as it
+// collects garbage
+func (h *HeapLimit) Checkpoint(b *testing.B) {
+	b.StopTimer()
+	defer b.StartTimer()
+	if live := stats.LiveHeap(); live > h.peak {
+		h.peak = live
+	}
+}
+
+// Check reports the peak live heap and fails the benchmark when it is over
+// the limit
+func (h *HeapLimit) Check(b *testing.B) {
+	b.Helper()
+	b.ReportMetric(float64(h.peak)/1024/1024, "peak-live-heap-MB")
+	if h.peak > h.Limit {
+		b.Fatalf("peak live heap %d MB is over the limit of %d MB", h.peak>>20, h.Limit>>20)
+	}
+}
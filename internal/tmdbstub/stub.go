@@ -0,0 +1,45 @@
+// Package tmdbstub serves recorded TMDB responses from a directory, so 002 can
+// be run offline and tested.
+//
+// A request for /3/movie/changes is answered with <dir>/3/movie/changes.json,
+// and page N > 1 of it with <dir>/3/movie/changes.pageN.json. Anything else is
+// a 404, like a removed item on TMDB.
+package tmdbstub
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const NOT_FOUND = `{"success":false,"status_code":34,"status_message":"The resource you requested could not be found."}`
+
+// Handler replays the responses under root, logging each request to logger
+// when it is not nil
+func Handler(root string, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(filepath.Clean("/"+r.URL.Path), "/")
+		if page, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && page > 1 {
+			name += ".page" + strconv.Itoa(page)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		data, err := os.ReadFile(filepath.Join(root, name+".json"))
+		if err != nil {
+			if logger != nil {
+				logger.Printf("404 %s", r.URL.Path)
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(NOT_FOUND))
+			return
+		}
+
+		if logger != nil {
+			logger.Printf("200 %s", r.URL.Path)
+		}
+		w.Write(data)
+	})
+}